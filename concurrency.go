@@ -0,0 +1,385 @@
+/*
+* Tasks and channels: spawn f(args) runs a call on a goroutine of its own and await gets its
+* result back. Tasks share variables the same way closures do, so to keep Environment maps
+* (and everything else) safe, only one task runs Lox code at a time: they take turns holding
+* one lock per program, the GIL. A task lets go of it while it waits (await, send, recv,
+* select, sleep) and every TASK_SLICE statements, so slow natives overlap while the Lox code
+* around them never runs two statements at once. When the main program waits and so does
+* every task, nothing can wake any of them: that's a deadlock, raised as a runtime error
+* at the main program's wait. A program ends once its tasks have: it
+* waits for the ones still running, unless all that's left are tasks stuck waiting on each
+* other, then reports the errors of failed tasks that nobody awaited
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Statements a task runs before giving the others a turn
+const TASK_SLICE = 1000
+
+// How often the end of the program checks on the tasks it's waiting for
+const SETTLE_POLL = 10 * time.Millisecond
+
+// Shared by an interpreter and every task spawned from it
+type taskGroup struct {
+	gil      sync.Mutex
+	running  int32      //tasks that haven't finished, read atomically
+	waiting  int32      //tasks (and the main program) in await, send, recv or select, read atomically
+	progress int64      //waits that have ended, so stuck tasks can be told apart from busy ones
+	failed   []*LoxTask //under the GIL, reported at the end unless something awaited them
+}
+
+// Takes the GIL; every goroutine running Lox code holds it
+func (itpr *Interpreter) acquire() {
+	itpr.tasks.gil.Lock()
+}
+
+func (itpr *Interpreter) release() {
+	itpr.tasks.gil.Unlock()
+}
+
+// Lets the other tasks run while this one waits on wait()
+func (itpr *Interpreter) blocking(wait func()) {
+	itpr.release()
+	defer itpr.acquire()
+	wait()
+}
+
+// Like blocking, for waits that only another task can end (await, send, recv, select).
+// wait gives up when stuck is closed, which only happens to the main program's waits
+func (itpr *Interpreter) waitOnTasks(at Token, wait func(stuck <-chan struct{})) {
+	g := itpr.tasks
+	stuck := make(chan struct{})
+	if itpr.task == nil {
+		done := make(chan struct{})
+		defer close(done)
+		go g.watch(stuck, done)
+	}
+	itpr.blocking(func() {
+		atomic.AddInt32(&g.waiting, 1)
+		wait(stuck)
+		atomic.AddInt64(&g.progress, 1)
+		atomic.AddInt32(&g.waiting, -1)
+	})
+	select {
+	case <-stuck:
+		itpr.error(&RuntimeError{token: at, code: E_RUNTIME, msg: "Deadlock: every task is waiting."})
+	default:
+	}
+}
+
+// Closes stuck once the main program and every task are all waiting and none of their
+// waits has ended for a whole poll, or returns once done is closed
+func (g *taskGroup) watch(stuck chan struct{}, done chan struct{}) {
+	ticker := time.NewTicker(SETTLE_POLL)
+	defer ticker.Stop()
+	progress := int64(-1)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		now := atomic.LoadInt64(&g.progress)
+		if atomic.LoadInt32(&g.waiting) > atomic.LoadInt32(&g.running) && now == progress {
+			close(stuck)
+			return
+		}
+		progress = now
+	}
+}
+
+// Called before each statement; gives way to the other tasks now and then
+func (itpr *Interpreter) checkpoint() {
+	itpr.steps++
+	if itpr.steps < TASK_SLICE {
+		return
+	}
+	itpr.steps = 0
+	if atomic.LoadInt32(&itpr.tasks.running) > 0 {
+		itpr.blocking(runtime.Gosched)
+	}
+}
+
+/**TASKS**/
+type LoxTask struct {
+	name    string
+	done    chan struct{} //closed once result or err is set
+	result  interface{}
+	err     interface{}
+	awaited bool //set under the GIL
+}
+
+func (t *LoxTask) String() string {
+	return fmt.Sprintf("<task %s>", t.name)
+}
+
+// spawn f(args): the callee and arguments are evaluated here, then the call runs on a fresh
+// Interpreter (its own environment pointer, call depth and generators) sharing our globals
+func (itpr *Interpreter) visitSpawnExpr(expr SpawnExpr) interface{} {
+	callee := itpr.evaluate(expr.call.callee)
+	arguments := itpr.arguments(callee, expr.call)
+	function := itpr.callable(callee, arguments, expr.call.paren)
+
+	task := &LoxTask{name: function.calleeName(), done: make(chan struct{})}
+	child := &Interpreter{globals: itpr.globals, environment: itpr.globals, locals: itpr.locals,
+		tracer: itpr.tracer, out: itpr.out, tasks: itpr.tasks, task: task}
+	atomic.AddInt32(&itpr.tasks.running, 1)
+	go func() {
+		child.acquire()
+		defer func() {
+			//an error is kept for whoever awaits the task
+			if err := recover(); err != nil {
+				task.err = err
+				itpr.tasks.failed = append(itpr.tasks.failed, task)
+			}
+			child.closeGenerators()
+			atomic.AddInt32(&itpr.tasks.running, -1)
+			child.release()
+			close(task.done)
+		}()
+		task.result = child.call(function, arguments, expr.call.paren)
+	}()
+	return task
+}
+
+// await task: a task that failed raises its error again here
+func (itpr *Interpreter) visitAwaitExpr(expr AwaitExpr) interface{} {
+	task, ok := itpr.evaluate(expr.value).(*LoxTask)
+	if !ok {
+		itpr.error(&RuntimeError{token: expr.keyword, code: E_TYPE, msg: "Can only await a task."})
+	}
+	task.awaited = true
+	itpr.waitOnTasks(expr.keyword, func(stuck <-chan struct{}) {
+		select {
+		case <-task.done:
+		case <-stuck:
+		}
+	})
+	if task.err != nil {
+		panic(task.err)
+	}
+	return task.result
+}
+
+// Once the main program is done: waits for the tasks still running, then gives back the
+// errors of the ones that failed with nothing awaiting them
+func (itpr *Interpreter) finishTasks() []Diagnostic {
+	itpr.acquire()
+	defer itpr.release()
+	itpr.blocking(itpr.tasks.settle)
+
+	var diagnostics []Diagnostic
+	for _, task := range itpr.tasks.failed {
+		//the debugger's quit command isn't the script's fault
+		if _, quit := task.err.(debuggerQuit); !task.awaited && !quit {
+			diagnostics = append(diagnostics, runtimeDiagnostic(task.err))
+		}
+	}
+	itpr.tasks.failed = nil
+	return diagnostics
+}
+
+// Waits until every task has finished, or until the ones left are all waiting and none of
+// their waits has ended for a whole poll: nothing is left to wake them up
+func (g *taskGroup) settle() {
+	progress := int64(-1)
+	for atomic.LoadInt32(&g.running) > 0 {
+		now := atomic.LoadInt64(&g.progress)
+		if atomic.LoadInt32(&g.waiting) >= atomic.LoadInt32(&g.running) && now == progress {
+			return
+		}
+		progress = now
+		time.Sleep(SETTLE_POLL)
+	}
+}
+
+/**CHANNELS**/
+// channel(capacity): 0 makes every send wait for a recv. closing happens through done
+// rather than close(ch), so a send still waiting when it's closed fails cleanly
+type LoxChannel struct {
+	ch     chan interface{}
+	done   chan struct{}
+	closed bool //set under the GIL
+}
+
+func (c *LoxChannel) String() string {
+	return "<channel>"
+}
+
+func (c *LoxChannel) send(itpr *Interpreter, value interface{}) {
+	sent := false
+	if !c.closed {
+		itpr.waitOnTasks(itpr.callSite, func(stuck <-chan struct{}) {
+			select {
+			case c.ch <- value:
+				sent = true
+			case <-c.done:
+			case <-stuck:
+			}
+		})
+	}
+	if !sent {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_RUNTIME, msg: "Can't send on a closed channel."})
+	}
+}
+
+// The next value, waiting for one if need be; ok is false once the channel is closed and empty
+func (c *LoxChannel) receive(itpr *Interpreter, at Token) (value interface{}, ok bool) {
+	itpr.waitOnTasks(at, func(stuck <-chan struct{}) {
+		select {
+		case value = <-c.ch:
+			ok = true
+		case <-c.done:
+			value, ok = c.drain()
+		case <-stuck:
+		}
+	})
+	return value, ok
+}
+
+// What's still buffered after the channel was closed
+func (c *LoxChannel) drain() (interface{}, bool) {
+	select {
+	case value := <-c.ch:
+		return value, true
+	default:
+		return nil, false
+	}
+}
+
+// send(value), recv() (nil once closed and empty) and close()
+func (c *LoxChannel) method(name string) (*nativeMethod, bool) {
+	switch name {
+	case "send":
+		return &nativeMethod{name: "send", params: 1, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+			c.send(itpr, args[0])
+			return nil
+		}}, true
+	case "recv":
+		return &nativeMethod{name: "recv", fn: func(itpr *Interpreter, args []interface{}) interface{} {
+			value, _ := c.receive(itpr, itpr.callSite)
+			return value
+		}}, true
+	case "close":
+		return &nativeMethod{name: "close", fn: func(itpr *Interpreter, args []interface{}) interface{} {
+			if c.closed {
+				itpr.error(&RuntimeError{token: itpr.callSite, code: E_RUNTIME, msg: "Channel is already closed."})
+			}
+			c.closed = true
+			close(c.done)
+			return nil
+		}}, true
+	}
+	return nil, false
+}
+
+// for-in over a channel receives until it's closed
+type channelIterator struct {
+	itpr    *Interpreter
+	at      Token
+	channel *LoxChannel
+}
+
+func (i *channelIterator) next() (interface{}, bool) {
+	return i.channel.receive(i.itpr, i.at)
+}
+
+type channelNative struct{}
+
+func (c channelNative) arity() int { return 1 }
+
+func (c channelNative) calleeName() string { return "channel" }
+
+func (c channelNative) call(itpr *Interpreter, args []interface{}) interface{} {
+	capacity, ok := toInt(args[0])
+	if !ok || capacity < 0 {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: "channel needs a capacity of 0 or more."})
+	}
+	return &LoxChannel{ch: make(chan interface{}, capacity), done: make(chan struct{})}
+}
+
+func (c channelNative) String() string {
+	return "<native fn>"
+}
+
+// select(channels): waits for whichever channel has a value first and returns
+// [channel, value]; a closed channel is always ready, with nil once it's empty
+type selectNative struct{}
+
+func (s selectNative) arity() int { return 1 }
+
+func (s selectNative) calleeName() string { return "select" }
+
+func (s selectNative) call(itpr *Interpreter, args []interface{}) interface{} {
+	//each channel gets two cases: a value (even) and being closed (odd)
+	var channels []*LoxChannel
+	var cases []reflect.SelectCase
+	list, ok := args[0].(*LoxList)
+	if ok {
+		for _, element := range list.elements {
+			channel, isChannel := element.(*LoxChannel)
+			if !isChannel {
+				ok = false
+				break
+			}
+			channels = append(channels, channel)
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(channel.ch)},
+				reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(channel.done)})
+		}
+	}
+	if !ok || len(channels) == 0 {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: "select needs a list of channels."})
+	}
+
+	var chosen int
+	var value interface{}
+	//the last case is giving up on a deadlock, which waitOnTasks raises
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv})
+	itpr.waitOnTasks(itpr.callSite, func(stuck <-chan struct{}) {
+		cases[len(cases)-1].Chan = reflect.ValueOf(stuck)
+		var received reflect.Value
+		chosen, received, _ = reflect.Select(cases)
+		if chosen == len(cases)-1 {
+			return
+		} else if chosen%2 == 0 {
+			value = received.Interface()
+		} else {
+			value, _ = channels[chosen/2].drain()
+		}
+	})
+	return &LoxList{elements: []interface{}{channels[chosen/2], value}}
+}
+
+func (s selectNative) String() string {
+	return "<native fn>"
+}
+
+// sleep(ms): other tasks carry on in the meantime
+type sleepNative struct{}
+
+func (s sleepNative) arity() int { return 1 }
+
+func (s sleepNative) calleeName() string { return "sleep" }
+
+func (s sleepNative) call(itpr *Interpreter, args []interface{}) interface{} {
+	if !isNumber(args[0]) || toFloat(args[0]) < 0 {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: "sleep needs a number of milliseconds."})
+	}
+	duration := time.Duration(toFloat(args[0]) * float64(time.Millisecond))
+	itpr.blocking(func() { time.Sleep(duration) })
+	return nil
+}
+
+func (s sleepNative) String() string {
+	return "<native fn>"
+}
@@ -0,0 +1,495 @@
+/*
+* Coverage ("glox --coverage=cover.out file.lox"). Attaches to the interpreter as its Tracer
+* and counts statements per line and which way every if/loop condition and and/or went.
+* Results are merged into an LCOV file, so running a whole directory one script at a time
+* adds up, and rendered as an HTML report next to it
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Where a branch is: the if/while/for keyword or the and/or operator
+type BranchSite struct {
+	line   int
+	column int
+}
+
+type Coverage struct {
+	file     string
+	lines    map[int]int            //statements executed per line
+	branches map[BranchSite]*[2]int //[taken, not taken]
+}
+
+func newCoverage(file string) *Coverage {
+	return &Coverage{file: file, lines: make(map[int]int), branches: make(map[BranchSite]*[2]int)}
+}
+
+/**TRACER HOOKS**/
+func (c *Coverage) enterStmt(itpr *Interpreter, stmt Stmt) {
+	if _, isBlock := stmt.(BlockStmt); isBlock {
+		return
+	}
+	c.lines[stmtLine(stmt)]++
+}
+
+func (c *Coverage) enterCall(itpr *Interpreter, callee LoxCallable, paren Token) {}
+
+func (c *Coverage) exitCall(itpr *Interpreter, callee LoxCallable) {}
+
+func (c *Coverage) branch(itpr *Interpreter, at Token, taken bool) {
+	site := BranchSite{line: at.line, column: at.column}
+	if c.branches[site] == nil {
+		c.branches[site] = &[2]int{}
+	}
+	if taken {
+		c.branches[site][0]++
+	} else {
+		c.branches[site][1]++
+	}
+}
+
+/**WHAT COULD HAVE RUN**/
+// Every statement line and branch site in a program, whether it ran or not
+type CoverageSites struct {
+	lines    map[int]bool
+	branches []BranchSite
+}
+
+func findSites(statements []Stmt) *CoverageSites {
+	sites := &CoverageSites{lines: make(map[int]bool)}
+	for _, stmt := range statements {
+		sites.stmt(stmt)
+	}
+	sort.Slice(sites.branches, func(i, j int) bool {
+		a, b := sites.branches[i], sites.branches[j]
+		return a.line < b.line || (a.line == b.line && a.column < b.column)
+	})
+	return sites
+}
+
+func (sites *CoverageSites) stmt(stmt Stmt) {
+	if stmt == nil {
+		return
+	}
+	if _, isBlock := stmt.(BlockStmt); !isBlock {
+		sites.lines[stmtLine(stmt)] = true
+	}
+
+	switch s := stmt.(type) {
+	case BlockStmt:
+		for _, inner := range s.statements {
+			sites.stmt(inner)
+		}
+	case ClassStmt:
+		for _, field := range s.fields {
+			sites.expr(field.initializer)
+		}
+		for _, method := range s.methods {
+			sites.stmt(method)
+		}
+	case ExpressionStmt:
+		sites.expr(s.expression)
+	case ForStmt:
+		sites.stmt(s.initializer)
+		if s.condition != nil {
+			sites.branch(s.keyword)
+			sites.expr(s.condition)
+		}
+		sites.expr(s.increment)
+		sites.stmt(s.body)
+	case ForInStmt:
+		sites.branch(s.keyword)
+		sites.expr(s.iterable)
+		sites.stmt(s.body)
+	case FunctionStmt:
+		for _, value := range s.defaults {
+			if value != nil {
+				sites.expr(value)
+			}
+		}
+		for _, inner := range s.body {
+			sites.stmt(inner)
+		}
+	case IfStmt:
+		sites.branch(s.keyword)
+		sites.expr(s.condition)
+		sites.stmt(s.thenBranch)
+		sites.stmt(s.elseBranch)
+	case PrintStmt:
+		sites.expr(s.expression)
+	case ReturnStmt:
+		sites.expr(s.value)
+	case YieldStmt:
+		sites.expr(s.value)
+	case VarStmt:
+		sites.expr(s.initializer)
+	case WhileStmt:
+		sites.branch(s.keyword)
+		sites.expr(s.condition)
+		sites.stmt(s.body)
+	}
+}
+
+// Expressions only matter for the and/or inside them
+func (sites *CoverageSites) expr(expr Expr) {
+	switch e := expr.(type) {
+	case AssignExpr:
+		sites.expr(e.value)
+	case BinaryExpr:
+		sites.expr(e.left)
+		sites.expr(e.right)
+	case CallExpr:
+		sites.expr(e.callee)
+		for _, arg := range e.arguments {
+			sites.expr(arg)
+		}
+	case ConditionalExpr:
+		sites.branch(e.question)
+		sites.expr(e.condition)
+		sites.expr(e.thenBranch)
+		sites.expr(e.elseBranch)
+	case GetExpr:
+		sites.expr(e.object)
+	case GroupingExpr:
+		sites.expr(e.expression)
+	case IndexExpr:
+		sites.expr(e.object)
+		sites.expr(e.index)
+	case IndexSetExpr:
+		sites.expr(e.object)
+		sites.expr(e.index)
+		sites.expr(e.value)
+	case InterpolationExpr:
+		for _, part := range e.exprs {
+			sites.expr(part)
+		}
+	case ListExpr:
+		for _, element := range e.elements {
+			sites.expr(element)
+		}
+	case MapExpr:
+		for i, key := range e.keys {
+			sites.expr(key)
+			sites.expr(e.values[i])
+		}
+	case LogicalExpr:
+		sites.branch(e.operator)
+		sites.expr(e.left)
+		sites.expr(e.right)
+	case OptionalChainExpr:
+		sites.expr(e.expression)
+	case SetExpr:
+		sites.expr(e.object)
+		sites.expr(e.value)
+	case UnaryExpr:
+		sites.expr(e.right)
+	case AwaitExpr:
+		sites.expr(e.value)
+	case SpawnExpr:
+		sites.expr(e.call)
+	case UpdateExpr:
+		sites.expr(e.target)
+	}
+}
+
+func (sites *CoverageSites) branch(at Token) {
+	sites.branches = append(sites.branches, BranchSite{line: at.line, column: at.column})
+}
+
+/**LCOV**/
+// One source file's worth of an LCOV tracefile
+type LcovRecord struct {
+	file     string
+	lines    map[int]int
+	branches map[[3]int]int //[line, block, branch] -> times taken, -1 if never evaluated ("-")
+}
+
+func newLcovRecord(file string) *LcovRecord {
+	return &LcovRecord{file: file, lines: make(map[int]int), branches: make(map[[3]int]int)}
+}
+
+// This run's counts over every site in the program; blocks number the branch sites on a line
+func (c *Coverage) record(statements []Stmt) *LcovRecord {
+	sites := findSites(statements)
+	path, err := filepath.Abs(c.file)
+	if err != nil {
+		path = c.file
+	}
+	rec := newLcovRecord(path)
+	for line := range sites.lines {
+		rec.lines[line] = c.lines[line]
+	}
+
+	block, lastLine := 0, 0
+	for _, site := range sites.branches {
+		if site.line != lastLine {
+			block, lastLine = 0, site.line
+		}
+		counts := c.branches[site]
+		for branch := 0; branch < 2; branch++ {
+			if counts == nil {
+				rec.branches[[3]int{site.line, block, branch}] = -1
+			} else {
+				rec.branches[[3]int{site.line, block, branch}] = counts[branch]
+			}
+		}
+		block++
+	}
+	return rec
+}
+
+// Adds another run's counts for the same file
+func (rec *LcovRecord) merge(other *LcovRecord) {
+	for line, hits := range other.lines {
+		rec.lines[line] += hits
+	}
+	for key, taken := range other.branches {
+		existing, seen := rec.branches[key]
+		switch {
+		case !seen || existing == -1:
+			rec.branches[key] = taken
+		case taken > 0:
+			rec.branches[key] = existing + taken
+		}
+	}
+}
+
+// Reads the records of an LCOV file (only the parts glox writes)
+func readLcov(r io.Reader) (map[string]*LcovRecord, error) {
+	records := make(map[string]*LcovRecord)
+	var rec *LcovRecord
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kind, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		fields := strings.Split(value, ",")
+		switch {
+		case kind == "SF":
+			rec = newLcovRecord(value)
+			records[value] = rec
+		case kind == "DA" && rec != nil && len(fields) >= 2:
+			line, err1 := strconv.Atoi(fields[0])
+			hits, err2 := strconv.Atoi(fields[1])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("bad line %q", scanner.Text())
+			}
+			rec.lines[line] += hits
+		case kind == "BRDA" && rec != nil && len(fields) == 4:
+			var key [3]int
+			for i := range key {
+				n, err := strconv.Atoi(fields[i])
+				if err != nil {
+					return nil, fmt.Errorf("bad line %q", scanner.Text())
+				}
+				key[i] = n
+			}
+			taken := -1
+			if fields[3] != "-" {
+				n, err := strconv.Atoi(fields[3])
+				if err != nil {
+					return nil, fmt.Errorf("bad line %q", scanner.Text())
+				}
+				taken = n
+			}
+			rec.branches[key] = taken
+		case kind == "end_of_record":
+			rec = nil
+		}
+	}
+	return records, scanner.Err()
+}
+
+func writeLcov(w io.Writer, records map[string]*LcovRecord) {
+	for _, rec := range sortedRecords(records) {
+		fmt.Fprintf(w, "TN:\nSF:%s\n", rec.file)
+
+		lines := sortedLines(rec.lines)
+		hit := 0
+		for _, line := range lines {
+			fmt.Fprintf(w, "DA:%d,%d\n", line, rec.lines[line])
+			if rec.lines[line] > 0 {
+				hit++
+			}
+		}
+
+		keys := make([][3]int, 0, len(rec.branches))
+		for key := range rec.branches {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			for k := 0; k < 3; k++ {
+				if keys[i][k] != keys[j][k] {
+					return keys[i][k] < keys[j][k]
+				}
+			}
+			return false
+		})
+		branchesHit := 0
+		for _, key := range keys {
+			taken := "-"
+			if rec.branches[key] >= 0 {
+				taken = strconv.Itoa(rec.branches[key])
+			}
+			if rec.branches[key] > 0 {
+				branchesHit++
+			}
+			fmt.Fprintf(w, "BRDA:%d,%d,%d,%s\n", key[0], key[1], key[2], taken)
+		}
+
+		fmt.Fprintf(w, "BRF:%d\nBRH:%d\nLF:%d\nLH:%d\nend_of_record\n", len(keys), branchesHit, len(lines), hit)
+	}
+}
+
+func sortedRecords(records map[string]*LcovRecord) []*LcovRecord {
+	list := make([]*LcovRecord, 0, len(records))
+	for _, rec := range records {
+		list = append(list, rec)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].file < list[j].file })
+	return list
+}
+
+func sortedLines(lines map[int]int) []int {
+	list := make([]int, 0, len(lines))
+	for line := range lines {
+		list = append(list, line)
+	}
+	sort.Ints(list)
+	return list
+}
+
+/**HTML REPORT**/
+const COVERAGE_CSS = `body { font-family: sans-serif; margin: 2em; }
+table.summary td, table.summary th { padding: 2px 12px; text-align: left; }
+pre { margin: 0; }
+table.source { border-collapse: collapse; font-family: monospace; width: 100%; }
+table.source td { padding: 0 8px; white-space: pre; }
+td.num, td.hits { color: #888; text-align: right; width: 1%; }
+tr.covered { background: #dfd; }
+tr.uncovered { background: #fdd; }
+tr.partial { background: #ffc; }`
+
+// One page with a summary table and every file's source, lines coloured by coverage
+func writeCoverageHTML(w io.Writer, records map[string]*LcovRecord) {
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>glox coverage</title>\n<style>\n%s\n</style></head><body>\n", COVERAGE_CSS)
+	fmt.Fprintln(w, "<h1>glox coverage</h1>\n<table class=\"summary\"><tr><th>File</th><th>Lines</th><th>Branches</th></tr>")
+	list := sortedRecords(records)
+	for i, rec := range list {
+		lines, linesHit, branches, branchesHit := rec.totals()
+		fmt.Fprintf(w, "<tr><td><a href=\"#file%d\">%s</a></td><td>%s</td><td>%s</td></tr>\n", i, html.EscapeString(rec.file),
+			ratio(linesHit, lines), ratio(branchesHit, branches))
+	}
+	fmt.Fprintln(w, "</table>")
+
+	for i, rec := range list {
+		fmt.Fprintf(w, "<h2 id=\"file%d\">%s</h2>\n", i, html.EscapeString(rec.file))
+		source, err := ioutil.ReadFile(rec.file)
+		if err != nil {
+			fmt.Fprintln(w, "<p>Source not available.</p>")
+			continue
+		}
+
+		//branches that never went one of their ways make a line partial
+		partial := make(map[int]bool)
+		for key, taken := range rec.branches {
+			if taken <= 0 {
+				partial[key[0]] = true
+			}
+		}
+
+		fmt.Fprintln(w, "<table class=\"source\">")
+		for n, text := range strings.Split(strings.TrimSuffix(string(source), "\n"), "\n") {
+			line := n + 1
+			class, hits := "", ""
+			if count, measured := rec.lines[line]; measured {
+				hits = strconv.Itoa(count)
+				switch {
+				case count == 0:
+					class = "uncovered"
+				case partial[line]:
+					class = "partial"
+				default:
+					class = "covered"
+				}
+			}
+			fmt.Fprintf(w, "<tr class=\"%s\"><td class=\"num\">%d</td><td class=\"hits\">%s</td><td>%s</td></tr>\n", class, line, hits, html.EscapeString(text))
+		}
+		fmt.Fprintln(w, "</table>")
+	}
+	fmt.Fprintln(w, "</body></html>")
+}
+
+func (rec *LcovRecord) totals() (lines int, linesHit int, branches int, branchesHit int) {
+	for _, hits := range rec.lines {
+		lines++
+		if hits > 0 {
+			linesHit++
+		}
+	}
+	for _, taken := range rec.branches {
+		branches++
+		if taken > 0 {
+			branchesHit++
+		}
+	}
+	return
+}
+
+func ratio(hit int, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%d (%.1f%%)", hit, total, 100*float64(hit)/float64(total))
+}
+
+/**OUTPUT FILES**/
+// Merges this run into out (LCOV) and rewrites the HTML report beside it
+func (c *Coverage) save(out string, source string) error {
+	scanner := newScanner(source)
+	parser := newParser(scanner.scanTokens())
+	statements := parser.parse()
+	if scanner.hadError || parser.hadError {
+		return fmt.Errorf("%s doesn't parse, so there's nothing to measure", c.file)
+	}
+
+	records := make(map[string]*LcovRecord)
+	if existing, err := os.Open(out); err == nil {
+		records, err = readLcov(existing)
+		existing.Close()
+		if err != nil {
+			return fmt.Errorf("can't merge with %s: %v", out, err)
+		}
+	}
+	rec := c.record(statements)
+	if records[rec.file] == nil {
+		records[rec.file] = newLcovRecord(rec.file)
+	}
+	records[rec.file].merge(rec)
+
+	lcov, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	writeLcov(lcov, records)
+	lcov.Close()
+
+	report, err := os.Create(strings.TrimSuffix(out, filepath.Ext(out)) + ".html")
+	if err != nil {
+		return err
+	}
+	defer report.Close()
+	writeCoverageHTML(report, records)
+	return nil
+}
@@ -0,0 +1,448 @@
+/*
+* Debug adapter ("glox dap") speaking the Debug Adapter Protocol over stdio, so editors can
+* drive the debugger. The program runs on its own goroutine and blocks in stopped() while
+* the editor looks around; requests keep being served on the adapter's goroutine
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**Wire types**/
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type dapStackFrame struct {
+	ID     int       `json:"id"`
+	Name   string    `json:"name"`
+	Line   int       `json:"line"`
+	Column int       `json:"column"`
+	Source dapSource `json:"source"`
+}
+
+type dapScope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type dapBreakpoint struct {
+	Verified bool   `json:"verified"`
+	Line     int    `json:"line"`
+	Message  string `json:"message,omitempty"`
+}
+
+// Tasks take turns under the GIL and the one that stops is the one shown, so they all
+// share this thread id
+const DAP_THREAD = 1
+
+/**Adapter**/
+type DebugAdapter struct {
+	in       *bufio.Reader
+	out      io.Writer
+	writing  sync.Mutex //responses & events come from both goroutines
+	seq      int
+	debugger *Debugger
+	itpr     *Interpreter //the one that stopped last: the program's, or one of its tasks'
+
+	program     string
+	source      string
+	launched    bool
+	configured  bool
+	running     bool //program goroutine started
+	stopOnEntry bool
+
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+	done    chan struct{}
+
+	//things the editor can expand while stopped; rebuilt after every resume
+	handles map[int]interface{} //DebugScope or *LoxInstance
+}
+
+func newDebugAdapter(in io.Reader, out io.Writer) *DebugAdapter {
+	a := &DebugAdapter{in: bufio.NewReader(in), out: out, resumed: make(chan struct{}), done: make(chan struct{}),
+		handles: make(map[int]interface{})}
+	a.debugger = newDebugger("", "", a)
+	return a
+}
+
+// Handles requests until the editor disconnects or closes the stream
+func (a *DebugAdapter) serve() error {
+	for {
+		body, err := readMessage(a.in)
+		if err == io.EOF {
+			a.stop()
+			return nil
+		}
+		if err != nil {
+			a.stop()
+			return err
+		}
+
+		var req dapRequest
+		if err := json.Unmarshal(body, &req); err != nil || req.Type != "request" {
+			continue
+		}
+		if req.Command == "disconnect" || req.Command == "terminate" {
+			a.stop()
+			a.respond(req, nil)
+			return nil
+		}
+		a.handle(req)
+	}
+}
+
+func (a *DebugAdapter) handle(req dapRequest) {
+	switch req.Command {
+	case "initialize":
+		a.respond(req, map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+		})
+		a.event("initialized", nil)
+
+	case "launch":
+		var args struct {
+			Program     string `json:"program"`
+			StopOnEntry bool   `json:"stopOnEntry"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		source, err := ioutil.ReadFile(args.Program)
+		if err != nil {
+			a.fail(req, "could not read "+args.Program)
+			return
+		}
+		a.program, a.source, a.stopOnEntry, a.launched = args.Program, string(source), args.StopOnEntry, true
+		a.debugger.file, a.debugger.source = args.Program, strings.Split(a.source, "\n")
+		a.respond(req, nil)
+		a.start()
+
+	case "setBreakpoints":
+		var args struct {
+			Source      dapSource `json:"source"`
+			Breakpoints []struct {
+				Line int `json:"line"`
+			} `json:"breakpoints"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		var lines []int
+		result := []dapBreakpoint{}
+		for _, bp := range args.Breakpoints {
+			if a.program != "" && !samePath(args.Source.Path, a.program) {
+				result = append(result, dapBreakpoint{Line: bp.Line, Message: "glox only debugs the launched file"})
+				continue
+			}
+			lines = append(lines, bp.Line)
+			result = append(result, dapBreakpoint{Verified: true, Line: bp.Line})
+		}
+		a.debugger.setBreakpoints(lines)
+		a.respond(req, map[string]interface{}{"breakpoints": result})
+
+	case "configurationDone":
+		a.configured = true
+		a.respond(req, nil)
+		a.start()
+
+	case "threads":
+		a.respond(req, map[string]interface{}{"threads": []map[string]interface{}{{"id": DAP_THREAD, "name": "main"}}})
+
+	case "continue":
+		a.resumeWith(req, STEP_CONTINUE, map[string]interface{}{"allThreadsContinued": true})
+	case "next":
+		a.resumeWith(req, STEP_OVER, nil)
+	case "stepIn":
+		a.resumeWith(req, STEP_INTO, nil)
+	case "stepOut":
+		a.resumeWith(req, STEP_OUT, nil)
+	case "pause":
+		a.debugger.pause()
+		a.respond(req, nil)
+
+	case "stackTrace":
+		if !a.isPaused() {
+			a.fail(req, "not stopped")
+			return
+		}
+		d := a.debugger
+		frames := []dapStackFrame{}
+		for i := len(d.frames) - 1; i >= 0; i-- {
+			frames = append(frames, dapStackFrame{ID: i + 1, Name: d.frames[i].name, Line: d.frames[i].line, Column: 1,
+				Source: dapSource{Name: filepath.Base(a.program), Path: a.program}})
+		}
+		a.respond(req, map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)})
+
+	case "scopes":
+		var args struct {
+			FrameID int `json:"frameId"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		frame, ok := a.frame(args.FrameID)
+		if !ok {
+			a.fail(req, "no such frame")
+			return
+		}
+		scopes := []dapScope{}
+		for _, scope := range a.debugger.scopes(a.itpr, frame) {
+			scopes = append(scopes, dapScope{Name: scope.name, VariablesReference: a.newHandle(scope), Expensive: scope.name == "Globals"})
+		}
+		a.respond(req, map[string]interface{}{"scopes": scopes})
+
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		if !a.isPaused() {
+			a.fail(req, "not stopped")
+			return
+		}
+		a.respond(req, map[string]interface{}{"variables": a.variables(a.handles[args.VariablesReference])})
+
+	case "evaluate":
+		var args struct {
+			Expression string `json:"expression"`
+			FrameID    int    `json:"frameId"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		frame, ok := a.frame(args.FrameID)
+		if !ok {
+			a.fail(req, "not stopped")
+			return
+		}
+		value, errMsg := evaluateIn(a.itpr, a.debugger.frameEnv(a.itpr, frame), args.Expression)
+		if errMsg != "" {
+			a.fail(req, errMsg)
+			return
+		}
+		a.respond(req, map[string]interface{}{"result": debugString(a.itpr, value), "variablesReference": a.handleValue(value)})
+
+	default:
+		a.fail(req, "unsupported request "+req.Command)
+	}
+}
+
+/**Running the program**/
+// Starts the program once it's been launched and the editor has sent its breakpoints
+func (a *DebugAdapter) start() {
+	if !a.launched || !a.configured || a.running {
+		return
+	}
+	a.running = true
+
+	runner := newRunner()
+	runner.file = a.program
+	runner.errOut = dapOutput{adapter: a, category: "stderr"}
+	runner.interpreter.out = dapOutput{adapter: a, category: "stdout"}
+	runner.interpreter.tracer = a.debugger
+	a.itpr = runner.interpreter
+	if !a.stopOnEntry {
+		a.debugger.resume(STEP_CONTINUE)
+	}
+
+	go func() {
+		defer close(a.done)
+		runner.run(a.source)
+		runner.finishTasks(a.source)
+
+		exitCode := 0
+		if runner.hadError {
+			exitCode = 65
+		} else if runner.hadRuntimeError {
+			exitCode = 70
+		}
+		a.event("exited", map[string]int{"exitCode": exitCode})
+		a.event("terminated", nil)
+	}()
+}
+
+// DebugFrontend: tells the editor and waits for it to resume us
+func (a *DebugAdapter) stopped(d *Debugger, itpr *Interpreter, reason string) {
+	a.mu.Lock()
+	a.paused = true
+	a.itpr = itpr
+	a.mu.Unlock()
+	a.event("stopped", map[string]interface{}{"reason": reason, "threadId": DAP_THREAD, "allThreadsStopped": true})
+	<-a.resumed
+}
+
+func (a *DebugAdapter) isPaused() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.paused
+}
+
+// Answers the request first so its response comes before anything the program does next
+func (a *DebugAdapter) resumeWith(req dapRequest, mode StepMode, body interface{}) {
+	if !a.isPaused() {
+		a.fail(req, "not stopped")
+		return
+	}
+	a.respond(req, body)
+	a.release(mode)
+}
+
+func (a *DebugAdapter) release(mode StepMode) {
+	a.mu.Lock()
+	a.paused = false
+	a.mu.Unlock()
+	a.handles = make(map[int]interface{})
+	a.debugger.resume(mode)
+	a.resumed <- struct{}{}
+}
+
+// Ends the program (if it's still going) and waits for it to wind down
+func (a *DebugAdapter) stop() {
+	if !a.running {
+		return
+	}
+	a.debugger.quit()
+	if a.isPaused() {
+		a.release(STEP_CONTINUE)
+	}
+	<-a.done
+}
+
+/**Inspection**/
+// Turns a DAP frame id back into a Debugger frame index, if we're stopped
+func (a *DebugAdapter) frame(id int) (int, bool) {
+	if !a.isPaused() {
+		return 0, false
+	}
+	if id == 0 {
+		return len(a.debugger.frames) - 1, true //no frame given means the top one
+	}
+	return id - 1, id >= 1 && id <= len(a.debugger.frames)
+}
+
+func (a *DebugAdapter) newHandle(container interface{}) int {
+	id := len(a.handles) + 1
+	a.handles[id] = container
+	return id
+}
+
+// Instances can be expanded to show their fields; nothing else can
+func (a *DebugAdapter) handleValue(value interface{}) int {
+	if instance, ok := value.(*LoxInstance); ok {
+		return a.newHandle(instance)
+	}
+	return 0
+}
+
+func (a *DebugAdapter) variables(container interface{}) []dapVariable {
+	var names []string
+	var values map[string]interface{}
+	switch c := container.(type) {
+	case DebugScope:
+		names, values = c.variables()
+	case *LoxInstance:
+		values = c.fields
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	variables := []dapVariable{}
+	for _, name := range names {
+		value := values[name]
+		variables = append(variables, dapVariable{Name: name, Value: debugString(a.itpr, value), VariablesReference: a.handleValue(value)})
+	}
+	return variables
+}
+
+/**Output**/
+func (a *DebugAdapter) respond(req dapRequest, body interface{}) {
+	a.send(&dapResponse{Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body})
+}
+
+func (a *DebugAdapter) fail(req dapRequest, msg string) {
+	a.send(&dapResponse{Type: "response", RequestSeq: req.Seq, Success: false, Command: req.Command, Message: msg})
+}
+
+func (a *DebugAdapter) event(name string, body interface{}) {
+	a.send(&dapEvent{Type: "event", Event: name, Body: body})
+}
+
+// Numbers and writes one message; seq has to be set under the same lock as the write
+func (a *DebugAdapter) send(msg interface{}) {
+	a.writing.Lock()
+	defer a.writing.Unlock()
+	a.seq++
+	switch m := msg.(type) {
+	case *dapResponse:
+		m.Seq = a.seq
+	case *dapEvent:
+		m.Seq = a.seq
+	}
+	writeMessage(a.out, msg)
+}
+
+// Program output (print, error reports) becomes "output" events
+type dapOutput struct {
+	adapter  *DebugAdapter
+	category string
+}
+
+func (o dapOutput) Write(p []byte) (int, error) {
+	o.adapter.event("output", map[string]string{"category": o.category, "output": string(p)})
+	return len(p), nil
+}
+
+func samePath(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+/**COMMAND**/
+func runDebugAdapter(in io.Reader, out io.Writer) {
+	//stdout belongs to the protocol, so problems go to stderr
+	if err := newDebugAdapter(in, out).serve(); err != nil {
+		log.Println("glox dap:", err)
+	}
+}
@@ -0,0 +1,221 @@
+// /*
+//   - Drives the debug adapter with the messages an editor would send
+//     */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const dapTestSource = `class Point {
+  init(x, y) {
+    this.x = x;
+    this.y = y;
+  }
+}
+fun makeScaler(k) {
+  fun scale(p) {
+    var result = Point(p.x * k, p.y * k);
+    return result;
+  }
+  return scale;
+}
+var origin = Point(1, 2);
+var scaled = makeScaler(3)(origin);
+print scaled.x;
+`
+
+// Talks to an adapter over pipes; the adapter runs the program on its own
+// goroutine, so replies are waited for instead of read off in a fixed order
+type dapClient struct {
+	t        *testing.T
+	toServer *io.PipeWriter
+	messages chan map[string]json.RawMessage
+	pending  []map[string]json.RawMessage //read but not asked for yet
+	seq      int
+}
+
+func startDAP(t *testing.T) *dapClient {
+	serverIn, toServer := io.Pipe()
+	fromServer, serverOut := io.Pipe()
+	c := &dapClient{t: t, toServer: toServer, messages: make(chan map[string]json.RawMessage, 100)}
+
+	go func() {
+		newDebugAdapter(serverIn, serverOut).serve()
+		serverOut.Close()
+	}()
+	go func() {
+		reader := bufio.NewReader(fromServer)
+		for {
+			body, err := readMessage(reader)
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			var msg map[string]json.RawMessage
+			json.Unmarshal(body, &msg)
+			c.messages <- msg
+		}
+	}()
+	return c
+}
+
+func (c *dapClient) request(command string, args interface{}) int {
+	c.seq++
+	writeMessage(c.toServer, map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	return c.seq
+}
+
+// Next message that matches, keeping the others for later
+func (c *dapClient) waitFor(what string, match func(map[string]json.RawMessage) bool) map[string]json.RawMessage {
+	for i, msg := range c.pending {
+		if match(msg) {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return msg
+		}
+	}
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("adapter closed while waiting for %s", what)
+			}
+			if match(msg) {
+				return msg
+			}
+			c.pending = append(c.pending, msg)
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func (c *dapClient) response(seq int) map[string]json.RawMessage {
+	return c.waitFor("a response", func(msg map[string]json.RawMessage) bool {
+		return string(msg["type"]) == `"response"` && string(msg["request_seq"]) == jsonText(seq)
+	})
+}
+
+func (c *dapClient) event(name string) map[string]json.RawMessage {
+	return c.waitFor(name+" event", func(msg map[string]json.RawMessage) bool {
+		return string(msg["event"]) == jsonText(name)
+	})
+}
+
+// Sends a request and checks what comes back contains everything wanted
+func (c *dapClient) expect(command string, args interface{}, wants ...string) string {
+	reply := c.response(c.request(command, args))
+	text := string(reply["body"]) + string(reply["message"])
+	for _, want := range wants {
+		if !strings.Contains(text, want) {
+			c.t.Errorf("%s: expected %s in %s", command, want, text)
+		}
+	}
+	return string(reply["success"])
+}
+
+func jsonText(v interface{}) string {
+	text, _ := json.Marshal(v)
+	return string(text)
+}
+
+func TestDebugAdapter(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "scale.lox")
+	os.WriteFile(program, []byte(dapTestSource), 0644)
+
+	c := startDAP(t)
+	c.expect("initialize", map[string]string{"adapterID": "glox"}, `"supportsConfigurationDoneRequest":true`)
+	c.event("initialized")
+	c.expect("launch", map[string]interface{}{"program": program})
+	c.expect("setBreakpoints", map[string]interface{}{"source": map[string]string{"path": program}, "breakpoints": []map[string]int{{"line": 10}}},
+		`{"verified":true,"line":10}`)
+	c.expect("configurationDone", nil)
+
+	if stop := string(c.event("stopped")["body"]); !strings.Contains(stop, `"reason":"breakpoint"`) {
+		t.Errorf("expected a breakpoint stop, got %s", stop)
+	}
+	c.expect("threads", nil, `"name":"main"`)
+	c.expect("stackTrace", map[string]int{"threadId": 1}, `{"id":2,"name":"scale","line":10`, `{"id":1,"name":"\u003cscript\u003e","line":15`)
+
+	//scale's own variables, the makeScaler call it closed over, then the globals
+	c.expect("scopes", map[string]int{"frameId": 2},
+		`{"name":"Locals","variablesReference":1`, `{"name":"Closure","variablesReference":2`, `{"name":"Globals","variablesReference":3`)
+	c.expect("variables", map[string]int{"variablesReference": 1},
+		`{"name":"p","value":"Point instance","variablesReference":4}`, `{"name":"result","value":"Point instance","variablesReference":5}`)
+	c.expect("variables", map[string]int{"variablesReference": 2}, `{"name":"k","value":"3"`, `{"name":"scale","value":"\u003cfn scale\u003e"`)
+	c.expect("variables", map[string]int{"variablesReference": 5}, `{"name":"x","value":"3","variablesReference":0},{"name":"y","value":"6"`)
+
+	c.expect("evaluate", map[string]interface{}{"expression": "result.y + k", "frameId": 2}, `"result":"9"`)
+	c.expect("evaluate", map[string]interface{}{"expression": "origin", "frameId": 1}, `"result":"Point instance"`)
+	if ok := c.expect("evaluate", map[string]interface{}{"expression": "nope", "frameId": 2}, "Undefined variable 'nope'."); ok != "false" {
+		t.Errorf("evaluating an undefined variable should fail")
+	}
+
+	//step over the return, back out to the script
+	c.expect("next", map[string]int{"threadId": 1})
+	if stop := string(c.event("stopped")["body"]); !strings.Contains(stop, `"reason":"step"`) {
+		t.Errorf("expected a step stop, got %s", stop)
+	}
+	c.expect("stackTrace", map[string]int{"threadId": 1}, `{"id":1,"name":"\u003cscript\u003e","line":16`)
+
+	c.expect("continue", map[string]int{"threadId": 1})
+	if output := string(c.event("output")["body"]); !strings.Contains(output, `"output":"3\n"`) {
+		t.Errorf("expected the program's print as output, got %s", output)
+	}
+	if exited := string(c.event("exited")["body"]); exited != `{"exitCode":0}` {
+		t.Errorf("expected exit code 0, got %s", exited)
+	}
+	c.event("terminated")
+	c.expect("disconnect", nil)
+}
+
+// Watch expressions are evaluated at every stop; one whose tokens line up with the program's
+// mustn't change how the program runs afterwards
+func TestDebugAdapterWatchKeepsProgram(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "watch.lox")
+	os.WriteFile(program, []byte("fun g() { return len(\"ab\"); }\nfun f(len) {\n  {\n    {\n      print len;\n    }\n  }\n}\nf(1);\nprint g();\n"), 0644)
+
+	c := startDAP(t)
+	c.expect("initialize", nil)
+	c.expect("launch", map[string]interface{}{"program": program})
+	c.expect("setBreakpoints", map[string]interface{}{"source": map[string]string{"path": program}, "breakpoints": []map[string]int{{"line": 5}}})
+	c.expect("configurationDone", nil)
+	c.event("stopped")
+
+	//len lands on line 1, column 18, the same spot as the len g() calls
+	c.expect("evaluate", map[string]interface{}{"expression": "[1, 2, 3, 4, 50][len]", "frameId": 2, "context": "watch"}, `"result":"2"`)
+	c.expect("continue", map[string]int{"threadId": 1})
+	for _, want := range []string{`"output":"1\n"`, `"output":"2\n"`} {
+		if output := string(c.event("output")["body"]); !strings.Contains(output, want) {
+			t.Errorf("expected %s, got %s", want, output)
+		}
+	}
+	if exited := string(c.event("exited")["body"]); exited != `{"exitCode":0}` {
+		t.Errorf("expected exit code 0, got %s", exited)
+	}
+	c.event("terminated")
+	c.expect("disconnect", nil)
+}
+
+// Disconnecting from a paused program ends it instead of leaving it blocked
+func TestDebugAdapterDisconnect(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "scale.lox")
+	os.WriteFile(program, []byte(dapTestSource), 0644)
+
+	c := startDAP(t)
+	c.expect("initialize", nil)
+	c.expect("launch", map[string]interface{}{"program": program, "stopOnEntry": true})
+	c.expect("configurationDone", nil)
+	if stop := string(c.event("stopped")["body"]); !strings.Contains(stop, `"reason":"entry"`) {
+		t.Errorf("expected an entry stop, got %s", stop)
+	}
+	c.expect("disconnect", nil)
+	c.event("terminated")
+}
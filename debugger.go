@@ -0,0 +1,523 @@
+/*
+* Interactive debugger. The Debugger attaches to the interpreter as its Tracer and decides
+* when to pause (breakpoints, steps, pause requests); a DebugFrontend decides what pausing
+* means: reading commands from a terminal ("glox debug file.lox") or talking DAP ("glox dap").
+* Tasks each keep their own frames; whichever one stops is the one the frontend sees
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type StepMode int
+
+const (
+	STEP_CONTINUE StepMode = iota //run until a breakpoint
+	STEP_INTO                     //stop at the very next statement
+	STEP_OVER                     //next statement in this frame or a caller
+	STEP_OUT                      //next statement after this frame returns
+)
+
+// Why the program stopped, in the words DAP uses
+const (
+	STOP_ENTRY      = "entry"
+	STOP_BREAKPOINT = "breakpoint"
+	STOP_STEP       = "step"
+	STOP_PAUSE      = "pause"
+)
+
+const DEBUG_PROMPT = "(glox) "
+
+// Called on the program's goroutine whenever it pauses; returning resumes it
+type DebugFrontend interface {
+	stopped(d *Debugger, itpr *Interpreter, reason string)
+}
+
+// One call on the stack. line is where that frame currently is
+type DebugFrame struct {
+	name    string
+	line    int
+	env     *Environment //where this frame was when it called the next one
+	callEnv *Environment //the frame's own outermost environment, its parents are the closure
+}
+
+// Where an interpreter that isn't running right now left off
+type DebugStack struct {
+	frames   []DebugFrame
+	lastLine int
+}
+
+type Debugger struct {
+	file     string
+	source   []string //lines, for showing where we stopped
+	frontend DebugFrontend
+
+	//frontends may change these while the program runs
+	mu          sync.Mutex
+	breakpoints map[int]bool
+	mode        StepMode
+	pauseAsked  bool
+	quitAsked   bool
+
+	//only touched by whichever goroutine holds the GIL, or while it's stopped
+	stepDepth int          //frame count when a step over/out was asked for
+	stepping  *Interpreter //whose frames stepDepth counts
+	running   *Interpreter //whose frames & lastLine these are
+	frames    []DebugFrame
+	lastLine  int //line of the previous statement, so one line only hits a breakpoint once
+	parked    map[*Interpreter]DebugStack
+	started   bool
+}
+
+// Thrown from a paused statement to end the program on "quit"
+type debuggerQuit struct{}
+
+func newDebugger(file string, source string, frontend DebugFrontend) *Debugger {
+	return &Debugger{file: file, source: strings.Split(source, "\n"), frontend: frontend,
+		breakpoints: make(map[int]bool), mode: STEP_INTO, frames: []DebugFrame{{name: SCRIPT_FRAME}},
+		parked: make(map[*Interpreter]DebugStack)}
+}
+
+/**TRACER HOOKS**/
+func (d *Debugger) enterStmt(itpr *Interpreter, stmt Stmt) {
+	//blocks are just containers, stop at what's in them instead
+	if _, isBlock := stmt.(BlockStmt); isBlock {
+		return
+	}
+
+	d.switchTo(itpr)
+	frame := &d.frames[len(d.frames)-1]
+	if frame.callEnv == nil {
+		frame.callEnv = itpr.environment
+	}
+	line := stmtLine(stmt)
+	frame.line = line
+	newLine := line != d.lastLine
+	d.lastLine = line
+
+	if reason := d.shouldStop(line, newLine); reason != "" {
+		d.frontend.stopped(d, itpr, reason)
+		d.mu.Lock()
+		quit := d.quitAsked
+		d.mu.Unlock()
+		if quit {
+			panic(debuggerQuit{})
+		}
+	}
+}
+
+func (d *Debugger) enterCall(itpr *Interpreter, callee LoxCallable, paren Token) {
+	d.switchTo(itpr)
+	if len(d.frames) > 0 { //a task starts out with no frames at all
+		d.frames[len(d.frames)-1].env = itpr.environment
+	}
+	d.frames = append(d.frames, DebugFrame{name: callee.calleeName(), line: paren.line})
+}
+
+func (d *Debugger) exitCall(itpr *Interpreter, callee LoxCallable) {
+	d.switchTo(itpr)
+	d.frames = d.frames[:len(d.frames)-1]
+	//coming back to the caller counts as a new line even if the call was on it
+	d.lastLine = 0
+}
+
+func (d *Debugger) branch(itpr *Interpreter, at Token, taken bool) {}
+
+// Parks the frames of whoever ran last and brings out itpr's. The first interpreter to
+// show up is the main program, which the script frame was made for
+func (d *Debugger) switchTo(itpr *Interpreter) {
+	if itpr == d.running {
+		return
+	}
+	if d.running != nil && len(d.frames) > 0 { //a task with no frames left is done
+		d.parked[d.running] = DebugStack{frames: d.frames, lastLine: d.lastLine}
+	}
+	if d.running != nil {
+		stack := d.parked[itpr]
+		delete(d.parked, itpr)
+		d.frames, d.lastLine = stack.frames, stack.lastLine
+	}
+	d.running = itpr
+}
+
+// The reason to stop at this statement, or "" to keep going
+func (d *Debugger) shouldStop(line int, newLine bool) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	first := !d.started
+	d.started = true
+	stop := ""
+	switch {
+	case d.quitAsked:
+		panic(debuggerQuit{})
+	case d.pauseAsked:
+		stop = STOP_PAUSE
+	case d.mode == STEP_INTO && first:
+		stop = STOP_ENTRY
+	case d.mode == STEP_INTO,
+		d.mode == STEP_OVER && d.running == d.stepping && len(d.frames) <= d.stepDepth,
+		d.mode == STEP_OUT && d.running == d.stepping && len(d.frames) < d.stepDepth:
+		stop = STOP_STEP
+	case newLine && d.breakpoints[line]:
+		stop = STOP_BREAKPOINT
+	}
+
+	if stop != "" {
+		d.mode, d.pauseAsked = STEP_CONTINUE, false
+	}
+	return stop
+}
+
+/**CONTROLS (for frontends)**/
+// Sets how the program should carry on once the frontend lets it go
+func (d *Debugger) resume(mode StepMode) {
+	d.mu.Lock()
+	d.mode, d.stepDepth, d.stepping = mode, len(d.frames), d.running
+	d.mu.Unlock()
+}
+
+// Stops at the next statement, whatever it is
+func (d *Debugger) pause() {
+	d.mu.Lock()
+	d.pauseAsked = true
+	d.mu.Unlock()
+}
+
+// Ends the program at the next statement
+func (d *Debugger) quit() {
+	d.mu.Lock()
+	d.quitAsked = true
+	d.mu.Unlock()
+}
+
+func (d *Debugger) setBreakpoint(line int, on bool) {
+	d.mu.Lock()
+	if on {
+		d.breakpoints[line] = true
+	} else {
+		delete(d.breakpoints, line)
+	}
+	d.mu.Unlock()
+}
+
+// Replaces every breakpoint at once (DAP sends the whole list for a file)
+func (d *Debugger) setBreakpoints(lines []int) {
+	d.mu.Lock()
+	d.breakpoints = make(map[int]bool)
+	for _, line := range lines {
+		d.breakpoints[line] = true
+	}
+	d.mu.Unlock()
+}
+
+/**INSPECTION (only while stopped)**/
+// Environment a frame is currently running in; frame 0 is the script
+func (d *Debugger) frameEnv(itpr *Interpreter, frame int) *Environment {
+	if frame == len(d.frames)-1 {
+		return itpr.environment
+	}
+	return d.frames[frame].env
+}
+
+// A named slice of the Environment chain
+type DebugScope struct {
+	name string
+	envs []*Environment //innermost first
+}
+
+// Splits a frame's Environment chain into its locals, the closure it was defined in, and the globals
+func (d *Debugger) scopes(itpr *Interpreter, frame int) []DebugScope {
+	locals := DebugScope{name: "Locals"}
+	closure := DebugScope{name: "Closure"}
+	inLocals := true
+	for env := d.frameEnv(itpr, frame); env != itpr.globals && env != nil; env = env.enclosing {
+		if inLocals {
+			locals.envs = append(locals.envs, env)
+		} else {
+			closure.envs = append(closure.envs, env)
+		}
+		if env == d.frames[frame].callEnv {
+			inLocals = false
+		}
+	}
+
+	scopes := []DebugScope{locals}
+	if len(closure.envs) > 0 {
+		scopes = append(scopes, closure)
+	}
+	return append(scopes, DebugScope{name: "Globals", envs: []*Environment{itpr.globals}})
+}
+
+// Variables of a scope sorted by name; inner environments shadow outer ones
+func (s DebugScope) variables() ([]string, map[string]interface{}) {
+	values := make(map[string]interface{})
+	for i := len(s.envs) - 1; i >= 0; i-- {
+		for name, value := range s.envs[i].values {
+			values[name] = value
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, values
+}
+
+/**TERMINAL FRONTEND**/
+type DebugConsole struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func newDebugConsole(in io.Reader, out io.Writer) *DebugConsole {
+	return &DebugConsole{in: bufio.NewReader(in), out: out}
+}
+
+// Shows where we are and reads commands until one of them resumes the program
+func (c *DebugConsole) stopped(d *Debugger, itpr *Interpreter, reason string) {
+	c.showLine(d, d.frames[len(d.frames)-1].line, "stopped at")
+
+	for {
+		fmt.Fprint(c.out, DEBUG_PROMPT)
+		input, err := c.in.ReadString('\n')
+		if err != nil && input == "" {
+			d.quit() //ran out of commands
+			return
+		}
+
+		command, arg := splitCommand(strings.TrimSpace(input))
+		switch command {
+		case "":
+		case "b", "break":
+			c.setBreakpoint(d, arg, true)
+		case "d", "delete":
+			c.setBreakpoint(d, arg, false)
+		case "c", "continue":
+			d.resume(STEP_CONTINUE)
+			return
+		case "s", "step":
+			d.resume(STEP_INTO)
+			return
+		case "n", "next":
+			d.resume(STEP_OVER)
+			return
+		case "o", "out", "finish":
+			if len(d.frames) == 1 {
+				fmt.Fprintln(c.out, "Already in the outermost frame.")
+				continue
+			}
+			d.resume(STEP_OUT)
+			return
+		case "p", "print":
+			c.print(itpr, arg)
+		case "l", "locals":
+			c.locals(itpr)
+		case "bt", "stack":
+			c.stack(d)
+		case "q", "quit":
+			d.quit()
+			return
+		case "h", "help":
+			fmt.Fprintln(c.out, "break LINE, delete LINE, continue, step, next, out, print EXPR, locals, stack, quit")
+		default:
+			fmt.Fprintf(c.out, "Unknown command %q (try help).\n", command)
+		}
+	}
+}
+
+func (c *DebugConsole) setBreakpoint(d *Debugger, arg string, on bool) {
+	line, err := strconv.Atoi(arg)
+	if err != nil || line < 1 || line > len(d.source) {
+		fmt.Fprintf(c.out, "Not a line number: %q\n", arg)
+		return
+	}
+	d.setBreakpoint(line, on)
+	if on {
+		c.showLine(d, line, "breakpoint at")
+	}
+}
+
+// Evaluates an expression as if it were written at the paused statement
+func (c *DebugConsole) print(itpr *Interpreter, source string) {
+	value, err := evaluateIn(itpr, itpr.environment, source)
+	if err != "" {
+		fmt.Fprintln(c.out, err)
+		return
+	}
+	fmt.Fprintln(c.out, debugString(itpr, value))
+}
+
+// Every variable between here and the globals, innermost scope first
+func (c *DebugConsole) locals(itpr *Interpreter) {
+	if itpr.environment == itpr.globals {
+		fmt.Fprintln(c.out, "No locals at the top level.")
+		return
+	}
+	for env, depth := itpr.environment, 0; env != itpr.globals && env != nil; env, depth = env.enclosing, depth+1 {
+		names, values := DebugScope{envs: []*Environment{env}}.variables()
+		for _, name := range names {
+			fmt.Fprintf(c.out, "  [%d] %s = %s\n", depth, name, inspect(itpr, values[name]))
+		}
+	}
+}
+
+func (c *DebugConsole) stack(d *Debugger) {
+	for i := len(d.frames) - 1; i >= 0; i-- {
+		fmt.Fprintf(c.out, "#%d %s at %s:%d\n", len(d.frames)-1-i, d.frames[i].name, d.file, d.frames[i].line)
+	}
+}
+
+func (c *DebugConsole) showLine(d *Debugger, line int, what string) {
+	text := ""
+	if line >= 1 && line <= len(d.source) {
+		text = strings.TrimSpace(d.source[line-1])
+	}
+	fmt.Fprintf(c.out, "%s %s:%d: %s\n", what, d.file, line, text)
+}
+
+/**HELPERS**/
+func splitCommand(input string) (string, string) {
+	parts := strings.SplitN(input, " ", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], strings.TrimSpace(parts[1])
+}
+
+// Like stringify, but strings get quotes so "nil" and nil look different
+func debugString(itpr *Interpreter, value interface{}) string {
+	if str, ok := value.(string); ok {
+		return strconv.Quote(str)
+	}
+	return inspect(itpr, value)
+}
+
+// Stringifies a value while paused: __str__ runs without stopping at breakpoints, and one
+// that fails falls back to the plain "X instance"
+func inspect(itpr *Interpreter, value interface{}) (str string) {
+	tracer, hadRuntimeError := itpr.tracer, itpr.hadRuntimeError
+	itpr.tracer = nil
+	defer func() {
+		itpr.tracer = tracer
+		if err := recover(); err != nil {
+			itpr.hadRuntimeError = hadRuntimeError
+			str = fmt.Sprint(value)
+		}
+	}()
+	return itpr.stringify(value)
+}
+
+// Parses & runs one expression as if it were written where env is.
+// The resolver never saw it, so it gets scopes rebuilt from the live Environment chain.
+// What the resolver finds goes in a scratch locals map, so evaluating leaves nothing behind
+// in the program's
+func evaluateIn(itpr *Interpreter, env *Environment, source string) (value interface{}, errMsg string) {
+	scanner := newScanner(source)
+	parser := newParser(scanner.scanTokens())
+	expr := parseExpression(parser)
+	if scanner.hadError || parser.hadError || expr == nil {
+		diagnostics := append(scanner.diagnostics, parser.diagnostics...)
+		if len(diagnostics) == 0 {
+			return nil, "Expect expression."
+		}
+		return nil, diagnostics[0].msg
+	}
+
+	scratch := &Interpreter{locals: make(map[Token]int)}
+	resolver := newResolver(scratch)
+	resolver.curClass = SUBCLASS //let this & super through, the environment decides if they exist
+	var envs []*Environment
+	for e := env; e != itpr.globals && e != nil; e = e.enclosing {
+		envs = append(envs, e)
+	}
+	for i := len(envs) - 1; i >= 0; i-- {
+		scope := make(map[string]bool)
+		for name := range envs[i].values {
+			scope[name] = true
+		}
+		resolver.scopes.push(scope)
+	}
+	resolver.resolveExpr(expr)
+
+	//functions the expression calls still need the program's own locals
+	locals := make(map[Token]int, len(itpr.locals)+len(scratch.locals))
+	for name, depth := range itpr.locals {
+		locals[name] = depth
+	}
+	for name, depth := range scratch.locals {
+		locals[name] = depth
+	}
+
+	//calls made by the expression shouldn't stop at breakpoints
+	tracer, environment, programLocals, hadRuntimeError := itpr.tracer, itpr.environment, itpr.locals, itpr.hadRuntimeError
+	itpr.tracer, itpr.environment, itpr.locals = nil, env, locals
+	defer func() {
+		itpr.tracer, itpr.environment, itpr.locals = tracer, environment, programLocals
+		if err := recover(); err != nil {
+			itpr.hadRuntimeError = hadRuntimeError
+			switch e := err.(type) {
+			case RuntimeError:
+				errMsg = e.msg
+			case *RuntimeError:
+				errMsg = e.msg
+			default:
+				errMsg = fmt.Sprint("Can't evaluate that here: ", err)
+			}
+		}
+	}()
+	return itpr.evaluate(expr), ""
+}
+
+// A lone expression with nothing after it, nil on a parse error
+func parseExpression(p *Parser) (expr Expr) {
+	defer func() {
+		if err := recover(); err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				panic(err)
+			}
+			expr = nil
+		}
+	}()
+	expr = p.expression()
+	if !p.isAtEnd() {
+		p.error(&ParseError{token: p.peek(), code: E_SYNTAX, msg: "Expect end of expression."})
+	}
+	return expr
+}
+
+/**COMMAND**/
+// glox debug file.lox; commands come from stdin
+func runDebug(path string, in io.Reader, out io.Writer) int {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(out, "Error: could not read", path)
+		return 66
+	}
+
+	runner := newRunner()
+	runner.file = path
+	runner.errOut = out
+	runner.interpreter.tracer = newDebugger(path, string(source), newDebugConsole(in, out))
+	runner.run(string(source))
+	runner.finishTasks(string(source))
+
+	if runner.hadError {
+		return 65
+	}
+	if runner.hadRuntimeError {
+		return 70
+	}
+	return 0
+}
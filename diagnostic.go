@@ -0,0 +1,193 @@
+/*
+* One shared shape for every error the scanner, parser, resolver and interpreter report,
+* plus the renderers that turn them into rustc-style snippets, one-liners or JSON
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Severity int
+
+const (
+	SEV_ERROR Severity = iota
+	SEV_WARNING
+	SEV_NOTE
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SEV_WARNING:
+		return "warning"
+	case SEV_NOTE:
+		return "note"
+	}
+	return "error"
+}
+
+// Which stage of the pipeline found the problem
+type Phase int
+
+const (
+	SCAN_PHASE Phase = iota
+	PARSE_PHASE
+	RESOLVE_PHASE
+	RUNTIME_PHASE
+)
+
+func (p Phase) String() string {
+	switch p {
+	case SCAN_PHASE:
+		return "scan"
+	case PARSE_PHASE:
+		return "parse"
+	case RESOLVE_PHASE:
+		return "resolve"
+	}
+	return "runtime"
+}
+
+// Error codes, grouped by phase (1xx scan, 2xx parse, 3xx resolve, 4xx runtime)
+const (
+	E_UNEXPECTED_CHAR      = "E101"
+	E_UNTERMINATED_STRING  = "E102"
+	E_INVALID_UTF8         = "E103"
+	E_BAD_ESCAPE           = "E104"
+	E_UNTERMINATED_COMMENT = "E105"
+	E_BAD_NUMBER           = "E106"
+
+	E_SYNTAX         = "E201"
+	E_INVALID_TARGET = "E202"
+	E_TOO_MANY       = "E203"
+	E_EXPECTED_EXPR  = "E204"
+
+	E_REDECLARED     = "E301"
+	E_SELF_INIT      = "E302"
+	E_BAD_RETURN     = "E303"
+	E_BAD_THIS_SUPER = "E304"
+	E_SELF_INHERIT   = "E305"
+	E_BAD_LOOP_JUMP  = "E306"
+	E_DUPLICATE_BASE = "E307"
+
+	E_TYPE      = "E401"
+	E_UNDEFINED = "E402"
+	E_CALL      = "E403"
+	E_RUNTIME   = "E404"
+	E_ASSERT    = "E405"
+	E_INTERNAL  = "E499" //a bug in glox itself, never the script's fault
+)
+
+type Diagnostic struct {
+	severity Severity
+	phase    Phase
+	code     string
+	file     string
+	line     int
+	column   int
+	length   int //how many columns the caret underline covers
+	msg      string
+}
+
+// Builds an error diagnostic pointing at the given token
+func newDiagnostic(phase Phase, code string, token Token, msg string) Diagnostic {
+	//only underline up to the end of the first line of the lexeme
+	lexeme, _, _ := strings.Cut(token.lexeme, "\n")
+	length := len([]rune(lexeme))
+	if length == 0 {
+		length = 1
+	}
+	return Diagnostic{severity: SEV_ERROR, phase: phase, code: code, line: token.line, column: token.column, length: length, msg: msg}
+}
+
+// file:line:col: error[code]: msg
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s[%s]: %s", d.file, d.line, d.column, d.severity, d.code, d.msg)
+}
+
+/**RENDERING**/
+const (
+	HUMAN_FORMAT = "human"
+	SHORT_FORMAT = "short"
+	JSON_FORMAT  = "json"
+)
+
+// Checks a value given to --error-format
+func validErrorFormat(format string) bool {
+	return format == HUMAN_FORMAT || format == SHORT_FORMAT || format == JSON_FORMAT
+}
+
+// Writes a diagnostic in the requested format, using source to show the offending line
+func renderDiagnostic(w io.Writer, d Diagnostic, format string, source string) {
+	switch format {
+	case JSON_FORMAT:
+		renderJSON(w, d)
+	case SHORT_FORMAT:
+		fmt.Fprintln(w, d.String())
+	default:
+		renderHuman(w, d, source)
+	}
+}
+
+// rustc style: header, location arrow, then the source line with a caret underline
+func renderHuman(w io.Writer, d Diagnostic, source string) {
+	fmt.Fprintf(w, "%s[%s]: %s\n", d.severity, d.code, d.msg)
+
+	gutter := strings.Repeat(" ", len(fmt.Sprint(d.line)))
+	fmt.Fprintf(w, "%s--> %s:%d:%d\n", gutter, d.file, d.line, d.column)
+
+	lines := strings.Split(source, "\n")
+	if d.line < 1 || d.line > len(lines) {
+		return
+	}
+	text := strings.TrimRight(lines[d.line-1], "\r")
+
+	//keep tabs in the caret line so it lines up under the source
+	var pad strings.Builder
+	for i, c := range []rune(text) {
+		if i >= d.column-1 {
+			break
+		}
+		if c == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+	//columns past the end of the line (eg. "at end") still get spaced out
+	for i := len([]rune(text)); i < d.column-1; i++ {
+		pad.WriteRune(' ')
+	}
+
+	fmt.Fprintf(w, "%s |\n", gutter)
+	fmt.Fprintf(w, "%d | %s\n", d.line, text)
+	fmt.Fprintf(w, "%s | %s%s\n", gutter, pad.String(), strings.Repeat("^", d.length))
+}
+
+// Field names here are what editors and CI scripts read, so they're stable
+type jsonDiagnostic struct {
+	Severity string `json:"severity"`
+	Phase    string `json:"phase"`
+	Code     string `json:"code"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	EndCol   int    `json:"endColumn"`
+	Message  string `json:"message"`
+}
+
+func (d Diagnostic) toJSON() jsonDiagnostic {
+	return jsonDiagnostic{Severity: d.severity.String(), Phase: d.phase.String(), Code: d.code, File: d.file,
+		Line: d.line, Column: d.column, EndCol: d.column + d.length, Message: d.msg}
+}
+
+// One JSON object per line so a stream of diagnostics is easy to consume
+func renderJSON(w io.Writer, d Diagnostic) {
+	data, _ := json.Marshal(d.toJSON())
+	fmt.Fprintln(w, string(data))
+}
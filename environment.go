@@ -1,7 +1,7 @@
 /*
 * File to organize where variables are stored in a Hash Map structure
 * Created: 10/2
-* Modified: 10/7
+* Modified: 10/19
  */
 
 package main
@@ -32,9 +32,7 @@ func (env *Environment) get(name Token) interface{} {
 	}
 
 	//if doesnt exist anywhere, "throws" the error
-	err := RuntimeError{token: name, msg: fmt.Sprintf("Undefined variable '%s'", name.lexeme)}
-	fmt.Println(err.Error())
-	panic(err)
+	panic(RuntimeError{token: name, code: E_UNDEFINED, msg: fmt.Sprintf("Undefined variable '%s'.", name.lexeme)})
 }
 
 func (env *Environment) assign(name Token, value interface{}) {
@@ -51,9 +49,7 @@ func (env *Environment) assign(name Token, value interface{}) {
 	}
 
 	//if nowhere, "throw" and error
-	err := RuntimeError{token: name, msg: fmt.Sprintf("Undefined variable '%s'.", name.lexeme)}
-	fmt.Println(err.Error())
-	panic(err)
+	panic(RuntimeError{token: name, code: E_UNDEFINED, msg: fmt.Sprintf("Undefined variable '%s'.", name.lexeme)})
 }
 
 //Binds a new name-value pair
@@ -2,12 +2,12 @@
 * Class to format expression grammar
 * Automated in text, done manually here because generate made no sense to me
 * Created 9/10
-* Modified: 10/8
+* Modified: 10/19
  */
 
 package main
 
-//import "fmt"
+import "strings"
 
 // The "super" class
 type Expr interface {
@@ -18,6 +18,13 @@ type Expr interface {
 type AssignExpr struct {
 	name  Token
 	value Expr
+	operator Token //= or a compound one like +=
+}
+
+//await task: waits for a spawned call to finish and gives back what it returned
+type AwaitExpr struct {
+	keyword Token
+	value Expr
 }
 
 type BinaryExpr struct {
@@ -30,19 +37,84 @@ type CallExpr struct {
 	callee Expr
 	paren Token
 	arguments []Expr
+	spreads []Token //the "..." before each argument spread from a list (a zero Token for the others)
+	names []Token //the name before each named argument (a zero Token for the others)
+}
+
+//The "..." before argument i, if it's spread from a list
+func (c CallExpr) spreadAt(i int) (Token, bool) {
+	if c.spreads == nil || c.spreads[i].kind != ELLIPSIS {
+		return Token{}, false
+	}
+	return c.spreads[i], true
+}
+
+//The name of argument i, if it's passed by name
+func (c CallExpr) nameAt(i int) (Token, bool) {
+	if c.names == nil || c.names[i].kind != IDENTIFIER {
+		return Token{}, false
+	}
+	return c.names[i], true
 }
 
 type GetExpr struct {
 	object Expr
 	name Token
+	optional bool //a?.b, which gives nil when a is nil
+}
+
+//condition ? thenBranch : elseBranch
+type ConditionalExpr struct {
+	condition Expr
+	question Token
+	thenBranch Expr
+	elseBranch Expr
 }
 
 type GroupingExpr struct {
+	paren Token
 	expression Expr
 }
 
+//"Hi ${name}!" - segments are the string pieces around the expressions, one more of them than exprs
+//object[index]; bracket is the closing ] (like CallExpr's paren)
+type IndexExpr struct {
+	object Expr
+	bracket Token
+	index Expr
+}
+
+type IndexSetExpr struct {
+	object Expr
+	bracket Token
+	index Expr
+	value Expr
+	operator Token
+}
+
+type InterpolationExpr struct {
+	segments []Token
+	exprs []Expr
+}
+
+//[a, b, c]
+type ListExpr struct {
+	bracket Token
+	elements []Expr
+	closing Token
+}
+
+//{key: value, ...}
+type MapExpr struct {
+	brace Token
+	keys []Expr
+	values []Expr
+	closing Token
+}
+
 type LiteralExpr struct {
 	value interface{}
+	token Token //how it was spelled in the source
 }
 
 type LogicalExpr struct {
@@ -51,10 +123,22 @@ type LogicalExpr struct {
 	right Expr
 }
 
+//A call/property chain with a ?. in it, so a nil can end the whole chain early
+type OptionalChainExpr struct {
+	expression Expr
+}
+
 type SetExpr struct {
 	object Expr
 	name Token
 	value Expr
+	operator Token
+}
+
+//spawn f(args): runs the call as a task of its own
+type SpawnExpr struct {
+	keyword Token
+	call CallExpr
 }
 
 type SuperExpr struct {
@@ -71,6 +155,13 @@ type UnaryExpr struct {
 	right    Expr
 }
 
+//++x, x++, --x and x-- on a variable, field or index
+type UpdateExpr struct {
+	target Expr
+	operator Token
+	prefix bool
+}
+
 type VariableExpr struct {
 	name Token
 }
@@ -78,16 +169,26 @@ type VariableExpr struct {
 /**Visitor struct/class**/
 type Visitor interface {
 	visitAssignExpr(expr AssignExpr) interface{}
+	visitAwaitExpr(expr AwaitExpr) interface{}
 	visitBinaryExpr(expr BinaryExpr) interface{}
 	visitCallExpr(expr CallExpr) interface{}
+	visitConditionalExpr(expr ConditionalExpr) interface{}
 	visitGetExpr(expr GetExpr) interface{}
 	visitGroupingExpr(expr GroupingExpr) interface{}
+	visitIndexExpr(expr IndexExpr) interface{}
+	visitIndexSetExpr(expr IndexSetExpr) interface{}
+	visitInterpolationExpr(expr InterpolationExpr) interface{}
+	visitListExpr(expr ListExpr) interface{}
 	visitLiteralExpr(expr LiteralExpr) interface{}
 	visitLogicalExpr(expr LogicalExpr) interface{}
+	visitMapExpr(expr MapExpr) interface{}
+	visitOptionalChainExpr(expr OptionalChainExpr) interface{}
 	visitSetExpr(expr SetExpr) interface{}
+	visitSpawnExpr(expr SpawnExpr) interface{}
 	visitSuperExpr(expr SuperExpr) interface{}
 	visitThisExpr(expr ThisExpr) interface{}
 	visitUnaryExpr(expr UnaryExpr) interface{}
+	visitUpdateExpr(expr UpdateExpr) interface{}
 	visitVariableExpr(expr VariableExpr) interface{}
 }
 
@@ -96,6 +197,10 @@ func (expr AssignExpr) accept(v Visitor) interface{} {
 	return v.visitAssignExpr(expr)
 }
 
+func (expr AwaitExpr) accept(v Visitor) interface{} {
+	return v.visitAwaitExpr(expr)
+}
+
 func (expr BinaryExpr) accept(v Visitor) interface{} {
 	return v.visitBinaryExpr(expr)
 }
@@ -104,6 +209,10 @@ func (expr CallExpr) accept(v Visitor) interface{} {
 	return v.visitCallExpr(expr)
 }
 
+func (expr ConditionalExpr) accept(v Visitor) interface{} {
+	return v.visitConditionalExpr(expr)
+}
+
 func (expr GetExpr) accept(v Visitor) interface{} {
 	return v.visitGetExpr(expr)
 }
@@ -112,6 +221,22 @@ func (expr GroupingExpr) accept(v Visitor) interface{} {
 	return v.visitGroupingExpr(expr)
 }
 
+func (expr IndexExpr) accept(v Visitor) interface{} {
+	return v.visitIndexExpr(expr)
+}
+
+func (expr IndexSetExpr) accept(v Visitor) interface{} {
+	return v.visitIndexSetExpr(expr)
+}
+
+func (expr InterpolationExpr) accept(v Visitor) interface{} {
+	return v.visitInterpolationExpr(expr)
+}
+
+func (expr ListExpr) accept(v Visitor) interface{} {
+	return v.visitListExpr(expr)
+}
+
 func (expr LiteralExpr) accept(v Visitor) interface{} {
 	return v.visitLiteralExpr(expr)
 }
@@ -120,10 +245,22 @@ func (expr LogicalExpr) accept(v Visitor) interface{} {
 	return v.visitLogicalExpr(expr)
 }
 
+func (expr MapExpr) accept(v Visitor) interface{} {
+	return v.visitMapExpr(expr)
+}
+
+func (expr OptionalChainExpr) accept(v Visitor) interface{} {
+	return v.visitOptionalChainExpr(expr)
+}
+
 func (expr SetExpr) accept(v Visitor) interface{} {
 	return v.visitSetExpr(expr)
 }
 
+func (expr SpawnExpr) accept(v Visitor) interface{} {
+	return v.visitSpawnExpr(expr)
+}
+
 func (expr SuperExpr) accept(v Visitor) interface{} {
 	return v.visitSuperExpr(expr)
 }
@@ -136,6 +273,116 @@ func (expr UnaryExpr) accept(v Visitor) interface{} {
 	return v.visitUnaryExpr(expr)
 }
 
+func (expr UpdateExpr) accept(v Visitor) interface{} {
+	return v.visitUpdateExpr(expr)
+}
+
 func (expr VariableExpr) accept(v Visitor) interface{} {
 	return v.visitVariableExpr(expr)
 }
+
+/**POSITIONS**/
+//Leftmost token in an expression
+func exprToken(expr Expr) Token {
+	switch e := expr.(type) {
+	case AssignExpr:
+		return e.name
+	case AwaitExpr:
+		return e.keyword
+	case BinaryExpr:
+		return exprToken(e.left)
+	case CallExpr:
+		return exprToken(e.callee)
+	case ConditionalExpr:
+		return exprToken(e.condition)
+	case GetExpr:
+		return exprToken(e.object)
+	case GroupingExpr:
+		return e.paren
+	case IndexExpr:
+		return exprToken(e.object)
+	case IndexSetExpr:
+		return exprToken(e.object)
+	case InterpolationExpr:
+		return e.segments[0]
+	case ListExpr:
+		return e.bracket
+	case LiteralExpr:
+		return e.token
+	case LogicalExpr:
+		return exprToken(e.left)
+	case MapExpr:
+		return e.brace
+	case OptionalChainExpr:
+		return exprToken(e.expression)
+	case SetExpr:
+		return exprToken(e.object)
+	case SpawnExpr:
+		return e.keyword
+	case SuperExpr:
+		return e.keyword
+	case ThisExpr:
+		return e.keyword
+	case UnaryExpr:
+		return e.operator
+	case UpdateExpr:
+		if e.prefix {
+			return e.operator
+		}
+		return exprToken(e.target)
+	case VariableExpr:
+		return e.name
+	}
+	return Token{}
+}
+
+//Line the rightmost token in an expression ends on (a string literal can run over several)
+func exprEndLine(expr Expr) int {
+	switch e := expr.(type) {
+	case AssignExpr:
+		return exprEndLine(e.value)
+	case AwaitExpr:
+		return exprEndLine(e.value)
+	case BinaryExpr:
+		return exprEndLine(e.right)
+	case CallExpr:
+		return e.paren.line
+	case ConditionalExpr:
+		return exprEndLine(e.elseBranch)
+	case GetExpr:
+		return e.name.line
+	case GroupingExpr:
+		return exprEndLine(e.expression)
+	case IndexExpr:
+		return e.bracket.line
+	case IndexSetExpr:
+		return exprEndLine(e.value)
+	case ListExpr:
+		return e.closing.line
+	case InterpolationExpr:
+		last := e.segments[len(e.segments)-1]
+		return last.line + strings.Count(last.lexeme, "\n")
+	case LiteralExpr:
+		return e.token.line + strings.Count(e.token.lexeme, "\n")
+	case LogicalExpr:
+		return exprEndLine(e.right)
+	case MapExpr:
+		return e.closing.line
+	case OptionalChainExpr:
+		return exprEndLine(e.expression)
+	case SetExpr:
+		return exprEndLine(e.value)
+	case SpawnExpr:
+		return e.call.paren.line
+	case SuperExpr:
+		return e.method.line
+	case UnaryExpr:
+		return exprEndLine(e.right)
+	case UpdateExpr:
+		if e.prefix {
+			return exprEndLine(e.target)
+		}
+		return e.operator.line
+	}
+	return exprToken(expr).line
+}
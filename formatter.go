@@ -0,0 +1,540 @@
+/*
+* Pretty-prints a parsed Lox program back out in one canonical layout ("glox fmt").
+* Walks the syntax tree as both an expression and statement visitor, and weaves the
+* comments the scanner kept as trivia back in by source position. Expressions always come
+* out on one line, so a comment inside one (say between two arguments) moves to the end of
+* its statement's line, after any comment already there; comments between statements and
+* members stay where they were
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+const FORMAT_INDENT = "  "
+
+type Formatter struct {
+	lines      []string
+	indent     int
+	pending    string    //prefix for the next line, eg. "if (x) " in front of a body
+	comments   []Comment //every comment in the file, in source order
+	next       int       //first comment not printed yet
+	lastLine   int       //source line of the last thing printed, to keep blank lines
+	blockStart bool      //nothing printed yet in the current block
+}
+
+// Formats a whole source file, or returns the diagnostics that stopped it parsing
+func formatSource(source string) (string, []Diagnostic) {
+	scanner := newScanner(source)
+	tokens := scanner.scanTokens()
+	parser := newParser(tokens)
+	statements := parser.parse()
+	if scanner.hadError || parser.hadError {
+		return "", append(scanner.diagnostics, parser.diagnostics...)
+	}
+
+	f := &Formatter{blockStart: true}
+	for _, t := range tokens {
+		f.comments = append(f.comments, t.comments()...)
+	}
+
+	f.stmts(statements, tokens[len(tokens)-1])
+	if len(f.lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(f.lines, "\n") + "\n", nil
+}
+
+/**OUTPUT HELPERS**/
+// Writes one line at the current indent, using up any pending prefix
+func (f *Formatter) line(text string) {
+	f.lines = append(f.lines, strings.Repeat(FORMAT_INDENT, f.indent)+f.pending+text)
+	f.pending = ""
+	f.blockStart = false
+}
+
+// Keeps (at most) one blank line wherever the source had some
+func (f *Formatter) blankLineBefore(line int) {
+	if !f.blockStart && f.pending == "" && line > f.lastLine+1 {
+		f.lines = append(f.lines, "")
+	}
+}
+
+// Prints every comment that starts before the given token
+func (f *Formatter) flushComments(until Token) {
+	for f.commentsBefore(until) {
+		c := f.comments[f.next]
+		f.next++
+		//no trailing whitespace, even where a comment runs to the end of the file
+		text := strings.TrimRight(c.text, " \t\r\n")
+
+		if c.trailing && f.pending == "" && len(f.lines) > 0 {
+			//stays on the end of the line it was on
+			f.lines[len(f.lines)-1] += " " + text
+		} else {
+			f.blankLineBefore(c.line)
+			//block comments keep their own inner layout
+			commentLines := strings.Split(text, "\n")
+			for i := range commentLines {
+				commentLines[i] = strings.TrimRight(commentLines[i], " \t\r")
+			}
+			f.line(commentLines[0])
+			f.lines = append(f.lines, commentLines[1:]...)
+		}
+		//comments moved out of an expression are behind the statement just printed
+		if end := c.line + strings.Count(c.text, "\n"); end > f.lastLine {
+			f.lastLine = end
+		}
+	}
+}
+
+// Prints a list of statements, then the comments left before the closing token
+func (f *Formatter) stmts(statements []Stmt, closing Token) {
+	for _, stmt := range statements {
+		f.flushComments(stmtToken(stmt))
+		f.blankLineBefore(stmtLine(stmt))
+		stmt.accept(f)
+		f.lastLine = stmtEndLine(stmt)
+	}
+	f.flushComments(closing)
+}
+
+// Prints a "{ ... }" body, or "{}" if there is nothing in it at all
+func (f *Formatter) braces(header string, statements []Stmt, closing Token) {
+	if len(statements) == 0 && !f.commentsBefore(closing) {
+		f.line(header + "{}")
+		return
+	}
+
+	f.line(header + "{")
+	f.indent++
+	f.blockStart = true
+	f.stmts(statements, closing)
+	f.indent--
+	f.line("}")
+	f.lastLine = closing.line
+}
+
+// Whether any unprinted comment starts before the given token
+func (f *Formatter) commentsBefore(t Token) bool {
+	return f.next < len(f.comments) && before(f.comments[f.next].line, f.comments[f.next].column, t)
+}
+
+// Prints the body of an if/while/for on the same line as its header
+func (f *Formatter) body(header string, body Stmt) {
+	f.pending += header + " "
+	f.flushComments(stmtToken(body))
+	body.accept(f)
+}
+
+func (f *Formatter) expr(expr Expr) string {
+	return expr.accept(f).(string)
+}
+
+// name(a, b) for functions and methods alike
+func (f *Formatter) signature(fun FunctionStmt) string {
+	prefix := ""
+	if fun.isStatic {
+		prefix = "class "
+	} else if fun.isSetter {
+		prefix = "set "
+	}
+	if fun.isGetter {
+		return prefix + fun.name.lexeme + " "
+	}
+
+	var params []string
+	for i, p := range fun.params {
+		param := p.lexeme
+		if fun.hasRest && i == len(fun.params)-1 {
+			param = "..." + param
+		} else if fun.defaults != nil && fun.defaults[i] != nil {
+			param += " = " + f.expr(fun.defaults[i])
+		}
+		params = append(params, param)
+	}
+	return prefix + fun.name.lexeme + "(" + strings.Join(params, ", ") + ") "
+}
+
+/**STATEMENT VISITORS**/
+func (f *Formatter) visitBlockStmt(stmt BlockStmt) interface{} {
+	f.braces("", stmt.statements, stmt.closing)
+	return nil
+}
+
+func (f *Formatter) visitBreakStmt(stmt BreakStmt) interface{} {
+	f.line("break;")
+	return nil
+}
+
+func (f *Formatter) visitClassStmt(stmt ClassStmt) interface{} {
+	header := "class " + stmt.name.lexeme + " "
+	if stmt.superclass != nil {
+		header += "< " + stmt.superclass.name.lexeme + " "
+	}
+	if len(stmt.traits) > 0 {
+		var traits []string
+		for _, trait := range stmt.traits {
+			traits = append(traits, trait.name.lexeme)
+		}
+		header += "with " + strings.Join(traits, ", ") + " "
+	}
+
+	if len(stmt.methods) == 0 && len(stmt.fields) == 0 && !f.commentsBefore(stmt.closing) {
+		f.line(header + "{}")
+		return nil
+	}
+
+	//fields and methods, back in the order they were written
+	var members []Stmt
+	for _, field := range stmt.fields {
+		members = append(members, field)
+	}
+	for _, m := range stmt.methods {
+		members = append(members, m)
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		a, b := stmtToken(members[i]), stmtToken(members[j])
+		return before(a.line, a.column, b)
+	})
+
+	f.line(header + "{")
+	f.indent++
+	f.blockStart = true
+	for _, member := range members {
+		first := stmtToken(member)
+		f.flushComments(first)
+		f.blankLineBefore(first.line)
+		if m, isMethod := member.(FunctionStmt); isMethod {
+			f.braces(f.signature(m), m.body, m.closing)
+		} else {
+			member.accept(f)
+			f.lastLine = stmtEndLine(member)
+		}
+	}
+	f.flushComments(stmt.closing)
+	f.indent--
+	f.line("}")
+	return nil
+}
+
+func (f *Formatter) visitContinueStmt(stmt ContinueStmt) interface{} {
+	f.line("continue;")
+	return nil
+}
+
+func (f *Formatter) visitExpressionStmt(stmt ExpressionStmt) interface{} {
+	f.line(f.expr(stmt.expression) + ";")
+	return nil
+}
+
+func (f *Formatter) visitForStmt(stmt ForStmt) interface{} {
+	header := "for ("
+	switch init := stmt.initializer.(type) {
+	case nil:
+		header += ";"
+	case VarStmt:
+		header += f.varDecl(init)
+	case ExpressionStmt:
+		header += f.expr(init.expression) + ";"
+	}
+
+	if stmt.condition != nil {
+		header += " " + f.expr(stmt.condition)
+	}
+	header += ";"
+	if stmt.increment != nil {
+		header += " " + f.expr(stmt.increment)
+	}
+
+	f.body(header+")", stmt.body)
+	return nil
+}
+
+func (f *Formatter) visitForInStmt(stmt ForInStmt) interface{} {
+	f.body("for (var "+stmt.name.lexeme+" in "+f.expr(stmt.iterable)+")", stmt.body)
+	return nil
+}
+
+func (f *Formatter) visitFunctionStmt(stmt FunctionStmt) interface{} {
+	f.braces("fun "+f.signature(stmt), stmt.body, stmt.closing)
+	return nil
+}
+
+func (f *Formatter) visitIfStmt(stmt IfStmt) interface{} {
+	f.body("if ("+f.expr(stmt.condition)+")", stmt.thenBranch)
+	if stmt.elseBranch == nil {
+		return nil
+	}
+
+	//"} else" when the then branch was a block, otherwise else starts its own line
+	last := len(f.lines) - 1
+	if _, isBlock := stmt.thenBranch.(BlockStmt); isBlock && strings.TrimSpace(f.lines[last]) == "}" {
+		f.lines = f.lines[:last]
+		f.pending = "} "
+	}
+	f.body("else", stmt.elseBranch)
+	return nil
+}
+
+func (f *Formatter) visitPrintStmt(stmt PrintStmt) interface{} {
+	f.line("print " + f.expr(stmt.expression) + ";")
+	return nil
+}
+
+func (f *Formatter) visitReturnStmt(stmt ReturnStmt) interface{} {
+	if stmt.value == nil {
+		f.line("return;")
+	} else {
+		f.line("return " + f.expr(stmt.value) + ";")
+	}
+	return nil
+}
+
+func (f *Formatter) visitYieldStmt(stmt YieldStmt) interface{} {
+	if stmt.value == nil {
+		f.line("yield;")
+	} else {
+		f.line("yield " + f.expr(stmt.value) + ";")
+	}
+	return nil
+}
+
+func (f *Formatter) visitVarStmt(stmt VarStmt) interface{} {
+	f.line(f.varDecl(stmt))
+	return nil
+}
+
+func (f *Formatter) varDecl(stmt VarStmt) string {
+	if stmt.initializer == nil {
+		return "var " + stmt.name.lexeme + ";"
+	}
+	return "var " + stmt.name.lexeme + " = " + f.expr(stmt.initializer) + ";"
+}
+
+func (f *Formatter) visitWhileStmt(stmt WhileStmt) interface{} {
+	f.body("while ("+f.expr(stmt.condition)+")", stmt.body)
+	return nil
+}
+
+/**EXPRESSION VISITORS**/
+func (f *Formatter) visitAssignExpr(expr AssignExpr) interface{} {
+	return expr.name.lexeme + " " + expr.operator.lexeme + " " + f.expr(expr.value)
+}
+
+func (f *Formatter) visitBinaryExpr(expr BinaryExpr) interface{} {
+	return f.expr(expr.left) + " " + expr.operator.lexeme + " " + f.expr(expr.right)
+}
+
+func (f *Formatter) visitCallExpr(expr CallExpr) interface{} {
+	var args []string
+	for i, arg := range expr.arguments {
+		prefix := ""
+		if _, spread := expr.spreadAt(i); spread {
+			prefix = "..."
+		} else if name, named := expr.nameAt(i); named {
+			prefix = name.lexeme + ": "
+		}
+		args = append(args, prefix+f.expr(arg))
+	}
+	return f.expr(expr.callee) + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (f *Formatter) visitConditionalExpr(expr ConditionalExpr) interface{} {
+	return f.expr(expr.condition) + " ? " + f.expr(expr.thenBranch) + " : " + f.expr(expr.elseBranch)
+}
+
+func (f *Formatter) visitGetExpr(expr GetExpr) interface{} {
+	if expr.optional {
+		return f.expr(expr.object) + "?." + expr.name.lexeme
+	}
+	return f.expr(expr.object) + "." + expr.name.lexeme
+}
+
+func (f *Formatter) visitGroupingExpr(expr GroupingExpr) interface{} {
+	return "(" + f.expr(expr.expression) + ")"
+}
+
+func (f *Formatter) visitIndexExpr(expr IndexExpr) interface{} {
+	return f.expr(expr.object) + "[" + f.expr(expr.index) + "]"
+}
+
+func (f *Formatter) visitIndexSetExpr(expr IndexSetExpr) interface{} {
+	return f.expr(expr.object) + "[" + f.expr(expr.index) + "] " + expr.operator.lexeme + " " + f.expr(expr.value)
+}
+
+func (f *Formatter) visitInterpolationExpr(expr InterpolationExpr) interface{} {
+	//the pieces keep their source spelling ("Hi ${ and }!"), the expressions get formatted
+	var str strings.Builder
+	for i, segment := range expr.segments {
+		str.WriteString(segment.lexeme)
+		if i < len(expr.exprs) {
+			str.WriteString(f.expr(expr.exprs[i]))
+		}
+	}
+	return str.String()
+}
+
+func (f *Formatter) visitListExpr(expr ListExpr) interface{} {
+	var elements []string
+	for _, element := range expr.elements {
+		elements = append(elements, f.expr(element))
+	}
+	return "[" + strings.Join(elements, ", ") + "]"
+}
+
+func (f *Formatter) visitLiteralExpr(expr LiteralExpr) interface{} {
+	//keep the source spelling of numbers & strings
+	if expr.token.lexeme != "" {
+		return expr.token.lexeme
+	}
+	if expr.value == nil {
+		return "nil"
+	}
+	if str, ok := expr.value.(string); ok {
+		return "\"" + str + "\""
+	}
+	return fmt.Sprint(expr.value)
+}
+
+func (f *Formatter) visitLogicalExpr(expr LogicalExpr) interface{} {
+	return f.expr(expr.left) + " " + expr.operator.lexeme + " " + f.expr(expr.right)
+}
+
+func (f *Formatter) visitOptionalChainExpr(expr OptionalChainExpr) interface{} {
+	return f.expr(expr.expression)
+}
+
+func (f *Formatter) visitMapExpr(expr MapExpr) interface{} {
+	var entries []string
+	for i, key := range expr.keys {
+		entries = append(entries, f.expr(key)+": "+f.expr(expr.values[i]))
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+func (f *Formatter) visitSetExpr(expr SetExpr) interface{} {
+	return f.expr(expr.object) + "." + expr.name.lexeme + " " + expr.operator.lexeme + " " + f.expr(expr.value)
+}
+
+func (f *Formatter) visitSuperExpr(expr SuperExpr) interface{} {
+	return "super." + expr.method.lexeme
+}
+
+func (f *Formatter) visitThisExpr(expr ThisExpr) interface{} {
+	return "this"
+}
+
+func (f *Formatter) visitUnaryExpr(expr UnaryExpr) interface{} {
+	right := f.expr(expr.right)
+	//"- -x" and "- --x" must not run together
+	if strings.HasPrefix(right, "-") && expr.operator.kind == MINUS {
+		return expr.operator.lexeme + " " + right
+	}
+	return expr.operator.lexeme + right
+}
+
+func (f *Formatter) visitAwaitExpr(expr AwaitExpr) interface{} {
+	return "await " + f.expr(expr.value)
+}
+
+func (f *Formatter) visitSpawnExpr(expr SpawnExpr) interface{} {
+	return "spawn " + f.expr(expr.call)
+}
+
+func (f *Formatter) visitUpdateExpr(expr UpdateExpr) interface{} {
+	if expr.prefix {
+		return expr.operator.lexeme + f.expr(expr.target)
+	}
+	return f.expr(expr.target) + expr.operator.lexeme
+}
+
+func (f *Formatter) visitVariableExpr(expr VariableExpr) interface{} {
+	return expr.name.lexeme
+}
+
+/**COMMAND**/
+// glox fmt [-w] [--check] [files...]; with no files it formats stdin to stdout. Errors
+// go to stderr so they never end up in formatted output
+func runFormat(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := flags.Bool("w", false, "write the result back to each file instead of printing it")
+	check := flags.Bool("check", false, "only list files that aren't formatted, exit 1 if there are any")
+	if err := flags.Parse(args); err != nil {
+		return 64
+	}
+
+	if flags.NArg() == 0 {
+		source, _ := ioutil.ReadAll(stdin)
+		formatted, diagnostics := formatSource(string(source))
+		if diagnostics != nil {
+			reportAll(stderr, "<stdin>", string(source), diagnostics)
+			return 65
+		}
+		fmt.Fprint(stdout, formatted)
+		return 0
+	}
+
+	status := 0
+	for _, path := range flags.Args() {
+		source, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error: could not read", path)
+			status = 1
+			continue
+		}
+
+		formatted, diagnostics := formatSource(string(source))
+		if diagnostics != nil {
+			reportAll(stderr, path, string(source), diagnostics)
+			status = 65
+			continue
+		}
+
+		switch {
+		case *check:
+			if formatted != string(source) {
+				fmt.Fprintln(stdout, path)
+				if status == 0 {
+					status = 1
+				}
+			}
+		case *write:
+			if formatted != string(source) {
+				if err := writeFormatted(path, formatted); err != nil {
+					fmt.Fprintln(stderr, "Error: could not write", path+":", err)
+					status = 1
+				}
+			}
+		default:
+			fmt.Fprint(stdout, formatted)
+		}
+	}
+	return status
+}
+
+// Rewrites path in place, keeping its permissions
+func writeFormatted(path string, formatted string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(formatted), info.Mode())
+}
+
+// Renders diagnostics for a command that isn't going through a Runner
+func reportAll(w io.Writer, file string, source string, diagnostics []Diagnostic) {
+	for _, d := range diagnostics {
+		d.file = file
+		renderDiagnostic(w, d, HUMAN_FORMAT, source)
+	}
+}
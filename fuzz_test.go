@@ -0,0 +1,171 @@
+// /*
+//   - Native Go fuzz targets for the scanner, parser, resolver & interpreter.
+//     Crashers land in testdata/fuzz/<Target>/ and plain "go test" replays them
+//     */
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Statements a fuzzed program may run before it's stopped; enough for every seed to finish
+const FUZZ_STEP_BUDGET = 20000
+
+// Stops runaway programs (while (true) {}) with an ordinary Lox runtime error
+type stepBudget struct {
+	steps int
+}
+
+func (b *stepBudget) enterStmt(itpr *Interpreter, stmt Stmt) {
+	b.steps++
+	if b.steps > FUZZ_STEP_BUDGET {
+		itpr.error(&RuntimeError{token: Token{line: stmtLine(stmt)}, code: E_RUNTIME, msg: "Step budget exceeded."})
+	}
+}
+func (b *stepBudget) enterCall(itpr *Interpreter, callee LoxCallable, paren Token) {}
+func (b *stepBudget) exitCall(itpr *Interpreter, callee LoxCallable)               {}
+func (b *stepBudget) branch(itpr *Interpreter, at Token, taken bool)               {}
+
+// Every tests/*.lox file, plus a few snippets aimed at the edges of each phase
+func addSeeds(f *testing.F) {
+	files, _ := filepath.Glob(filepath.Join("tests", "*.lox"))
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(source))
+	}
+	for _, seed := range []string{"", "\"", "/", "1.", "\xff", "fun f(){f();}f();", "while(true){}", "a=b=c;", "class A<A{}", "super.x;",
+		"var c = channel(0); fun f() { c.send(1); } spawn f(); print c.recv(); print await spawn f();", "var asleep = \"sleep\";"} {
+		f.Add(seed)
+	}
+}
+
+// Scanning and parsing run outside interpret()'s recover, so any panic reaches the fuzzer as is
+func FuzzScanner(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, source string) {
+		scanner := newScanner(source)
+		tokens := scanner.scanTokens()
+		if len(tokens) == 0 || tokens[len(tokens)-1].kind != EOF {
+			t.Fatalf("token stream doesn't end in EOF: %v", tokens)
+		}
+		line := 1
+		for _, token := range tokens {
+			if token.line < line {
+				t.Fatalf("token %q on line %d comes after line %d", token.lexeme, token.line, line)
+			}
+			line = token.line
+		}
+		if scanner.hadError != (len(scanner.diagnostics) > 0) {
+			t.Fatalf("hadError is %v with diagnostics %v", scanner.hadError, scanner.diagnostics)
+		}
+	})
+}
+
+func FuzzParser(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, source string) {
+		parser := newParser(newScanner(source).scanTokens())
+		statements := parser.parse()
+		if parser.hadError != (len(parser.diagnostics) > 0) {
+			t.Fatalf("hadError is %v with diagnostics %v", parser.hadError, parser.diagnostics)
+		}
+		if !parser.hadError {
+			newResolver(newInterpreter()).resolveStmts(statements)
+		}
+	})
+}
+
+// The whole pipeline under a step budget: the only errors allowed are the ones Lox documents
+func FuzzInterpreter(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, source string) {
+		for _, d := range runFuzzed(t, ioutil.Discard, source) {
+			if d.code == E_INTERNAL {
+				t.Fatalf("Go panic escaped as a Lox error: %s", d.msg)
+			}
+		}
+	})
+}
+
+// Differential: a program and its formatted self must print the same and fail the same way
+func FuzzFormatter(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, source string) {
+		formatted, diagnostics := formatSource(source)
+		if diagnostics != nil {
+			return
+		}
+		if again, _ := formatSource(formatted); again != formatted {
+			t.Fatalf("formatting isn't idempotent:\n%s\nthen\n%s", formatted, again)
+		}
+
+		//tasks can take turns in a different order each run, and print in it
+		if hasToken(source, func(token Token) bool { return token.kind == SPAWN }) {
+			return
+		}
+		var before, after strings.Builder
+		for _, d := range runFuzzed(t, &before, source) {
+			before.WriteString(d.msg + "\n")
+		}
+		for _, d := range runFuzzed(t, &after, formatted) {
+			after.WriteString(d.msg + "\n")
+		}
+		if before.String() != after.String() {
+			t.Fatalf("formatting changed what the program does:\n%s\nbecame\n%s\nprinting %q instead of %q", source, formatted, after.String(), before.String())
+		}
+	})
+}
+
+// How long a fuzzed program gets. The step budget ends runaway tasks and the deadlock check
+// ends ones waiting on each other, so one still running after this is a bug
+const FUZZ_DEADLINE = 10 * time.Second
+
+// Whether any of the scanned tokens match, so an identifier like "asleep" or a string
+// saying "spawn" doesn't count
+func hasToken(source string, match func(Token) bool) bool {
+	for _, token := range newScanner(source).scanTokens() {
+		if match(token) {
+			return true
+		}
+	}
+	return false
+}
+
+// sleep really waits, and the step budget can't cut a long one short
+func callsSleep(token Token) bool {
+	return token.kind == IDENTIFIER && token.lexeme == "sleep"
+}
+
+// Runs source like the runner does, tasks and all, returning every diagnostic from every phase
+func runFuzzed(t *testing.T, out io.Writer, source string) []Diagnostic {
+	if hasToken(source, callsSleep) {
+		return nil
+	}
+	runner := newRunner()
+	runner.errOut = ioutil.Discard
+	runner.interpreter.out = out
+	runner.interpreter.tracer = &stepBudget{} //tasks share it, taking turns under the GIL
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runner.run(source)
+		runner.finishTasks(source)
+		runner.interpreter.closeGenerators()
+	}()
+	select {
+	case <-done:
+	case <-time.After(FUZZ_DEADLINE):
+		t.Fatalf("still running after %v:\n%s", FUZZ_DEADLINE, source)
+	}
+	return runner.reported
+}
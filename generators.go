@@ -0,0 +1,231 @@
+/*
+* Generators: calling a function with a yield in it returns a generator instead of running it.
+* The body runs on its own goroutine, but only ever while the caller waits for it, so the two
+* hand the Interpreter back and forth over channels and never run at the same time. That keeps
+* the suspended body's Go stack (and every executeBlock under it) intact between next() calls
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// What a resumed body did: yielded a value, finished (done), or raised an error (panicked)
+type generatorStep struct {
+	value    interface{}
+	done     bool
+	panicked interface{}
+}
+
+// Raised at a suspended yield when the generator is closed, so the body unwinds like a return
+type generatorClosed struct{}
+
+type generatorState struct {
+	itpr     *Interpreter
+	name     string
+	resume   chan bool //true asks the body to close instead of carrying on
+	steps    chan generatorStep
+	running  bool
+	finished bool
+	peeked   *generatorStep //what hasNext() ran ahead to, handed out by the next next()
+}
+
+// The Lox value; the goroutine only holds the state, so this can be garbage collected while
+// the body is still suspended, and the finalizer then gets the body closed
+type LoxGenerator struct {
+	state *generatorState
+}
+
+func (g *LoxGenerator) String() string {
+	return fmt.Sprintf("<generator %s>", g.state.name)
+}
+
+func newGenerator(itpr *Interpreter, f LoxFunction, env *Environment) *LoxGenerator {
+	itpr.closeAbandonedGenerators()
+
+	state := &generatorState{itpr: itpr, name: f.declaration.name.lexeme, resume: make(chan bool), steps: make(chan generatorStep)}
+	if itpr.generators == nil {
+		itpr.generators = make(map[*generatorState]bool)
+	}
+	itpr.generators[state] = true
+	go state.run(f, env)
+
+	generator := &LoxGenerator{state: state}
+	runtime.SetFinalizer(generator, func(g *LoxGenerator) {
+		itpr.generatorMu.Lock()
+		itpr.abandoned = append(itpr.abandoned, g.state)
+		itpr.generatorMu.Unlock()
+	})
+	return generator
+}
+
+// The body's goroutine: waits to be resumed, then runs until a yield hands control back
+func (g *generatorState) run(f LoxFunction, env *Environment) {
+	defer func() {
+		step := generatorStep{done: true}
+		switch err := recover().(type) {
+		case nil, Return, generatorClosed:
+		default:
+			step.panicked = err
+		}
+		g.steps <- step
+	}()
+
+	if close := <-g.resume; close {
+		return
+	}
+	g.itpr.executeBlock(f.declaration.body, env)
+}
+
+// Runs the body to its next yield (or its end), on behalf of whoever is calling
+func (g *generatorState) step(close bool) generatorStep {
+	if g.finished {
+		return generatorStep{done: true}
+	}
+	itpr := g.itpr
+	if g.running {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_RUNTIME, msg: fmt.Sprintf("Generator '%s' is already running.", g.name)})
+	}
+
+	//the body swaps in its own environment, so put the caller's back once it stops
+	env, depth, outer := itpr.environment, itpr.callDepth, itpr.generator
+	itpr.generator = g
+	g.running = true
+	g.resume <- close
+	step := <-g.steps
+	g.running = false
+	itpr.environment, itpr.callDepth, itpr.generator = env, depth, outer
+
+	if step.done {
+		g.finished = true
+		delete(itpr.generators, g)
+	}
+	if step.panicked != nil {
+		panic(step.panicked)
+	}
+	return step
+}
+
+// The next value, unless hasNext() already ran ahead to it
+func (g *generatorState) advance() generatorStep {
+	if g.peeked != nil {
+		step := *g.peeked
+		g.peeked = nil
+		return step
+	}
+	return g.step(false)
+}
+
+func (g *generatorState) hasNext() bool {
+	if g.peeked == nil {
+		step := g.step(false)
+		g.peeked = &step
+	}
+	return !g.peeked.done
+}
+
+// Unwinds a suspended body (nothing happens to one that has finished)
+func (g *generatorState) close() {
+	g.peeked = nil
+	g.step(true)
+}
+
+// Yield: hands the value to the caller and waits to be resumed
+func (itpr *Interpreter) visitYieldStmt(stmt YieldStmt) interface{} {
+	var value interface{}
+	if stmt.value != nil {
+		value = itpr.evaluate(stmt.value)
+	}
+
+	g := itpr.generator
+	env, depth := itpr.environment, itpr.callDepth
+	g.steps <- generatorStep{value: value}
+	if close := <-g.resume; close {
+		panic(generatorClosed{})
+	}
+	itpr.environment, itpr.callDepth = env, depth
+	return nil
+}
+
+// Closes the bodies of generators nothing refers to any more. Only the interpreter's own
+// goroutine can drive a body, so the finalizers just queue them up for this
+func (itpr *Interpreter) closeAbandonedGenerators() {
+	itpr.generatorMu.Lock()
+	abandoned := itpr.abandoned
+	itpr.abandoned = nil
+	itpr.generatorMu.Unlock()
+
+	for _, g := range abandoned {
+		//a generator can be garbage while its own body is still running, eg. gen().next()
+		if g.running {
+			itpr.generatorMu.Lock()
+			itpr.abandoned = append(itpr.abandoned, g)
+			itpr.generatorMu.Unlock()
+			continue
+		}
+		g.close()
+	}
+}
+
+// Closes every generator that hasn't finished, for hosts that are done with this interpreter
+func (itpr *Interpreter) closeGenerators() {
+	for g := range itpr.generators {
+		if !g.running {
+			g.close()
+		}
+	}
+}
+
+// A body runs on the Interpreter of the task that made it, so no other task can resume it
+func (g *generatorState) checkOwner(itpr *Interpreter, at Token) {
+	if itpr != g.itpr {
+		itpr.error(&RuntimeError{token: at, code: E_RUNTIME, msg: fmt.Sprintf("Generator '%s' belongs to another task.", g.name)})
+	}
+}
+
+// next(), hasNext() and close()
+func (g *LoxGenerator) method(name string) (*nativeMethod, bool) {
+	state := g.state
+	switch name {
+	case "next":
+		return &nativeMethod{name: "next", fn: func(itpr *Interpreter, args []interface{}) interface{} {
+			state.checkOwner(itpr, itpr.callSite)
+			step := state.advance()
+			if step.done {
+				itpr.error(&RuntimeError{token: itpr.callSite, code: E_RUNTIME, msg: fmt.Sprintf("Generator '%s' has no more values.", state.name)})
+			}
+			return step.value
+		}}, true
+	case "hasNext":
+		return &nativeMethod{name: "hasNext", fn: func(itpr *Interpreter, args []interface{}) interface{} {
+			state.checkOwner(itpr, itpr.callSite)
+			return state.hasNext()
+		}}, true
+	case "close":
+		return &nativeMethod{name: "close", fn: func(itpr *Interpreter, args []interface{}) interface{} {
+			state.checkOwner(itpr, itpr.callSite)
+			state.close()
+			return nil
+		}}, true
+	}
+	return nil, false
+}
+
+// Lets for-in walk a generator, closing it if the loop stops early
+type generatorIterator struct {
+	state *generatorState
+}
+
+func (i *generatorIterator) next() (interface{}, bool) {
+	if !i.state.hasNext() {
+		return nil, false
+	}
+	return i.state.advance().value, true
+}
+
+func (i *generatorIterator) close() {
+	i.state.close()
+}
@@ -3,48 +3,106 @@
 * as established in the file expression.go.
 * Where textbook relies on Java's generic Object classification, I use Go's interface{}
 * Created: 9/23
-* Modified: 10/7
+* Modified: 10/19
  */
 
 package main
 
 import (
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 )
 
+//deep enough for any sane recursion, shallow enough that Go's own stack never overflows
+const MAX_CALL_DEPTH = 10000
+
 type RuntimeError struct {
 	token Token
+	code string
 	msg string
 }
 
 // assuming runtime error
 func (rt RuntimeError) Error() string {
-	return fmt.Sprintf("[line %d] Runtime Error: %v\n", rt.token.line, rt.msg)
+	return fmt.Sprintf("[line %d] Runtime Error: %v", rt.token.line, rt.msg)
+}
+
+// Converts to the shared diagnostic shape, pointing at the token that failed
+func (rt RuntimeError) diagnostic() Diagnostic {
+	code := rt.code
+	if code == "" {
+		code = E_RUNTIME
+	}
+	return newDiagnostic(RUNTIME_PHASE, code, rt.token, rt.msg)
 }
 
 type Interpreter struct {
 	globals *Environment
 	environment *Environment
-	locals map[Expr]int
+	locals map[Token]int //keyed by each variable's name (or this/super) token, unique to its spot in the source and its scan
 	hadRuntimeError bool
+	diagnostics []Diagnostic
+	tracer Tracer //debugger & friends, nil unless one is attached
+	out io.Writer //where print goes
+	callSite Token //paren of the call being made, for natives to report errors at
+	callDepth int
+	generator *generatorState //whose body is running right now, for yield
+	generators map[*generatorState]bool //started and not finished
+	generatorMu sync.Mutex //finalizers run on their own goroutine
+	abandoned []*generatorState //collected by the GC, waiting to be closed
+	tasks *taskGroup //the GIL this interpreter shares with the tasks it spawns
+	task *LoxTask //the task this interpreter runs, nil for the main program
+	steps int //statements run since this task last gave way to the others
+}
+
+// Hooks for tools that watch a program run. Every call site checks for a nil
+// tracer first, so running without one costs a single comparison
+type Tracer interface {
+	enterStmt(itpr *Interpreter, stmt Stmt)
+	enterCall(itpr *Interpreter, callee LoxCallable, paren Token)
+	exitCall(itpr *Interpreter, callee LoxCallable)
+	branch(itpr *Interpreter, at Token, taken bool) //if/loop conditions, and whether and/or went on to the right side
 }
 
 func newInterpreter() *Interpreter { //creates a nil enclosing env because this should be the global
 	g := newEnvironment(nil)
 	//I don't think go can do nested functions???? so that's gonna go in its own file
 	g.define("clock", clock{})
+	g.define("assert", assert{})
+	g.define("assertEqual", assertEqual{})
+	g.define("assertThrows", assertThrows{})
+	g.define("len", length{})
+	g.define("substr", substr{})
+	g.define("range", rangeNative{})
+	g.define("entries", entries{})
+	g.define("channel", channelNative{})
+	g.define("select", selectNative{})
+	g.define("sleep", sleepNative{})
+	for _, native := range reflectionNatives {
+		g.define(native.name, native)
+	}
 
-	return &Interpreter{globals: g, environment: g, locals: make(map[Expr]int), hadRuntimeError: false}
+	return &Interpreter{globals: g, environment: g, locals: make(map[Token]int), hadRuntimeError: false, out: os.Stdout, tasks: &taskGroup{}}
 }
 
 func (itpr *Interpreter) interpret(statments []Stmt) {
+	itpr.hadRuntimeError = false
+	itpr.acquire()
+	defer itpr.release()
 	defer func() {
 		//read as "err from recovered after failure"
-		//			"if error occured, print the stuff"
+		//			"if error occured, record it for the runner"
 		if err := recover(); err != nil {
-			//check if its a runtime error
-			fmt.Println("Had an error: ")
+			itpr.environment = itpr.globals
+			//the debugger's quit command isn't the script's fault
+			if _, quit := err.(debuggerQuit); quit {return}
 			itpr.hadRuntimeError = true
+			itpr.diagnostics = append(itpr.diagnostics, runtimeDiagnostic(err))
 		}
 	}()
 
@@ -62,6 +120,15 @@ func (itpr *Interpreter) visitBlockStmt(stmt BlockStmt) interface{} {
 	return nil
 }
 
+// Number arithmetic, raising overflow and division by zero as runtime errors
+func (itpr *Interpreter) arithmetic(operator Token, left interface{}, right interface{}) interface{} {
+	result, msg := arithmetic(operator.kind, left, right)
+	if msg != "" {
+		itpr.error(&RuntimeError{token: operator, code: E_RUNTIME, msg: msg})
+	}
+	return result
+}
+
 //Class Stmt
 func (itpr *Interpreter) visitClassStmt(stmt ClassStmt) interface{} {
 	//extract superclass
@@ -72,29 +139,55 @@ func (itpr *Interpreter) visitClassStmt(stmt ClassStmt) interface{} {
 		//check that result is a class
 		object, ok := itpr.evaluate(stmt.superclass).(LoxClass)
 		if !ok {
-			itpr.error(&RuntimeError{token: stmt.superclass.name, msg: "Superclass must be a class"})
+			itpr.error(&RuntimeError{token: stmt.superclass.name, code: E_TYPE, msg: "Superclass must be a class."})
 		}
 		super = &object
 	}
+	//and the traits mixed in after it
+	var traits []*LoxClass
+	for _, trait := range stmt.traits {
+		object, ok := itpr.evaluate(trait).(LoxClass)
+		if !ok {
+			itpr.error(&RuntimeError{token: trait.name, code: E_TYPE, msg: "Trait must be a class."})
+		}
+		traits = append(traits, &object)
+	}
+	bases := traits
+	if super != nil {
+		bases = append([]*LoxClass{super}, traits...)
+	}
+	ancestors, ok := linearize(bases)
+	if !ok {
+		itpr.error(&RuntimeError{token: stmt.name, code: E_TYPE, msg: fmt.Sprintf("Can't find a consistent method order for '%s'.", stmt.name.lexeme)})
+	}
 	
 	//extract methods
 	itpr.environment.define(stmt.name.lexeme, nil)
 
-	//super methods
-	if stmt.superclass != nil {
+	//super methods (super holds this class, super.name looks past it)
+	if len(bases) > 0 {
 		itpr.environment = newEnvironment(itpr.environment)
-		itpr.environment.define("super", super)
 	}
 
 	methods := make(map[string]LoxFunction)
+	setters := make(map[string]LoxFunction)
+	statics := make(map[string]LoxFunction)
 	for _, m := range stmt.methods {
-		function := LoxFunction{declaration: m, closure: itpr.environment, isInitializer: (m.name.lexeme == "init")}
-		methods[m.name.lexeme] = function
+		function := LoxFunction{declaration: m, closure: itpr.environment, isInitializer: (m.name.lexeme == "init" && !m.isStatic)}
+		if m.isStatic {
+			statics[m.name.lexeme] = function
+		} else if m.isSetter {
+			setters[m.name.lexeme] = function
+		} else {
+			methods[m.name.lexeme] = function
+		}
 	}
 
-	class := LoxClass{name: stmt.name.lexeme, superclass: super, methods: methods}
+	class := LoxClass{name: stmt.name.lexeme, superclass: super, traits: traits, ancestors: ancestors, methods: methods, setters: setters, statics: statics,
+		fields: stmt.fields, closure: itpr.environment, cache: make(map[memberKey]*LoxFunction)}
 	
-	if stmt.superclass != nil {
+	if len(bases) > 0 {
+		itpr.environment.define("super", &class)
 		itpr.environment = itpr.environment.enclosing //enclsoing is nil?
 	}
 	
@@ -102,6 +195,35 @@ func (itpr *Interpreter) visitClassStmt(stmt ClassStmt) interface{} {
 	return nil
 }
 
+//Break & continue unwind to the loop they're in (the resolver makes sure there is one)
+type breakLoop struct {}
+type continueLoop struct {}
+
+func (itpr *Interpreter) visitBreakStmt(stmt BreakStmt) interface{} {
+	panic(breakLoop{})
+}
+
+func (itpr *Interpreter) visitContinueStmt(stmt ContinueStmt) interface{} {
+	panic(continueLoop{})
+}
+
+//Runs a loop body once, reporting whether it hit a break
+func (itpr *Interpreter) loopBody(body func()) (broke bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch r.(type) {
+			case breakLoop:
+				broke = true
+			case continueLoop:
+			default:
+				panic(r) //errors & returns keep unwinding
+			}
+		}
+	}()
+	body()
+	return false
+}
+
 //Expression Stmt
 func (itpr *Interpreter) visitExpressionStmt(stmt ExpressionStmt) interface{} {
 	itpr.evaluate(stmt.expression)
@@ -118,10 +240,10 @@ func (itpr *Interpreter) visitForStmt(stmt ForStmt) interface{} {
 	for {
 		if stmt.condition != nil {
 			//eval the condition
-			if !itpr.isTruthy(itpr.evaluate(stmt.condition)) {break}
+			if !itpr.condition(stmt.keyword, stmt.condition) {break}
 		}
 
-		itpr.execute(stmt.body)
+		if itpr.loopBody(func() { itpr.execute(stmt.body) }) {break}
 
 		if stmt.increment != nil {
 			itpr.evaluate(stmt.increment)
@@ -131,6 +253,30 @@ func (itpr *Interpreter) visitForStmt(stmt ForStmt) interface{} {
 	return nil
 }
 
+//For-in Stmt
+func (itpr *Interpreter) visitForInStmt(stmt ForInStmt) interface{} {
+	iterator := itpr.iterate(exprToken(stmt.iterable), itpr.evaluate(stmt.iterable))
+	//a generator left part way through (break, return, an error) gets closed
+	if c, ok := iterator.(interface{ close() }); ok {
+		defer c.close()
+	}
+
+	for {
+		value, ok := iterator.next()
+		if itpr.tracer != nil {
+			itpr.tracer.branch(itpr, stmt.keyword, ok)
+		}
+		if !ok {break}
+
+		//a new variable every time around, so closures each keep their own
+		env := newEnvironment(itpr.environment)
+		env.define(stmt.name.lexeme, value)
+		if itpr.loopBody(func() { itpr.executeBlock([]Stmt{stmt.body}, env) }) {break}
+	}
+
+	return nil
+}
+
 //Function Stmt
 func (itpr *Interpreter) visitFunctionStmt(stmt FunctionStmt) interface{} {
 	function := LoxFunction{declaration: stmt, closure: itpr.environment, isInitializer: false}
@@ -140,7 +286,7 @@ func (itpr *Interpreter) visitFunctionStmt(stmt FunctionStmt) interface{} {
 
 //If Stmt
 func (itpr *Interpreter) visitIfStmt(stmt IfStmt) interface{} {
-	if itpr.isTruthy(itpr.evaluate(stmt.condition)) {
+	if itpr.condition(stmt.keyword, stmt.condition) {
 		itpr.execute(stmt.thenBranch)
 	} else if (stmt.elseBranch != nil) {
 		itpr.execute(stmt.elseBranch)
@@ -151,7 +297,7 @@ func (itpr *Interpreter) visitIfStmt(stmt IfStmt) interface{} {
 //Print Stmt
 func (itpr *Interpreter) visitPrintStmt(stmt PrintStmt) interface{} {
 	value := itpr.evaluate(stmt.expression)
-	fmt.Println(itpr.stringify(value))
+	fmt.Fprintln(itpr.out, itpr.stringify(value))
 	return nil
 }
 
@@ -180,8 +326,8 @@ func (itpr *Interpreter) visitVarStmt(stmt VarStmt) interface{} {
 
 // While Stmt
 func (itpr *Interpreter) visitWhileStmt(stmt WhileStmt) interface{} {
-	for itpr.isTruthy(itpr.evaluate(stmt.condition)) {
-		itpr.execute(stmt.body)
+	for itpr.condition(stmt.keyword, stmt.condition) {
+		if itpr.loopBody(func() { itpr.execute(stmt.body) }) {break}
 	}
 	return nil
 }
@@ -189,15 +335,16 @@ func (itpr *Interpreter) visitWhileStmt(stmt WhileStmt) interface{} {
 /**EXPRESSION VISITORS**/
 // Assign
 func (itpr *Interpreter) visitAssignExpr(expr AssignExpr) interface{} {
-	value := itpr.evaluate(expr.value)
-
-	//check thing exists first
-	distance, ok := itpr.locals[expr]
-	if ok {
-		itpr.environment.assignAt(distance, expr.name, value)
+	var value interface{}
+	if isCompound(expr.operator) {
+		//x += y reads x before working out y
+		current := itpr.lookUpVariable(expr.name)
+		value = itpr.compound(expr.operator, current, itpr.evaluate(expr.value))
 	} else {
-		itpr.globals.assign(expr.name, value)
+		value = itpr.evaluate(expr.value)
 	}
+
+	itpr.assignVariable(expr.name, value)
 	return value
 }
 
@@ -205,141 +352,289 @@ func (itpr *Interpreter) visitAssignExpr(expr AssignExpr) interface{} {
 func (itpr *Interpreter) visitBinaryExpr(expr BinaryExpr) interface{} {
 	left := itpr.evaluate(expr.left)
 	right := itpr.evaluate(expr.right)
+	return itpr.binary(expr.operator, left, right)
+}
+
+// Applies a binary operator to two values (compound assignments share it with visitBinaryExpr)
+func (itpr *Interpreter) binary(operator Token, left interface{}, right interface{}) interface{} {
+	//instances can overload operators (protocols.go)
+	if result, handled := itpr.overloadedBinary(operator, left, right); handled {
+		return result
+	}
 
 	//perform operations
-	switch expr.operator.kind {
-	case MINUS:
+	switch operator.kind {
+	case MINUS, SLASH, STAR, TILDE_SLASH, PERCENT, STAR_STAR:
 		//makes sure that left and right are both numbers first
-		err := itpr.checkNumberOperands(expr.operator, left, right)
+		err := itpr.checkNumberOperands(operator, left, right)
 		if err == nil {
-			return (left.(float64) - right.(float64))
+			return itpr.arithmetic(operator, left, right)
 		} else {
 			itpr.error(err)
 		} //throws the error (kind of?)
 
-	case SLASH:
-		err := itpr.checkNumberOperands(expr.operator, left, right)
-		if err == nil {
-			return (left.(float64) / right.(float64))
-		} else {
-			itpr.error(err)
+	case AMPERSAND, PIPE, CARET, LESS_LESS, GREATER_GREATER:
+		l, lInt := left.(int64)
+		r, rInt := right.(int64)
+		if !lInt || !rInt {
+			itpr.error(&RuntimeError{token: operator, code: E_TYPE, msg: fmt.Sprintf("Operands of '%s' must be integers.", operator.lexeme)})
 		}
-
-	case STAR:
-		err := itpr.checkNumberOperands(expr.operator, left, right)
-		if err == nil {
-			return (left.(float64) * right.(float64))
-		} else {
-			itpr.error(err)
+		result, msg := bitwise(operator.kind, l, r)
+		if msg != "" {
+			itpr.error(&RuntimeError{token: operator, code: E_RUNTIME, msg: msg})
 		}
+		return result
 
 	case PLUS: //need to determine if adding nums or strings
-		//check if floats?
-		_, rType := right.(float64)
-		_, lType := left.(float64)
-		if rType && lType {
-			return (left.(float64) + right.(float64))
+		//check if numbers?
+		if isNumber(left) && isNumber(right) {
+			return itpr.arithmetic(operator, left, right)
 		}
 
 		//or strings?
-		_, rType = right.(string)
-		_, lType = left.(string)
+		_, rType := right.(string)
+		_, lType := left.(string)
 		if rType && lType {
 			return (left.(string) + right.(string))
 		}
 
 		//else "throw" (?) an error
-		err := &RuntimeError{token: expr.operator, msg: "Operands must be 2 numbers or strings"}
+		err := &RuntimeError{token: operator, code: E_TYPE, msg: "Operands must be two numbers or two strings."}
 		itpr.error(err)
 
 	case GREATER:
-		err := itpr.checkNumberOperands(expr.operator, left, right)
+		err := itpr.checkNumberOperands(operator, left, right)
 		if err == nil {
-			return (left.(float64) > right.(float64))
+			return compareNumbers(left, right) > 0
 		} else {
 			itpr.error(err)
 		}
 
 	case GREATER_EQUAL:
-		err := itpr.checkNumberOperands(expr.operator, left, right)
+		err := itpr.checkNumberOperands(operator, left, right)
 		if err == nil {
-			return (left.(float64) >= right.(float64))
+			return compareNumbers(left, right) >= 0
 		} else {
 			itpr.error(err)
 		}
 
 	case LESS:
-		err := itpr.checkNumberOperands(expr.operator, left, right)
+		err := itpr.checkNumberOperands(operator, left, right)
 		if err == nil {
-			return (left.(float64) < right.(float64))
+			return compareNumbers(left, right) < 0
 		} else {
 			itpr.error(err)
 		}
 
 	case LESS_EQUAL:
-		err := itpr.checkNumberOperands(expr.operator, left, right)
+		err := itpr.checkNumberOperands(operator, left, right)
 		if err == nil {
-			return (left.(float64) <= right.(float64))
+			return compareNumbers(left, right) <= 0
 		} else {
 			itpr.error(err)
 		}
 
 	case BANG_EQUAL:
-		return !itpr.isEqual(left, right)
+		return !itpr.isEqual(operator, left, right)
 
 	case EQUAL_EQUAL:
-		return itpr.isEqual(left, right)
+		return itpr.isEqual(operator, left, right)
 	} //end of switch case
 
 	return nil
 }
 
+// The operator a compound assignment applies (+= and ++ both add)
+var compoundOperators = map[TokenType]TokenType{
+	PLUS_EQUAL: PLUS, MINUS_EQUAL: MINUS, STAR_EQUAL: STAR, SLASH_EQUAL: SLASH,
+	PLUS_PLUS: PLUS, MINUS_MINUS: MINUS,
+}
+
+func isCompound(operator Token) bool {
+	_, ok := compoundOperators[operator.kind]
+	return ok
+}
+
+// current op value for a compound assignment, with errors pointing at the += (or ++)
+func (itpr *Interpreter) compound(operator Token, current interface{}, value interface{}) interface{} {
+	op := operator
+	op.kind = compoundOperators[operator.kind]
+	return itpr.binary(op, current, value)
+}
+
+// ++ and -- only work on numbers
+func (itpr *Interpreter) increment(operator Token, value interface{}) interface{} {
+	if err := itpr.checkNumberOperand(operator, value); err != nil {
+		itpr.error(err)
+	}
+	return itpr.compound(operator, value, int64(1))
+}
+
 // Call
 func (itpr *Interpreter) visitCallExpr(expr CallExpr) interface{} {
 	callee := itpr.evaluate(expr.callee)
+	arguments := itpr.arguments(callee, expr)
+	return itpr.call(callee, arguments, expr.paren)
+}
 
+// Evaluates a call's arguments in order, spreading lists out and putting named ones in
+// their parameter's place
+func (itpr *Interpreter) arguments(callee interface{}, expr CallExpr) []interface{} {
 	var arguments []interface{}
+	var named []namedArgument
+	for i, arg := range expr.arguments {
+		value := itpr.evaluate(arg)
+		if spread, ok := expr.spreadAt(i); ok {
+			list, isList := value.(*LoxList)
+			if !isList {
+				itpr.error(&RuntimeError{token: spread, code: E_TYPE, msg: "Can only spread a list."})
+			}
+			arguments = append(arguments, list.elements...)
+		} else if name, ok := expr.nameAt(i); ok {
+			named = append(named, namedArgument{name: name, value: value})
+		} else {
+			arguments = append(arguments, value)
+		}
+	}
+	if named != nil {
+		arguments = itpr.arrange(callee, arguments, named, expr.paren)
+	}
+	return arguments
+}
+
+// Calls a value, with errors (and the debugger/profiler's idea of the call site) at paren
+func (itpr *Interpreter) call(callee interface{}, arguments []interface{}, paren Token) interface{} {
+	function := itpr.callable(callee, arguments, paren)
 
-	for _, arg := range expr.arguments {
-		arguments = append(arguments, itpr.evaluate(arg))
+	if itpr.tracer != nil {
+		itpr.tracer.enterCall(itpr, function, paren)
+		defer itpr.tracer.exitCall(itpr, function)
 	}
+	if itpr.callDepth == MAX_CALL_DEPTH {
+		itpr.error(&RuntimeError{token: paren, code: E_RUNTIME, msg: "Stack overflow."})
+	}
+	itpr.callDepth++
+	defer func() { itpr.callDepth-- }()
 
+	itpr.callSite = paren
+	return function.call(itpr, arguments)
+}
+
+// Checks that callee can be called with these arguments (spawn checks before starting the task)
+func (itpr *Interpreter) callable(callee interface{}, arguments []interface{}, paren Token) LoxCallable {
+	//instances with __call__ can be called too
+	if method, ok := protocolMethod(callee, "__call__"); ok {
+		callee = method
+	}
 	//this is how we label the name to "callable" level priority - i think???
 	function, ok := (callee).(LoxCallable)
 	if !ok { //throw runtime error if not callable
-		itpr.error(&RuntimeError{token: expr.paren, msg: "Can only call functions and classes."})
+		itpr.error(&RuntimeError{token: paren, code: E_CALL, msg: "Can only call functions and classes."})
 	}
 
 	//check arity
-	if (len(arguments) != function.arity()) {
-		itpr.error(&RuntimeError{token: expr.paren, msg: fmt.Sprintf("Expected %d arguments but got %d.", function.arity(), len(arguments))})
+	min, max := arityRange(function)
+	if len(arguments) < min || (max >= 0 && len(arguments) > max) {
+		itpr.error(&RuntimeError{token: paren, code: E_CALL, msg: arityMessage(min, max, len(arguments))})
 	}
-
-	return function.call(itpr, arguments)
+	return function
 }
 
 //Get
 func (itpr *Interpreter) visitGetExpr(expr GetExpr) interface{} {
 	object := itpr.evaluate(expr.object)
+	if expr.optional && object == nil {
+		panic(nilChain{})
+	}
 	//check if its an instance
 	inst, ok := object.(*LoxInstance) 
 	if ok {
-		val, err := inst.get(expr.name)
-		//"Throw" the error
-		if (err != nil) {
-			panic(err)
+		return itpr.property(inst, expr.name)
+	}
+	//class methods
+	if class, ok := object.(LoxClass); ok {
+		return itpr.staticProperty(class, expr.name)
+	}
+	//built in objects like generators have native methods
+	if native, ok := object.(nativeObject); ok {
+		if method, found := native.method(expr.name.lexeme); found {
+			return method
 		}
-		return val
+		itpr.error(&RuntimeError{token: expr.name, code: E_UNDEFINED, msg: fmt.Sprintf("Undefined property '%s'.", expr.name.lexeme)})
 	}
-	itpr.error(&RuntimeError{token: expr.name, msg: "Only instances have properties"})
+	itpr.error(&RuntimeError{token: expr.name, code: E_TYPE, msg: "Only instances have properties."})
 	return nil
 }
 
+//Index
+func (itpr *Interpreter) visitIndexExpr(expr IndexExpr) interface{} {
+	object := itpr.evaluate(expr.object)
+	index := itpr.evaluate(expr.index)
+	return itpr.index(object, expr.bracket, index)
+}
+
+//Index set: list[i] = value (or +=, etc.)
+func (itpr *Interpreter) visitIndexSetExpr(expr IndexSetExpr) interface{} {
+	object := itpr.evaluate(expr.object)
+	index := itpr.evaluate(expr.index)
+
+	var current interface{}
+	if isCompound(expr.operator) {
+		current = itpr.index(object, expr.bracket, index)
+	}
+	value := itpr.evaluate(expr.value)
+	if isCompound(expr.operator) {
+		value = itpr.compound(expr.operator, current, value)
+	}
+
+	itpr.setIndex(object, expr.bracket, index, value)
+	return value
+}
+
+//Conditional: only the branch picked gets evaluated
+func (itpr *Interpreter) visitConditionalExpr(expr ConditionalExpr) interface{} {
+	if itpr.condition(expr.question, expr.condition) {
+		return itpr.evaluate(expr.thenBranch)
+	}
+	return itpr.evaluate(expr.elseBranch)
+}
+
 //Grouping
 func (itpr *Interpreter) visitGroupingExpr(expr GroupingExpr) interface{} {
 	return itpr.evaluate(expr.expression)
 }
 
+//Interpolation: each piece of the string, with the expressions between them stringified
+func (itpr *Interpreter) visitInterpolationExpr(expr InterpolationExpr) interface{} {
+	var str strings.Builder
+	for i, segment := range expr.segments {
+		str.WriteString(segment.literal.(string))
+		if i < len(expr.exprs) {
+			str.WriteString(itpr.stringify(itpr.evaluate(expr.exprs[i])))
+		}
+	}
+	return str.String()
+}
+
+//List: a new one each time the literal runs
+func (itpr *Interpreter) visitListExpr(expr ListExpr) interface{} {
+	list := &LoxList{elements: make([]interface{}, 0, len(expr.elements))}
+	for _, element := range expr.elements {
+		list.elements = append(list.elements, itpr.evaluate(element))
+	}
+	return list
+}
+
+//Map: a new one each time the literal runs, keys in the order written
+func (itpr *Interpreter) visitMapExpr(expr MapExpr) interface{} {
+	m := newLoxMap()
+	for i, key := range expr.keys {
+		k := itpr.evaluate(key)
+		itpr.mapSet(m, exprToken(key), k, itpr.evaluate(expr.values[i]))
+	}
+	return m
+}
+
 //Literal
 func (itpr *Interpreter) visitLiteralExpr(expr LiteralExpr) interface{} {
 	return expr.value
@@ -349,47 +644,83 @@ func (itpr *Interpreter) visitLiteralExpr(expr LiteralExpr) interface{} {
 func (itpr *Interpreter) visitLogicalExpr(expr LogicalExpr) interface{} {
 	left := itpr.evaluate(expr.left)
 
-	if (expr.operator.kind == OR) {
-		if itpr.isTruthy(left) {return left}
-	} else {
-		if !itpr.isTruthy(left) {return left}
+	//short circuits when the left side already decides it
+	var decided bool
+	switch expr.operator.kind {
+	case OR:
+		decided = itpr.isTruthy(left)
+	case AND:
+		decided = !itpr.isTruthy(left)
+	case QUESTION_QUESTION:
+		decided = left != nil
+	}
+	if itpr.tracer != nil {
+		itpr.tracer.branch(itpr, expr.operator, !decided)
 	}
+	if decided {return left}
 
 	return itpr.evaluate(expr.right)
 }
 
+//Thrown by a?.b when a is nil, and caught by the chain it's in
+type nilChain struct {}
+
+//Optional chain: gives nil if a ?. in it found nil, instead of carrying on
+func (itpr *Interpreter) visitOptionalChainExpr(expr OptionalChainExpr) (value interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(nilChain); !ok {
+				panic(r) //not ours, keep unwinding
+			}
+			value = nil
+		}
+	}()
+	return itpr.evaluate(expr.expression)
+}
+
 //Set
 func (itpr *Interpreter) visitSetExpr(expr SetExpr) interface{} {
 	object := itpr.evaluate(expr.object)
 
 	objectInstance, ok := object.(*LoxInstance)
 	if !ok {
-		itpr.error(&RuntimeError{token: expr.name, msg: "Only instances have fields."})
+		itpr.error(&RuntimeError{token: expr.name, code: E_TYPE, msg: "Only instances have fields."})
 	}
 
+	var current interface{}
+	if isCompound(expr.operator) {
+		current = itpr.property(objectInstance, expr.name)
+	}
 	value := itpr.evaluate(expr.value)
-	objectInstance.set(expr.name, value)
+	if isCompound(expr.operator) {
+		value = itpr.compound(expr.operator, current, value)
+	}
+
+	itpr.setProperty(objectInstance, expr.name, value)
 	return value
 }
 
 //Super
 func (itpr *Interpreter) visitSuperExpr(expr SuperExpr) interface{} {
-	distance := itpr.locals[expr]
-	superclass := itpr.environment.getAt(distance, "super").(*LoxClass)
+	distance := itpr.locals[expr.keyword]
+	defining := itpr.environment.getAt(distance, "super").(*LoxClass)
 
 	object := itpr.environment.getAt(distance - 1, "this").(*LoxInstance)
 
-	method := superclass.findMethod(expr.method.lexeme)
+	method := object.class.findAfter(*defining, expr.method.lexeme)
 
 	if method == nil {
-		itpr.error(&RuntimeError{token: expr.method, msg: "Undefied property '"+expr.method.lexeme+"'."})
+		itpr.error(&RuntimeError{token: expr.method, code: E_UNDEFINED, msg: "Undefined property '"+expr.method.lexeme+"'."})
+	}
+	if method.declaration.isGetter {
+		return itpr.call(method.bind(object), nil, expr.method)
 	}
 	return method.bind(object)
 }
 
 //This
 func (itpr *Interpreter) visitThisExpr(expr ThisExpr) interface{} {
-	return itpr.lookUpVariable(expr.keyword, expr)
+	return itpr.lookUpVariable(expr.keyword)
 }
 
 //Unary
@@ -405,9 +736,22 @@ func (itpr *Interpreter) visitUnaryExpr(expr UnaryExpr) interface{} {
 			itpr.error(err)
 		} else {
 			//else all good
-			return -right.(float64) //convert to double
+			if i, isInt := right.(int64); isInt {
+				if i == math.MinInt64 {
+					itpr.error(&RuntimeError{token: expr.operator, code: E_RUNTIME, msg: MSG_OVERFLOW})
+				}
+				return -i
+			}
+			return -right.(float64)
 		}
 
+	case TILDE:
+		i, isInt := right.(int64)
+		if !isInt {
+			itpr.error(&RuntimeError{token: expr.operator, code: E_TYPE, msg: "Operand of '~' must be an integer."})
+		}
+		return ^i
+
 	case BANG:
 		return !itpr.isTruthy(right)
 	}
@@ -416,9 +760,42 @@ func (itpr *Interpreter) visitUnaryExpr(expr UnaryExpr) interface{} {
 	return nil
 }
 
+//Update: ++x and x++ (or --) on a variable, field or list element
+func (itpr *Interpreter) visitUpdateExpr(expr UpdateExpr) interface{} {
+	var old, updated interface{}
+	switch target := expr.target.(type) {
+	case VariableExpr:
+		old = itpr.lookUpVariable(target.name)
+		updated = itpr.increment(expr.operator, old)
+		itpr.assignVariable(target.name, updated)
+
+	case GetExpr:
+		inst, ok := itpr.evaluate(target.object).(*LoxInstance)
+		if !ok {
+			itpr.error(&RuntimeError{token: target.name, code: E_TYPE, msg: "Only instances have fields."})
+		}
+		old = itpr.property(inst, target.name)
+		updated = itpr.increment(expr.operator, old)
+		itpr.setProperty(inst, target.name, updated)
+
+	case IndexExpr:
+		object := itpr.evaluate(target.object)
+		index := itpr.evaluate(target.index)
+		old = itpr.index(object, target.bracket, index)
+		updated = itpr.increment(expr.operator, old)
+		itpr.setIndex(object, target.bracket, index, updated)
+	}
+
+	//++x gives the new value, x++ the old one
+	if expr.prefix {
+		return updated
+	}
+	return old
+}
+
 // Variable
 func (itpr *Interpreter) visitVariableExpr(expr VariableExpr) interface{} {
-	return itpr.lookUpVariable(expr.name, expr)
+	return itpr.lookUpVariable(expr.name)
 }
 
 
@@ -445,28 +822,45 @@ func (itpr *Interpreter) isTruthy(object interface{}) bool {
 	return true
 }
 
-// Checks if 2 values are equal (nulls are equal)
+// Checks if 2 values are equal (nulls are equal), calling __eq__ at the given token
 // IDK if Go evaluates this way already but I'll do it by hand anyway
-func (itpr *Interpreter) isEqual(l interface{}, r interface{}) bool {
+func (itpr *Interpreter) isEqual(at Token, l interface{}, r interface{}) bool {
 	if l == nil && r == nil {
 		return true
 	}
-	//check if l is still null
-	if l == nil {
+	//check if either is still null (nil is only equal to itself, even for __eq__)
+	if l == nil || r == nil {
 		return false
 	}
+	if equal, handled := itpr.overloadedEqual(at, l, r); handled {
+		return equal
+	}
 
+	//functions & classes hold slices and maps, so == would panic on them
+	switch left := l.(type) {
+	case LoxFunction:
+		right, ok := r.(LoxFunction)
+		return ok && left.declaration.name == right.declaration.name && left.closure == right.closure
+	case LoxClass:
+		right, ok := r.(LoxClass)
+		return ok && sameClass(left, right)
+	}
+	//1 == 1.0, whichever kind of number each side is
+	if isNumber(l) && isNumber(r) {
+		return compareNumbers(l, r) == 0
+	}
+	if !reflect.TypeOf(l).Comparable() || !reflect.TypeOf(r).Comparable() {
+		return false
+	}
 	return l == r
 }
 
 // Checks that the given operand is a number type
 // Used for error checking in unary evaluation
 func (itpr *Interpreter) checkNumberOperand(operator Token, operand interface{}) *RuntimeError {
-	_, isDouble := operand.(float64)
-
-	//will return an error if not a double
-	if !isDouble {
-		return &RuntimeError{token: operator, msg: "Operand must be a number in a Unary expression"}
+	//will return an error if not a number
+	if !isNumber(operand) {
+		return &RuntimeError{token: operator, code: E_TYPE, msg: "Operand must be a number."}
 	}
 
 	//else all good
@@ -475,25 +869,33 @@ func (itpr *Interpreter) checkNumberOperand(operator Token, operand interface{})
 
 // Checks that the 2 given variables are numbers
 func (itpr *Interpreter) checkNumberOperands(operator Token, left interface{}, right interface{}) *RuntimeError {
-	_, lDouble := left.(float64)
-	_, rDouble := right.(float64)
-
-	//if both are doubles, proceed
-	if lDouble && rDouble {
+	//if both are numbers, proceed
+	if isNumber(left) && isNumber(right) {
 		return nil
 	}
 
 	//else sths not right
-	return &RuntimeError{token: operator, msg: "Operands must be numbers in Binary expressions"}
+	return &RuntimeError{token: operator, code: E_TYPE, msg: "Operands must be numbers."}
 }
 
-// Added myself, just calls error's report and flags in Interpreter
+// Added myself, flags the Interpreter and unwinds back to interpret()
 func (itpr *Interpreter) error(err *RuntimeError) {
-	fmt.Println(err.Error())
 	itpr.hadRuntimeError = true
 	panic(err)
 }
 
+// Turns whatever interpret() recovered into a diagnostic
+func runtimeDiagnostic(err interface{}) Diagnostic {
+	switch e := err.(type) {
+	case *RuntimeError:
+		return e.diagnostic()
+	case RuntimeError:
+		return e.diagnostic()
+	}
+	//anything else is a bug in glox itself rather than in the script
+	return Diagnostic{severity: SEV_ERROR, phase: RUNTIME_PHASE, code: E_INTERNAL, length: 1, msg: fmt.Sprintf("internal error: %v", err)}
+}
+
 // Displays the results of an interpreted expression
 func (itpr *Interpreter) stringify(object interface{}) string {
 	//null?
@@ -501,18 +903,45 @@ func (itpr *Interpreter) stringify(object interface{}) string {
 		return "nil"
 	}
 
+	//numbers print like the reference Lox, so 3.0 is just "3"
+	if isNumber(object) {
+		return formatNumber(object)
+	}
+	switch o := object.(type) {
+	case *LoxList:
+		return itpr.stringifyList(o, make(map[interface{}]bool))
+	case *LoxMap:
+		return itpr.stringifyMap(o, make(map[interface{}]bool))
+	}
+	if str, ok := itpr.overloadedString(object); ok {
+		return str
+	}
+
 	//else just sprint
 	return fmt.Sprint(object)
 }
 
+//Evaluates an if/loop condition, telling any tracer which way it went
+func (itpr *Interpreter) condition(at Token, expr Expr) bool {
+	truth := itpr.isTruthy(itpr.evaluate(expr))
+	if itpr.tracer != nil {
+		itpr.tracer.branch(itpr, at, truth)
+	}
+	return truth
+}
+
 //Navigates to statement visitor to "execut"
 func (itpr *Interpreter) execute(stmt Stmt) {
+	itpr.checkpoint()
+	if itpr.tracer != nil {
+		itpr.tracer.enterStmt(itpr, stmt)
+	}
 	stmt.accept(itpr)
 }
 
 //Add variables found in the resolver to the locals map
-func (itpr *Interpreter) resolve(expr Expr, depth int) {
-	itpr.locals[expr] = depth
+func (itpr *Interpreter) resolve(name Token, depth int) {
+	itpr.locals[name] = depth
 }
 
 //Executes full block of statements in sub-environment
@@ -530,9 +959,59 @@ func (itpr *Interpreter) executeBlock(statements []Stmt, env *Environment) {
 	}
 }
 
+//assigns to the variable either in the locals or globals
+func (itpr *Interpreter) assignVariable(name Token, value interface{}) {
+	//check thing exists first
+	distance, ok := itpr.locals[name]
+	if ok {
+		itpr.environment.assignAt(distance, name, value)
+	} else {
+		itpr.globals.assign(name, value)
+	}
+}
+
+//reads a field (or bound method) off an instance
+func (itpr *Interpreter) property(inst *LoxInstance, name Token) interface{} {
+	val, err := inst.get(name)
+	//"Throw" the error
+	if (err != nil) {
+		panic(err)
+	}
+	//getters run as soon as they're read
+	if getter, ok := val.(LoxFunction); ok && getter.declaration.isGetter {
+		return itpr.call(getter, nil, name)
+	}
+	return val
+}
+
+//Sets a field, or hands the value to the setter for that name
+func (itpr *Interpreter) setProperty(inst *LoxInstance, name Token, value interface{}) {
+	if setter := inst.class.findSetter(name.lexeme); setter != nil {
+		itpr.call(setter.bind(inst), []interface{}{value}, name)
+		return
+	}
+	//a field would hide the getter for good
+	if getter := inst.class.findMethod(name.lexeme); getter != nil && getter.declaration.isGetter {
+		itpr.error(&RuntimeError{token: name, code: E_TYPE, msg: fmt.Sprintf("Property '%s' has a getter but no setter.", name.lexeme)})
+	}
+	inst.set(name, value)
+}
+
+//Class.method, for "class" methods (and getters)
+func (itpr *Interpreter) staticProperty(class LoxClass, name Token) interface{} {
+	method := class.findStatic(name.lexeme)
+	if method == nil {
+		itpr.error(&RuntimeError{token: name, code: E_UNDEFINED, msg: fmt.Sprintf("Undefined property '%s'.", name.lexeme)})
+	}
+	if method.declaration.isGetter {
+		return itpr.call(*method, nil, name)
+	}
+	return *method
+}
+
 //looks up the variable either in the locals or globals
-func (itpr *Interpreter) lookUpVariable(name Token, expr Expr) interface{} {
-	distance, ok := itpr.locals[expr]
+func (itpr *Interpreter) lookUpVariable(name Token) interface{} {
+	distance, ok := itpr.locals[name]
 	if ok {
 		return itpr.environment.getAt(distance, name.lexeme)
 	} else {
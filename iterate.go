@@ -0,0 +1,126 @@
+/*
+* The iteration protocol behind for-in. Lists give their elements, maps their keys, strings
+* their characters and ranges their numbers; an instance takes part by having an iterator()
+* method that returns an object with hasNext() and next()
+* Created: 10/19
+ */
+
+package main
+
+import "fmt"
+
+// One walk over an iterable; ok is false once it has run out
+type loxIterator interface {
+	next() (value interface{}, ok bool)
+}
+
+// range(start, end, step): start up to (not including) end, counting down for a negative step
+type LoxRange struct {
+	start, end, step int64
+}
+
+func (r LoxRange) String() string {
+	return fmt.Sprintf("range(%d, %d, %d)", r.start, r.end, r.step)
+}
+
+// Starts walking a value for for-in, or raises an error at the given token if it can't be
+func (itpr *Interpreter) iterate(at Token, iterable interface{}) loxIterator {
+	switch it := iterable.(type) {
+	case *LoxList:
+		return &listIterator{list: it}
+	case *LoxMap:
+		//keys added while looping aren't visited
+		return &sliceIterator{values: append([]interface{}(nil), it.keys...)}
+	case string:
+		var chars []interface{}
+		for _, r := range it {
+			chars = append(chars, string(r))
+		}
+		return &sliceIterator{values: chars}
+	case LoxRange:
+		return &rangeIterator{current: it.start, r: it}
+	case *LoxGenerator:
+		it.state.checkOwner(itpr, at)
+		return &generatorIterator{state: it.state}
+	case *LoxChannel:
+		return &channelIterator{itpr: itpr, at: at, channel: it}
+	case *LoxInstance:
+		if it.class.findMethod("iterator") != nil {
+			return &instanceIterator{itpr: itpr, at: at, object: itpr.callMethod(it, "iterator", at)}
+		}
+	}
+	itpr.error(&RuntimeError{token: at, code: E_TYPE,
+		msg: "Can only loop over lists, maps, strings, ranges, generators, channels and instances with an iterator() method."})
+	return nil
+}
+
+// Reads the list's length each time, so elements added while looping are visited too
+type listIterator struct {
+	list *LoxList
+	i    int
+}
+
+func (l *listIterator) next() (interface{}, bool) {
+	if l.i >= len(l.list.elements) {
+		return nil, false
+	}
+	l.i++
+	return l.list.elements[l.i-1], true
+}
+
+type sliceIterator struct {
+	values []interface{}
+	i      int
+}
+
+func (s *sliceIterator) next() (interface{}, bool) {
+	if s.i >= len(s.values) {
+		return nil, false
+	}
+	s.i++
+	return s.values[s.i-1], true
+}
+
+type rangeIterator struct {
+	r       LoxRange
+	current int64
+	done    bool
+}
+
+func (r *rangeIterator) next() (interface{}, bool) {
+	if r.done || (r.r.step > 0 && r.current >= r.r.end) || (r.r.step < 0 && r.current <= r.r.end) {
+		return nil, false
+	}
+	value := r.current
+	//stop rather than wrap around at the ends of int64
+	if sum, msg := arithmetic(PLUS, value, r.r.step); msg == "" {
+		r.current = sum.(int64)
+	} else {
+		r.done = true
+	}
+	return value, true
+}
+
+// Drives the object returned by a user class's iterator()
+type instanceIterator struct {
+	itpr   *Interpreter
+	at     Token
+	object interface{}
+}
+
+func (i *instanceIterator) next() (interface{}, bool) {
+	inst, ok := i.object.(*LoxInstance)
+	if !ok {
+		i.itpr.error(&RuntimeError{token: i.at, code: E_TYPE, msg: "iterator() must return an instance with hasNext() and next() methods."})
+	}
+	if !i.itpr.isTruthy(i.itpr.callMethod(inst, "hasNext", i.at)) {
+		return nil, false
+	}
+	return i.itpr.callMethod(inst, "next", i.at), true
+}
+
+// Calls a method by name with no arguments, as if the script had written inst.name()
+func (itpr *Interpreter) callMethod(inst *LoxInstance, name string, at Token) interface{} {
+	method := itpr.property(inst, Token{kind: IDENTIFIER, lexeme: name, line: at.line, column: at.column})
+	return itpr.call(method, nil, at)
+}
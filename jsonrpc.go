@@ -0,0 +1,66 @@
+/*
+* Content-Length framed JSON messages, the wire format shared by the
+* Language Server Protocol and the Debug Adapter Protocol
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Largest body readMessage will take, so a bad Content-Length can't make it allocate
+// whatever it says
+const MAX_MESSAGE_SIZE = 64 << 20
+
+// Reads one message body, skipping over any headers other than Content-Length
+func readMessage(in *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		//a blank line ends the headers
+		if line == "" {
+			break
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("bad Content-Length %q", value)
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, fmt.Errorf("message is missing a Content-Length header")
+	}
+	if length > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("Content-Length %d is over the %d byte limit", length, MAX_MESSAGE_SIZE)
+	}
+
+	body := make([]byte, length)
+	_, err := io.ReadFull(in, body)
+	return body, err
+}
+
+// Encodes v as JSON and writes it with its header
+func writeMessage(out io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
@@ -0,0 +1,94 @@
+/*
+* Lox's built-in list: [1, 2, 3] literals, reading and assigning elements with list[i],
+* and indexing strings by character (maps.go adds map[key]). Lists are shared by reference,
+* like instances
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type LoxList struct {
+	elements []interface{}
+}
+
+// object[index]; a string gives back the character at that position
+func (itpr *Interpreter) index(object interface{}, bracket Token, index interface{}) interface{} {
+	switch o := object.(type) {
+	case *LoxList:
+		return o.elements[itpr.checkIndex(bracket, index, len(o.elements))]
+	case *LoxMap:
+		return itpr.mapGet(o, bracket, index)
+	case string:
+		runes := []rune(o)
+		return string(runes[itpr.checkIndex(bracket, index, len(runes))])
+	}
+	if method, ok := protocolMethod(object, "__getitem__"); ok {
+		return itpr.call(method, []interface{}{index}, bracket)
+	}
+	itpr.error(&RuntimeError{token: bracket, code: E_TYPE, msg: "Only lists, maps and strings can be indexed."})
+	return nil
+}
+
+// object[index] = value, which only lists and maps allow
+func (itpr *Interpreter) setIndex(object interface{}, bracket Token, index interface{}, value interface{}) {
+	if m, isMap := object.(*LoxMap); isMap {
+		itpr.mapSet(m, bracket, index, value)
+		return
+	}
+	list, ok := object.(*LoxList)
+	if !ok {
+		msg := "Only lists and maps can be assigned to by index."
+		if _, isString := object.(string); isString {
+			msg = "Strings can't be changed in place."
+		}
+		itpr.error(&RuntimeError{token: bracket, code: E_TYPE, msg: msg})
+	}
+	list.elements[itpr.checkIndex(bracket, index, len(list.elements))] = value
+}
+
+// An index has to be a whole number from 0 up to (not including) the length
+func (itpr *Interpreter) checkIndex(bracket Token, index interface{}, length int) int {
+	i, ok := toInt(index)
+	if !ok {
+		itpr.error(&RuntimeError{token: bracket, code: E_TYPE, msg: "Index must be a whole number."})
+	}
+	if i < 0 || i >= int64(length) {
+		itpr.error(&RuntimeError{token: bracket, code: E_RUNTIME,
+			msg: fmt.Sprintf("Index %d is out of range for length %d.", i, length)})
+	}
+	return int(i)
+}
+
+// [1, 2, "three"]; a list that contains itself prints as [...] there
+func (itpr *Interpreter) stringifyList(list *LoxList, open map[interface{}]bool) string {
+	if open[list] {
+		return "[...]"
+	}
+	open[list] = true
+	defer delete(open, list)
+
+	parts := make([]string, len(list.elements))
+	for i, element := range list.elements {
+		parts[i] = itpr.stringifyElement(element, open)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// A value inside a list or map: strings get their quotes, and open tracks the lists and
+// maps being printed further out
+func (itpr *Interpreter) stringifyElement(element interface{}, open map[interface{}]bool) string {
+	switch e := element.(type) {
+	case *LoxList:
+		return itpr.stringifyList(e, open)
+	case *LoxMap:
+		return itpr.stringifyMap(e, open)
+	case string:
+		return "\"" + e + "\""
+	}
+	return itpr.stringify(element)
+}
@@ -2,14 +2,16 @@
 * Main file for Crafting Interpreters glox
 * Tree-Walk Version
 * Created 9/5
-* Modified: 10/7
+* Modified: 10/19
  */
 
 package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -17,13 +19,51 @@ import (
 )
 
 func main() {
-	if len(os.Args) > 2 {
-		log.Fatal("Usage: glox [script]")
-	} else if (len(os.Args) == 2) {
+	errorFormat := flag.String("error-format", HUMAN_FORMAT, "how to print errors: human, short or json")
+	profile := flag.String("profile", "", "profile the script, writing PREFIX.folded and PREFIX.pb.gz")
+	coverage := flag.String("coverage", "", "merge the script's line & branch coverage into this LCOV file (plus an HTML report)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: glox [--error-format=human|short|json] [--profile=PREFIX | --coverage=FILE] [script]\n       glox fmt [-w | --check] [files...]\n       glox test [-v] [--junit=FILE] [paths...]\n       glox debug script\n       glox lsp\n       glox dap")
+	}
+	flag.Parse()
+
+	if !validErrorFormat(*errorFormat) {
+		log.Fatalf("Unknown error format %q", *errorFormat)
+	}
+	if *profile != "" && *coverage != "" {
+		log.Fatal("--profile and --coverage can't be used together")
+	}
+
+	if flag.NArg() == 1 && flag.Arg(0) == "lsp" {
+		runLanguageServer(os.Stdin, os.Stdout)
+	} else if flag.NArg() == 1 && flag.Arg(0) == "dap" {
+		runDebugAdapter(os.Stdin, os.Stdout)
+	} else if flag.NArg() == 2 && flag.Arg(0) == "debug" {
+		os.Exit(runDebug(flag.Arg(1), os.Stdin, os.Stdout))
+	} else if flag.NArg() >= 1 && flag.Arg(0) == "fmt" {
+		os.Exit(runFormat(flag.Args()[1:], os.Stdin, os.Stdout, os.Stderr))
+	} else if flag.NArg() >= 1 && flag.Arg(0) == "test" {
+		os.Exit(runTests(flag.Args()[1:], os.Stdout))
+	} else if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(64)
+	} else if (flag.NArg() == 1) {
 		runner := newRunner()
-		runner.runFile(os.Args[1])
+		runner.errorFormat = *errorFormat
+		if *profile != "" {
+			runner.profiler = newProfiler(flag.Arg(0))
+			runner.profileOut = *profile
+			runner.interpreter.tracer = runner.profiler
+		}
+		if *coverage != "" {
+			runner.coverage = newCoverage(flag.Arg(0))
+			runner.coverageOut = *coverage
+			runner.interpreter.tracer = runner.coverage
+		}
+		runner.runFile(flag.Arg(0))
 	} else {
 		runner := newRunner()
+		runner.errorFormat = *errorFormat
 		runner.runPrompt()
 	}
 }
@@ -37,13 +77,24 @@ func (r *Runner) runFile(path string) {
 	}
 
 	//send to runner
+	r.file = path
 	r.run(string(file))
+	r.finishTasks(string(file))
 
-	if r.hadError {
-		os.Exit(65)
+	//the profile is still worth having if the script failed
+	if r.profiler != nil {
+		if err := r.profiler.save(r.profileOut, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: could not write profile:", err)
+		}
 	}
-	if r.hadRuntimeError {
-		os.Exit(70)
+	if r.coverage != nil {
+		if err := r.coverage.save(r.coverageOut, string(file)); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: could not write coverage:", err)
+		}
+	}
+
+	if code := r.exitCode(); code != 0 {
+		os.Exit(code)
 	}
 }
 
@@ -64,6 +115,7 @@ func (r *Runner) runPrompt() {
 		//reset for next round
 		r.hadError = false
 		r.hadRuntimeError = false
+		r.reported = nil //nothing looks back past the line just run, so don't keep the whole session's
 	}
 }
 
@@ -72,36 +124,64 @@ type Runner struct {
 	hadError bool
 	hadRuntimeError bool
 	interpreter *Interpreter
+	file string //name shown in diagnostics
+	errorFormat string
+	errOut io.Writer //diagnostics go here, apart from what the script prints
+	profiler *Profiler //set by --profile
+	profileOut string
+	coverage *Coverage //set by --coverage
+	coverageOut string
+	reported []Diagnostic //everything report() has printed, for callers that check it afterwards
 }
 
 //"Constructor"
 func newRunner() *Runner {
-	return &Runner{hadError: false, hadRuntimeError: false, interpreter: newInterpreter()}
+	return &Runner{hadError: false, hadRuntimeError: false, interpreter: newInterpreter(),
+		file: "<stdin>", errorFormat: HUMAN_FORMAT, errOut: os.Stderr}
 }
 
 /**Runs inputted Lox statement from given stream "source"*/
 func (r *Runner) run(source string) {
 
-	//scan source stream into tokens
-	scanner := newScanner(source)
-	tokens := scanner.scanTokens()
-
-	parser := newParser(tokens)
-	statements := parser.parse()
-
-	//Stop if a syntax error
-	r.hadError = parser.hadError
+	//scan, parse & resolve, stopping if there's a syntax or resolution error
+	program := prepare(source)
+	r.hadError = program.hadError
+	r.report(source, program.diagnostics)
 	if r.hadError {return}
 
-	resolver := newResolver(r.interpreter)
-	resolver.resolveStmts(statements)
+	diagnostics := program.run(r.interpreter)
+	r.hadRuntimeError = r.interpreter.hadRuntimeError
+	r.report(source, diagnostics)
+}
 
-	//stop if resolution error
-	r.hadError = resolver.hadError
+//Once a whole program has run, waits for its tasks & reports the ones that failed unawaited
+func (r *Runner) finishTasks(source string) {
 	if r.hadError {return}
+	diagnostics := r.interpreter.finishTasks()
+	if len(diagnostics) > 0 {
+		r.hadRuntimeError = true
+	}
+	r.report(source, diagnostics)
+}
 
-	r.interpreter.interpret(statements)
-	r.hadRuntimeError = r.interpreter.hadRuntimeError
-	if (r.hadRuntimeError) {return}
+//Prints each phase's diagnostics in the chosen format
+func (r *Runner) report(source string, phases ...[]Diagnostic) {
+	for _, diagnostics := range phases {
+		for _, d := range diagnostics {
+			d.file = r.file
+			renderDiagnostic(r.errOut, d, r.errorFormat, source)
+			r.reported = append(r.reported, d)
+		}
+	}
+}
 
+//sysexits style: 65 for bad input (scan, parse & resolve errors), 70 for runtime errors
+func (r *Runner) exitCode() int {
+	if r.hadError {
+		return 65
+	}
+	if r.hadRuntimeError {
+		return 70
+	}
+	return 0
 }
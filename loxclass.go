@@ -1,12 +1,14 @@
 /*
 * Stores all the class setup stuff for lox classes, including class instances
 * Created: 10/8
+* Modified: 10/19
  */
 
 package main
 
 import (
 	"fmt"
+	"reflect"
 )
 
 type ClassType int
@@ -16,28 +18,149 @@ const (
 	SUBCLASS
 )
 
+//The kinds of member a class looks up
+const (
+	METHOD_MEMBER = iota //getters too
+	SETTER_MEMBER
+	STATIC_MEMBER
+)
+
 /**CLASS OBJECT**/
 type LoxClass struct {
 	name string
 	superclass *LoxClass
-	methods map[string]LoxFunction
+	traits []*LoxClass
+	ancestors []*LoxClass //the method resolution order after the class itself
+	methods map[string]LoxFunction //getters too
+	setters map[string]LoxFunction
+	statics map[string]LoxFunction //"class" methods, called on the class itself
+	fields []VarStmt
+	closure *Environment //where the field initializers run (with "this" added)
+	cache map[memberKey]*LoxFunction //lookups done so far, misses included (classes never change)
+}
+
+type memberKey struct {
+	kind int
+	name string
 }
 
 //Returns given method
 func (c LoxClass) findMethod(name string) *LoxFunction {
-	m, exists := c.methods[name]
-	if exists {
-		return &m
+	return c.find(name, METHOD_MEMBER)
+}
+
+func (c LoxClass) findSetter(name string) *LoxFunction {
+	return c.find(name, SETTER_MEMBER)
+}
+
+func (c LoxClass) findStatic(name string) *LoxFunction {
+	return c.find(name, STATIC_MEMBER)
+}
+
+//Looks in one kind of member, here and then along the ancestors
+func (c LoxClass) find(name string, kind int) *LoxFunction {
+	key := memberKey{kind: kind, name: name}
+	if m, cached := c.cache[key]; cached {
+		return m
 	}
 
-	//or an inherited method
-	if c.superclass != nil {
-		return c.superclass.findMethod(name)
+	m := c.findIn(append([]*LoxClass{&c}, c.ancestors...), name, kind)
+	if c.cache != nil {
+		c.cache[key] = m
 	}
+	return m
+}
 
+//The first of the classes to declare the member itself
+func (c LoxClass) findIn(classes []*LoxClass, name string, kind int) *LoxFunction {
+	for _, class := range classes {
+		if m, exists := class.members(kind)[name]; exists {
+			return &m
+		}
+	}
 	return nil
 }
 
+func (c LoxClass) members(kind int) map[string]LoxFunction {
+	switch kind {
+	case SETTER_MEMBER:
+		return c.setters
+	case STATIC_MEMBER:
+		return c.statics
+	}
+	return c.methods
+}
+
+//For super.name in a method of the defining class: the next class after it in the
+//instance's method resolution order that has the method
+func (c LoxClass) findAfter(defining LoxClass, name string) *LoxFunction {
+	order := append([]*LoxClass{&c}, c.ancestors...)
+	for i, class := range order {
+		if sameClass(*class, defining) {
+			return c.findIn(order[i+1:], name, METHOD_MEMBER)
+		}
+	}
+	//the method was bound to an instance of a class that doesn't inherit it
+	return defining.findIn(defining.ancestors, name, METHOD_MEMBER)
+}
+
+//Classes are copied around by value, but their method maps are made once per declaration
+func sameClass(a LoxClass, b LoxClass) bool {
+	return a.name == b.name && reflect.ValueOf(a.methods).Pointer() == reflect.ValueOf(b.methods).Pointer()
+}
+
+//C3 linearization: each base comes before its own ancestors, the bases keep the order they
+//were listed in, and so does every ancestor's order. ok is false when those can't all hold
+func linearize(bases []*LoxClass) (order []*LoxClass, ok bool) {
+	var lists [][]*LoxClass
+	for _, base := range bases {
+		lists = append(lists, append([]*LoxClass{base}, base.ancestors...))
+	}
+	lists = append(lists, append([]*LoxClass(nil), bases...))
+
+	for {
+		var remaining [][]*LoxClass
+		for _, list := range lists {
+			if len(list) > 0 {
+				remaining = append(remaining, list)
+			}
+		}
+		lists = remaining
+		if len(lists) == 0 {
+			return order, true
+		}
+
+		//the first head that isn't waiting behind something in another list
+		var next *LoxClass
+		for _, list := range lists {
+			if !inTail(lists, list[0]) {
+				next = list[0]
+				break
+			}
+		}
+		if next == nil {
+			return nil, false
+		}
+		order = append(order, next)
+		for i, list := range lists {
+			if sameClass(*list[0], *next) {
+				lists[i] = list[1:]
+			}
+		}
+	}
+}
+
+func inTail(lists [][]*LoxClass, class *LoxClass) bool {
+	for _, list := range lists {
+		for _, other := range list[1:] {
+			if sameClass(*other, *class) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (c LoxClass) String() string {
 	return c.name
 }
@@ -45,6 +168,7 @@ func (c LoxClass) String() string {
 //"Implements loxcallable" stuff
 func (c LoxClass) call(itpr *Interpreter, arguments []interface{}) interface{} {
 	instance := &LoxInstance{class: c}
+	c.initFields(itpr, instance)
 	intializer := c.findMethod("init")
 	if intializer != nil {
 		intializer.bind(instance).call(itpr, arguments)
@@ -53,12 +177,45 @@ func (c LoxClass) call(itpr *Interpreter, arguments []interface{}) interface{} {
 	return instance
 }
 
+//Runs the declared fields' initializers, the furthest ancestor's first, so init sees them all set
+func (c LoxClass) initFields(itpr *Interpreter, instance *LoxInstance) {
+	for i := len(c.ancestors) - 1; i >= 0; i-- {
+		c.ancestors[i].initOwnFields(itpr, instance)
+	}
+	c.initOwnFields(itpr, instance)
+}
+
+func (c LoxClass) initOwnFields(itpr *Interpreter, instance *LoxInstance) {
+	if len(c.fields) == 0 {return}
+
+	env := newEnvironment(c.closure)
+	env.define("this", instance)
+	previous := itpr.environment
+	itpr.environment = env
+	defer func() {itpr.environment = previous}()
+	for _, field := range c.fields {
+		var value interface{}
+		if field.initializer != nil {
+			value = itpr.evaluate(field.initializer)
+		}
+		instance.set(field.name, value)
+	}
+}
+
 func (c LoxClass) arity() int {
 	initializer := c.findMethod("init")
 	if initializer == nil {return 0}
 	return initializer.arity()
 }
 
+func (c LoxClass) calleeName() string {return c.name}
+
+func (c LoxClass) maxArity() int {
+	initializer := c.findMethod("init")
+	if initializer == nil {return 0}
+	return initializer.maxArity()
+}
+
 /**INSTANCE**/
 type LoxInstance struct {
 	class LoxClass
@@ -76,7 +233,7 @@ func (inst *LoxInstance) get(name Token) (interface{}, error) {
 	if (method != nil) {return method.bind(inst), nil}
 
 	//if doesn't exist, throw runtime error
-	return nil, RuntimeError{token: name, msg: fmt.Sprintf("Undefined property '%s'.", name.lexeme)}
+	return nil, RuntimeError{token: name, code: E_UNDEFINED, msg: fmt.Sprintf("Undefined property '%s'.", name.lexeme)}
 }
 
 //Setter
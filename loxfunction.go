@@ -1,7 +1,7 @@
 /*
 * File to specify which expressions are "callable" and which aren't
 * Created: 10/4
-* Modified: 10/8
+* Modified: 10/19
  */
 
 package main
@@ -9,12 +9,62 @@ package main
 import (
 	"fmt"
 	"time"
+	"unicode/utf8"
 )
 
 //"Interface"
 type LoxCallable interface {
 	arity() int
 	call(itpr *Interpreter, arguments []interface{}) interface{}
+	calleeName() string //what stacks, profiles and task names call it
+}
+
+//Callables that can be given more arguments than arity() asks for
+type optionalArguments interface {
+	maxArity() int //-1 when there's no limit
+}
+
+//The fewest & most arguments a callable takes (max is -1 for no limit)
+func arityRange(function LoxCallable) (min int, max int) {
+	min = function.arity()
+	if optional, ok := function.(optionalArguments); ok {
+		return min, optional.maxArity()
+	}
+	return min, min
+}
+
+func arityMessage(min int, max int, got int) string {
+	if max < 0 {
+		return fmt.Sprintf("Expected at least %d arguments but got %d.", min, got)
+	}
+	if min != max {
+		return fmt.Sprintf("Expected %d to %d arguments but got %d.", min, max, got)
+	}
+	return fmt.Sprintf("Expected %d arguments but got %d.", min, got)
+}
+
+//Methods of built in values, like a generator's next()
+type nativeMethod struct {
+	name string
+	params int
+	fn func(itpr *Interpreter, args []interface{}) interface{}
+}
+
+func (m *nativeMethod) arity() int {return m.params}
+
+func (m *nativeMethod) calleeName() string {return m.name}
+
+func (m *nativeMethod) call(itpr *Interpreter, args []interface{}) interface{} {
+	return m.fn(itpr, args)
+}
+
+func (m *nativeMethod) String() string {
+	return "<native fn>"
+}
+
+//Built in values with methods (obj.name gives one back)
+type nativeObject interface {
+	method(name string) (*nativeMethod, bool)
 }
 
 /**List of Native Callables**/
@@ -24,6 +74,8 @@ type clock struct {}
 
 func (c clock) arity() int {return 0}
 
+func (c clock) calleeName() string {return "clock"}
+
 func (c clock) call(itpr *Interpreter, args []interface{}) interface{} {
 	return float64(time.Now().UnixMilli())
 }
@@ -32,6 +84,237 @@ func (c clock) String() string {
 	return "<native fn>"
 }
 
+//Assertions for "glox test". Natives don't get a token, so failures point at itpr.callSite
+type assert struct {}
+
+func (a assert) arity() int {return 1}
+
+func (a assert) maxArity() int {return 2}
+
+func (a assert) calleeName() string {return "assert"}
+
+//assert(cond, message): the message, when there is one, is what the failure says
+func (a assert) call(itpr *Interpreter, args []interface{}) interface{} {
+	if !itpr.isTruthy(args[0]) {
+		msg := "Assertion failed."
+		if len(args) == 2 {
+			msg = itpr.stringify(args[1])
+		}
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_ASSERT, msg: msg})
+	}
+	return nil
+}
+
+func (a assert) String() string {
+	return "<native fn>"
+}
+
+type assertEqual struct {}
+
+func (a assertEqual) arity() int {return 2}
+
+func (a assertEqual) calleeName() string {return "assertEqual"}
+
+//assertEqual(actual, expected)
+func (a assertEqual) call(itpr *Interpreter, args []interface{}) interface{} {
+	site := itpr.callSite //__eq__ would move it
+	if !itpr.deepEqual(site, args[0], args[1], make(map[[2]interface{}]bool)) {
+		itpr.error(&RuntimeError{token: site, code: E_ASSERT,
+			msg: fmt.Sprintf("Expected %s but got %s.", debugString(itpr, args[1]), debugString(itpr, args[0]))})
+	}
+	return nil
+}
+
+func (a assertEqual) String() string {
+	return "<native fn>"
+}
+
+//Like ==, except lists and maps are equal when they hold equal things, so a test can check a
+//result it built itself. seen holds the pairs being compared already, for lists that hold themselves
+func (itpr *Interpreter) deepEqual(at Token, l interface{}, r interface{}, seen map[[2]interface{}]bool) bool {
+	pair := [2]interface{}{l, r}
+	switch left := l.(type) {
+	case *LoxList:
+		right, ok := r.(*LoxList)
+		if !ok || len(left.elements) != len(right.elements) {
+			return false
+		}
+		if seen[pair] {
+			return true
+		}
+		seen[pair] = true
+		for i := range left.elements {
+			if !itpr.deepEqual(at, left.elements[i], right.elements[i], seen) {
+				return false
+			}
+		}
+		return true
+	case *LoxMap:
+		right, ok := r.(*LoxMap)
+		if !ok || len(left.keys) != len(right.keys) {
+			return false
+		}
+		if seen[pair] {
+			return true
+		}
+		seen[pair] = true
+		for i, key := range left.keys {
+			j := itpr.mapFind(right, at, key, itpr.hashKey(at, key))
+			if j < 0 || !itpr.deepEqual(at, left.values[i], right.values[j], seen) {
+				return false
+			}
+		}
+		return true
+	}
+	return itpr.isEqual(at, l, r)
+}
+
+type assertThrows struct {}
+
+func (a assertThrows) arity() int {return 1}
+
+func (a assertThrows) calleeName() string {return "assertThrows"}
+
+//Calls a function that takes no arguments and returns the message of the runtime error it threw
+func (a assertThrows) call(itpr *Interpreter, args []interface{}) (message interface{}) {
+	site := itpr.callSite
+	function, ok := args[0].(LoxCallable)
+	if !ok || function.arity() != 0 {
+		itpr.error(&RuntimeError{token: site, code: E_CALL, msg: "assertThrows needs a function that takes no arguments."})
+	}
+
+	hadRuntimeError := itpr.hadRuntimeError
+	threw := func() (thrown *RuntimeError) {
+		defer func() {
+			if err := recover(); err != nil {
+				switch e := err.(type) {
+				case *RuntimeError:
+					thrown = e
+				case RuntimeError:
+					thrown = &e
+				default:
+					panic(err)
+				}
+			}
+		}()
+		function.call(itpr, nil)
+		return nil
+	}()
+
+	if threw == nil {
+		itpr.error(&RuntimeError{token: site, code: E_ASSERT, msg: "Expected a runtime error but none was thrown."})
+	}
+	//an expected error doesn't count against the script
+	itpr.hadRuntimeError = hadRuntimeError
+	return threw.msg
+}
+
+func (a assertThrows) String() string {
+	return "<native fn>"
+}
+
+//String natives count in code points, so "héllo" is 5 long however many bytes it takes (len takes lists & maps too)
+type length struct {}
+
+func (l length) arity() int {return 1}
+
+func (l length) calleeName() string {return "len"}
+
+func (l length) call(itpr *Interpreter, args []interface{}) interface{} {
+	switch collection := args[0].(type) {
+	case *LoxList:
+		return int64(len(collection.elements))
+	case *LoxMap:
+		return int64(len(collection.keys))
+	}
+	if n, ok := itpr.overloadedLength(itpr.callSite, args[0]); ok {
+		return n
+	}
+	str, ok := args[0].(string)
+	if !ok {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: "len needs a string, list or map."})
+	}
+	return int64(utf8.RuneCountInString(str))
+}
+
+func (l length) String() string {
+	return "<native fn>"
+}
+
+type substr struct {}
+
+func (s substr) arity() int {return 3}
+
+func (s substr) calleeName() string {return "substr"}
+
+//substr(str, start, end): code points start up to (not including) end
+func (s substr) call(itpr *Interpreter, args []interface{}) interface{} {
+	str, ok := args[0].(string)
+	start, startOk := toInt(args[1])
+	end, endOk := toInt(args[2])
+	if !ok || !startOk || !endOk {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: "substr needs a string and two whole numbers."})
+	}
+
+	runes := []rune(str)
+	if start < 0 || end < start || end > int64(len(runes)) {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_RUNTIME,
+			msg: fmt.Sprintf("Substring %v to %v is out of range for a string of length %d.", start, end, len(runes))})
+	}
+	return string(runes[int(start):int(end)])
+}
+
+func (s substr) String() string {
+	return "<native fn>"
+}
+
+//range(start, end, step) for for-in loops; nothing is made up front, so range(0, 1e9, 1) is fine
+type rangeNative struct {}
+
+func (r rangeNative) arity() int {return 3}
+
+func (r rangeNative) calleeName() string {return "range"}
+
+func (r rangeNative) call(itpr *Interpreter, args []interface{}) interface{} {
+	start, startOk := toInt(args[0])
+	end, endOk := toInt(args[1])
+	step, stepOk := toInt(args[2])
+	if !startOk || !endOk || !stepOk {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: "range needs three whole numbers."})
+	}
+	if step == 0 {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_RUNTIME, msg: "range step can't be 0."})
+	}
+	return LoxRange{start: start, end: end, step: step}
+}
+
+func (r rangeNative) String() string {
+	return "<native fn>"
+}
+
+//entries(map): a [key, value] list for each entry, in order
+type entries struct {}
+
+func (e entries) arity() int {return 1}
+
+func (e entries) calleeName() string {return "entries"}
+
+func (e entries) call(itpr *Interpreter, args []interface{}) interface{} {
+	m, ok := args[0].(*LoxMap)
+	if !ok {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: "entries needs a map."})
+	}
+	list := &LoxList{}
+	for i, key := range m.keys {
+		list.elements = append(list.elements, &LoxList{elements: []interface{}{key, m.values[i]}})
+	}
+	return list
+}
+
+func (e entries) String() string {
+	return "<native fn>"
+}
+
 //User defined functions
 type LoxFunction struct {
 	declaration FunctionStmt
@@ -45,11 +328,27 @@ func (f LoxFunction) bind(instance *LoxInstance) LoxFunction {
 	return LoxFunction{declaration: f.declaration, closure: env, isInitializer: f.isInitializer}
 }
 
+//Parameters with defaults (and a rest parameter) can be left out
 func (f LoxFunction) arity() int {
-	return len(f.declaration.params)
+	min, _ := f.declaration.arityRange()
+	return min
 }
 
+func (f LoxFunction) maxArity() int {
+	_, max := f.declaration.arityRange()
+	return max
+}
+
+func (f LoxFunction) calleeName() string {return f.declaration.name.lexeme}
+
 func (f LoxFunction) call(itpr *Interpreter, arguments []interface{}) (returnValue interface{}) {
+	env := f.bindArguments(itpr, arguments)
+
+	//the body only runs as the generator is asked for values
+	if f.declaration.isGenerator {
+		return newGenerator(itpr, f, env)
+	}
+
 	//catch
 	defer func() {
 		if err := recover(); err != nil {
@@ -62,11 +361,6 @@ func (f LoxFunction) call(itpr *Interpreter, arguments []interface{}) (returnVal
 			panic(err)
 		}
 	}()
-	
-	env := newEnvironment(f.closure)
-	for i := 0; i < len(f.declaration.params); i++ {
-		env.define(f.declaration.params[i].lexeme, arguments[i])
-	}
 
 	//try
 	itpr.executeBlock(f.declaration.body, env)
@@ -79,6 +373,105 @@ func (f LoxFunction) call(itpr *Interpreter, arguments []interface{}) (returnVal
 	return nil
 }
 
+//Defines the parameters in a new environment for the body. Defaults are evaluated there, in
+//order, for each parameter that wasn't given (or was skipped over by named arguments)
+func (f LoxFunction) bindArguments(itpr *Interpreter, arguments []interface{}) *Environment {
+	env := newEnvironment(f.closure)
+	if f.declaration.defaults != nil {
+		previous := itpr.environment
+		itpr.environment = env
+		defer func() {itpr.environment = previous}()
+	}
+
+	params := f.declaration.params
+	fixed := len(params)
+	if f.declaration.hasRest {fixed--}
+	for i := 0; i < fixed; i++ {
+		missing := i >= len(arguments)
+		if !missing {
+			_, missing = arguments[i].(missingArgument)
+		}
+		if missing {
+			env.define(params[i].lexeme, itpr.evaluate(f.declaration.defaults[i]))
+		} else {
+			env.define(params[i].lexeme, arguments[i])
+		}
+	}
+	if f.declaration.hasRest {
+		rest := &LoxList{}
+		if len(arguments) > fixed {
+			rest.elements = append(rest.elements, arguments[fixed:]...)
+		}
+		env.define(params[fixed].lexeme, rest)
+	}
+	return env
+}
+
+//A name: value argument
+type namedArgument struct {
+	name Token
+	value interface{}
+}
+
+//Stands in for a parameter left to its default when named arguments skip over it
+type missingArgument struct {}
+
+//Puts named arguments in their parameters' places after the positional ones, so the call
+//goes ahead as if they'd all been positional
+func (itpr *Interpreter) arrange(callee interface{}, positional []interface{}, named []namedArgument, paren Token) []interface{} {
+	var declaration FunctionStmt
+	switch c := callee.(type) {
+	case LoxFunction:
+		declaration = c.declaration
+	case LoxClass:
+		if initializer := c.findMethod("init"); initializer != nil {
+			declaration = initializer.declaration
+		}
+	case *LoxInstance:
+		method, ok := protocolMethod(c, "__call__")
+		if !ok {return positional} //calling it fails anyway
+		declaration = method.declaration
+	case LoxCallable:
+		itpr.error(&RuntimeError{token: named[0].name, code: E_CALL, msg: "Only functions declared in Lox take named arguments."})
+	default:
+		return positional
+	}
+
+	params := declaration.params
+	fixed := len(params)
+	if declaration.hasRest {fixed--}
+	arguments := make([]interface{}, fixed)
+	given := make([]bool, fixed)
+	for i := 0; i < fixed && i < len(positional); i++ {
+		arguments[i], given[i] = positional[i], true
+	}
+	for _, arg := range named {
+		i := 0
+		for i < len(params) && params[i].lexeme != arg.name.lexeme {i++}
+		if i == len(params) {
+			itpr.error(&RuntimeError{token: arg.name, code: E_CALL, msg: fmt.Sprintf("No parameter named '%s'.", arg.name.lexeme)})
+		}
+		if i == fixed {
+			itpr.error(&RuntimeError{token: arg.name, code: E_CALL, msg: "The rest parameter can't be passed by name."})
+		}
+		if given[i] {
+			itpr.error(&RuntimeError{token: arg.name, code: E_CALL, msg: fmt.Sprintf("Argument '%s' was passed twice.", arg.name.lexeme)})
+		}
+		arguments[i], given[i] = arg.value, true
+	}
+	for i := 0; i < fixed; i++ {
+		if given[i] {continue}
+		if declaration.defaults == nil || declaration.defaults[i] == nil {
+			itpr.error(&RuntimeError{token: paren, code: E_CALL, msg: fmt.Sprintf("Missing argument for '%s'.", params[i].lexeme)})
+		}
+		arguments[i] = missingArgument{}
+	}
+	if len(positional) > fixed {
+		arguments = append(arguments, positional[fixed:]...)
+	}
+	return arguments
+}
+
 func (f LoxFunction) String() string {
 	return fmt.Sprintf("<fn %s>", f.declaration.name.lexeme)
 }
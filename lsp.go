@@ -0,0 +1,462 @@
+/*
+* Language server ("glox lsp") speaking LSP over stdio. Every edit re-runs the scanner,
+* parser and resolver on the document, and the resolver's symbol table answers
+* definition, reference, hover, completion and outline requests
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+/**Wire types**/
+type rpcMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	RPC_PARSE_ERROR      = -32700
+	RPC_INVALID_REQUEST  = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+)
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextDocument struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type lspPositionParams struct {
+	TextDocument lspTextDocument `json:"textDocument"`
+	Position     lspPosition     `json:"position"`
+	Context      struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Detail         string              `json:"detail"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children,omitempty"`
+}
+
+// Enum values from the LSP spec
+const (
+	LSP_COMPLETION_METHOD   = 2
+	LSP_COMPLETION_FUNCTION = 3
+	LSP_COMPLETION_VARIABLE = 6
+	LSP_COMPLETION_CLASS    = 7
+	LSP_COMPLETION_KEYWORD  = 14
+
+	LSP_SYMBOL_CLASS    = 5
+	LSP_SYMBOL_METHOD   = 6
+	LSP_SYMBOL_FUNCTION = 12
+)
+
+/**Analysis of a single document**/
+type Analysis struct {
+	lines       []string //the source, for turning rune columns into LSP's UTF-16 ones
+	statements  []Stmt
+	diagnostics []Diagnostic
+	symbols     *SymbolTable
+}
+
+// Runs the front half of the pipeline (nothing is executed) and keeps everything tooling needs
+func analyze(source string) (analysis *Analysis) {
+	analysis = &Analysis{lines: strings.Split(source, "\n"), symbols: newSymbolTable()}
+
+	scanner := newScanner(source)
+	tokens := scanner.scanTokens()
+	parser := newParser(tokens)
+	analysis.statements = parser.parse()
+	analysis.diagnostics = append(scanner.diagnostics, parser.diagnostics...)
+
+	defer func() {
+		//a half-parsed file shouldn't take the whole server down
+		if err := recover(); err != nil {
+			analysis.symbols.finish()
+		}
+	}()
+
+	resolver := newResolver(newInterpreter())
+	resolver.symbols = analysis.symbols
+	resolver.resolveStmts(analysis.statements)
+	analysis.symbols.finish()
+	analysis.diagnostics = append(analysis.diagnostics, resolver.diagnostics...)
+	return analysis
+}
+
+/**Server**/
+type LanguageServer struct {
+	in        *bufio.Reader
+	out       io.Writer
+	documents map[string]string    //uri -> text
+	analyses  map[string]*Analysis //uri -> latest analysis
+	shutdown  bool
+}
+
+func newLanguageServer(in io.Reader, out io.Writer) *LanguageServer {
+	return &LanguageServer{in: bufio.NewReader(in), out: out, documents: make(map[string]string), analyses: make(map[string]*Analysis)}
+}
+
+// Handles messages until the client sends "exit" or closes the stream
+func (ls *LanguageServer) serve() error {
+	for {
+		body, err := readMessage(ls.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg rpcMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			ls.respondError(nil, RPC_PARSE_ERROR, err.Error())
+			continue
+		}
+
+		if msg.Method == "exit" {
+			return nil
+		}
+		ls.handle(msg)
+	}
+}
+
+// Dispatches on method name; requests get a response, notifications don't
+func (ls *LanguageServer) handle(msg rpcMessage) {
+	if ls.shutdown && msg.ID != nil {
+		ls.respondError(msg.ID, RPC_INVALID_REQUEST, "server is shutting down")
+		return
+	}
+
+	switch msg.Method {
+	case "initialize":
+		ls.respond(msg.ID, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1, //full document on every change
+				"definitionProvider":     true,
+				"referencesProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+				"completionProvider":     map[string]interface{}{"triggerCharacters": []string{"."}},
+			},
+			"serverInfo": map[string]string{"name": "glox"},
+		})
+	case "initialized":
+	case "shutdown":
+		ls.shutdown = true
+		ls.respond(msg.ID, nil)
+
+	case "textDocument/didOpen":
+		var params struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		ls.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params struct {
+			TextDocument   lspTextDocument `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		if n := len(params.ContentChanges); n > 0 {
+			ls.update(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didClose":
+		var params struct {
+			TextDocument lspTextDocument `json:"textDocument"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		delete(ls.documents, params.TextDocument.URI)
+		delete(ls.analyses, params.TextDocument.URI)
+		ls.publishDiagnostics(params.TextDocument.URI, &Analysis{})
+
+	case "textDocument/definition":
+		ls.respond(msg.ID, ls.definition(msg.Params))
+	case "textDocument/references":
+		ls.respond(msg.ID, ls.references(msg.Params))
+	case "textDocument/hover":
+		ls.respond(msg.ID, ls.hover(msg.Params))
+	case "textDocument/completion":
+		ls.respond(msg.ID, ls.completion(msg.Params))
+	case "textDocument/documentSymbol":
+		ls.respond(msg.ID, ls.documentSymbols(msg.Params))
+
+	default:
+		if msg.ID != nil {
+			ls.respondError(msg.ID, RPC_METHOD_NOT_FOUND, "unsupported method "+msg.Method)
+		}
+	}
+}
+
+// Re-analyzes a document and pushes its diagnostics to the client
+func (ls *LanguageServer) update(uri string, text string) {
+	ls.documents[uri] = text
+	analysis := analyze(text)
+	ls.analyses[uri] = analysis
+	ls.publishDiagnostics(uri, analysis)
+}
+
+func (ls *LanguageServer) publishDiagnostics(uri string, analysis *Analysis) {
+	converted := []lspDiagnostic{}
+	for _, d := range analysis.diagnostics {
+		start := analysis.position(d.line, d.column)
+		end := analysis.position(d.line, d.column+d.length)
+		converted = append(converted, lspDiagnostic{Range: lspRange{Start: start, End: end}, Severity: int(d.severity) + 1,
+			Code: d.code, Source: "glox", Message: d.msg})
+	}
+	ls.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": converted})
+}
+
+/**Requests**/
+// Looks up the symbol under the cursor in the request's document
+func (ls *LanguageServer) symbolAt(raw json.RawMessage) (*lspPositionParams, *Analysis, *Symbol, Token) {
+	var params lspPositionParams
+	json.Unmarshal(raw, &params)
+	analysis := ls.analyses[params.TextDocument.URI]
+	if analysis == nil {
+		return &params, nil, nil, Token{}
+	}
+	sym, token := analysis.symbols.symbolAt(params.Position.Line+1, analysis.column(params.Position))
+	return &params, analysis, sym, token
+}
+
+func (ls *LanguageServer) definition(raw json.RawMessage) interface{} {
+	params, analysis, sym, _ := ls.symbolAt(raw)
+	if sym == nil {
+		return nil
+	}
+	return lspLocation{URI: params.TextDocument.URI, Range: analysis.tokenRange(sym.name)}
+}
+
+func (ls *LanguageServer) references(raw json.RawMessage) interface{} {
+	params, analysis, sym, _ := ls.symbolAt(raw)
+	locations := []lspLocation{}
+	if sym == nil {
+		return locations
+	}
+
+	if params.Context.IncludeDeclaration {
+		locations = append(locations, lspLocation{URI: params.TextDocument.URI, Range: analysis.tokenRange(sym.name)})
+	}
+	for _, ref := range sym.references {
+		locations = append(locations, lspLocation{URI: params.TextDocument.URI, Range: analysis.tokenRange(ref)})
+	}
+	return locations
+}
+
+func (ls *LanguageServer) hover(raw json.RawMessage) interface{} {
+	_, analysis, sym, token := ls.symbolAt(raw)
+	if sym == nil {
+		return nil
+	}
+	value := "```lox\n" + sym.describe() + "\n```"
+	if sym.doc != "" {
+		value += "\n\n" + sym.doc
+	}
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": value},
+		"range":    analysis.tokenRange(token),
+	}
+}
+
+func (ls *LanguageServer) completion(raw json.RawMessage) interface{} {
+	var params lspPositionParams
+	json.Unmarshal(raw, &params)
+	items := []lspCompletionItem{}
+	analysis := ls.analyses[params.TextDocument.URI]
+
+	//right after a "." only properties make sense
+	if ls.afterDot(params.TextDocument.URI, params.Position) {
+		if analysis != nil {
+			for _, m := range analysis.symbols.allMethods() {
+				items = append(items, lspCompletionItem{Label: m.name.lexeme, Kind: LSP_COMPLETION_METHOD, Detail: m.describe()})
+			}
+		}
+		return items
+	}
+
+	for word := range keywords {
+		items = append(items, lspCompletionItem{Label: word, Kind: LSP_COMPLETION_KEYWORD})
+	}
+	for name := range newInterpreter().globals.values {
+		items = append(items, lspCompletionItem{Label: name, Kind: LSP_COMPLETION_FUNCTION, Detail: "native function"})
+	}
+	if analysis != nil {
+		for name, sym := range analysis.symbols.globals {
+			kind := LSP_COMPLETION_VARIABLE
+			if sym.kind == FUNCTION_SYMBOL {
+				kind = LSP_COMPLETION_FUNCTION
+			} else if sym.kind == CLASS_SYMBOL {
+				kind = LSP_COMPLETION_CLASS
+			}
+			items = append(items, lspCompletionItem{Label: name, Kind: kind, Detail: sym.describe()})
+		}
+	}
+
+	//maps don't keep an order, so sort for stable results
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
+
+func (ls *LanguageServer) documentSymbols(raw json.RawMessage) interface{} {
+	var params lspPositionParams
+	json.Unmarshal(raw, &params)
+	symbols := []lspDocumentSymbol{}
+	analysis := ls.analyses[params.TextDocument.URI]
+	if analysis == nil {
+		return symbols
+	}
+
+	for _, sym := range analysis.symbols.declarations {
+		switch sym.kind {
+		case CLASS_SYMBOL:
+			class := lspDocumentSymbol{Name: sym.name.lexeme, Detail: sym.describe(), Kind: LSP_SYMBOL_CLASS,
+				Range: analysis.tokenRange(sym.name), SelectionRange: analysis.tokenRange(sym.name)}
+			for _, m := range sym.methods {
+				class.Children = append(class.Children, lspDocumentSymbol{Name: m.name.lexeme, Detail: m.describe(),
+					Kind: LSP_SYMBOL_METHOD, Range: analysis.tokenRange(m.name), SelectionRange: analysis.tokenRange(m.name)})
+			}
+			symbols = append(symbols, class)
+		case FUNCTION_SYMBOL:
+			symbols = append(symbols, lspDocumentSymbol{Name: sym.name.lexeme, Detail: sym.describe(), Kind: LSP_SYMBOL_FUNCTION,
+				Range: analysis.tokenRange(sym.name), SelectionRange: analysis.tokenRange(sym.name)})
+		}
+	}
+	return symbols
+}
+
+/**Helpers**/
+// LSP positions are 0-based where tokens are 1-based
+func (a *Analysis) tokenRange(token Token) lspRange {
+	start := a.position(token.line, token.column)
+	end := a.position(token.line, token.column+len([]rune(token.lexeme)))
+	return lspRange{Start: start, End: end}
+}
+
+// LSP counts characters in UTF-16 code units where tokens count code points, so anything
+// past the BMP (an emoji in a string, say) takes two
+func (a *Analysis) position(line int, column int) lspPosition {
+	character := column - 1
+	if line-1 < len(a.lines) {
+		character = 0
+		runes := []rune(a.lines[line-1])
+		for i := 0; i < column-1; i++ {
+			if i < len(runes) {
+				character += utf16.RuneLen(runes[i])
+			} else {
+				character++ //past the end of the line, like the rest of a multi-line token
+			}
+		}
+	}
+	return lspPosition{Line: line - 1, Character: character}
+}
+
+// The 1-based code point column of an LSP position
+func (a *Analysis) column(pos lspPosition) int {
+	if pos.Line >= len(a.lines) {
+		return pos.Character + 1
+	}
+	return utf16Column(a.lines[pos.Line], pos.Character) + 1
+}
+
+// How many code points of line the first units UTF-16 code units cover
+func utf16Column(line string, units int) int {
+	column := 0
+	for _, r := range line {
+		if units <= 0 {
+			break
+		}
+		units -= utf16.RuneLen(r)
+		column++
+	}
+	return column
+}
+
+// Checks whether the text just before the cursor is "." (ignoring a partly typed name)
+func (ls *LanguageServer) afterDot(uri string, pos lspPosition) bool {
+	lines := strings.Split(ls.documents[uri], "\n")
+	if pos.Line >= len(lines) {
+		return false
+	}
+	line := []rune(lines[pos.Line])
+	i := utf16Column(lines[pos.Line], pos.Character) - 1
+	if i >= len(line) {
+		i = len(line) - 1
+	}
+	var scanner Scanner
+	for i >= 0 && scanner.isAlphaNumeric(line[i]) {
+		i--
+	}
+	return i >= 0 && line[i] == '.'
+}
+
+func (ls *LanguageServer) respond(id *json.RawMessage, result interface{}) {
+	writeMessage(ls.out, map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": result})
+}
+
+func (ls *LanguageServer) respondError(id *json.RawMessage, code int, msg string) {
+	writeMessage(ls.out, map[string]interface{}{"jsonrpc": "2.0", "id": id, "error": rpcError{Code: code, Message: msg}})
+}
+
+func (ls *LanguageServer) notify(method string, params interface{}) {
+	writeMessage(ls.out, map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// Wraps serve() for the "glox lsp" subcommand
+func runLanguageServer(in io.Reader, out io.Writer) {
+	//stdout belongs to the protocol, so problems go to stderr
+	if err := newLanguageServer(in, out).serve(); err != nil {
+		log.Println("glox lsp:", err)
+	}
+}
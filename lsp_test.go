@@ -0,0 +1,206 @@
+// /*
+//   - Drives the language server with a scripted JSON-RPC client
+//     */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const lspTestSource = `class Shape {
+  area() { return 0; }
+}
+class Square < Shape {
+  init(side) { this.side = side; }
+  area() { return this.side * this.side; }
+}
+fun describe(shape, label) {
+  print label;
+  return shape.area();
+}
+var sq = Square(3);
+print describe(sq, "square");
+var broken = ;
+`
+
+//Builds the client's side of the conversation up front
+type lspScript struct {
+	buf    bytes.Buffer
+	nextID int
+}
+
+func (s *lspScript) request(method string, params interface{}) int {
+	s.nextID++
+	writeMessage(&s.buf, map[string]interface{}{"jsonrpc": "2.0", "id": s.nextID, "method": method, "params": params})
+	return s.nextID
+}
+
+func (s *lspScript) notify(method string, params interface{}) {
+	writeMessage(&s.buf, map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func position(uri string, line int, character int) map[string]interface{} {
+	return map[string]interface{}{"textDocument": map[string]string{"uri": uri}, "position": map[string]int{"line": line, "character": character},
+		"context": map[string]bool{"includeDeclaration": true}}
+}
+
+//Everything the server wrote back, split into responses (by id) and notifications
+type lspReplies struct {
+	responses     map[int]json.RawMessage
+	notifications []map[string]json.RawMessage
+}
+
+func runLSPScript(t *testing.T, script *lspScript) lspReplies {
+	var out bytes.Buffer
+	if err := newLanguageServer(&script.buf, &out).serve(); err != nil {
+		t.Fatal("server failed:", err)
+	}
+
+	replies := lspReplies{responses: make(map[int]json.RawMessage)}
+	reader := bufio.NewReader(&out)
+	for {
+		body, err := readMessage(reader)
+		if err != nil {
+			break
+		}
+		var msg map[string]json.RawMessage
+		json.Unmarshal(body, &msg)
+		if id, ok := msg["id"]; ok {
+			var n int
+			json.Unmarshal(id, &n)
+			if res, ok := msg["result"]; ok {
+				replies.responses[n] = res
+			} else {
+				replies.responses[n] = msg["error"]
+			}
+		} else {
+			replies.notifications = append(replies.notifications, msg)
+		}
+	}
+	return replies
+}
+
+func TestLanguageServer(t *testing.T) {
+	uri := "file:///shapes.lox"
+	script := &lspScript{}
+	initialize := script.request("initialize", map[string]interface{}{})
+	script.notify("initialized", map[string]interface{}{})
+	script.notify("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]string{"uri": uri, "languageId": "lox", "text": lspTestSource}})
+
+	definition := script.request("textDocument/definition", position(uri, 12, 7))  //"describe" in the call
+	references := script.request("textDocument/references", position(uri, 7, 14)) //"shape" parameter
+	hoverFun := script.request("textDocument/hover", position(uri, 12, 8))
+	hoverClass := script.request("textDocument/hover", position(uri, 3, 7))
+	completeDot := script.request("textDocument/completion", position(uri, 9, 15))
+	completeTop := script.request("textDocument/completion", position(uri, 12, 1))
+	symbols := script.request("textDocument/documentSymbol", position(uri, 0, 0))
+	unknown := script.request("textDocument/rename", position(uri, 0, 0))
+
+	script.notify("textDocument/didChange", map[string]interface{}{"textDocument": map[string]string{"uri": uri},
+		"contentChanges": []map[string]string{{"text": "print 1;\n"}}})
+	shutdown := script.request("shutdown", nil)
+	script.notify("exit", nil)
+
+	replies := runLSPScript(t, script)
+
+	if !strings.Contains(string(replies.responses[initialize]), `"definitionProvider":true`) {
+		t.Errorf("initialize: got %s", replies.responses[initialize])
+	}
+
+	//diagnostics from the broken var, then none after the fix
+	if len(replies.notifications) != 2 {
+		t.Fatalf("expected 2 publishDiagnostics notifications, got %d", len(replies.notifications))
+	}
+	first := string(replies.notifications[0]["params"])
+	if !strings.Contains(first, `"message":"Expect expression."`) || !strings.Contains(first, `"start":{"line":13,"character":13}`) {
+		t.Errorf("first diagnostics: got %s", first)
+	}
+	if !strings.Contains(string(replies.notifications[1]["params"]), `"diagnostics":[]`) {
+		t.Errorf("diagnostics after change: got %s", replies.notifications[1]["params"])
+	}
+
+	expect := []struct {
+		name     string
+		id       int
+		contains []string
+	}{
+		{"definition", definition, []string{`"range":{"start":{"line":7,"character":4},"end":{"line":7,"character":12}}`}},
+		{"references", references, []string{`"start":{"line":7,"character":13}`, `"start":{"line":9,"character":9}`}},
+		{"hover function", hoverFun, []string{"fun describe(shape, label) (arity 2)"}},
+		{"hover class", hoverClass, []string{`class Square \u003c Shape`}},
+		{"method completion", completeDot, []string{`"label":"area"`, `"label":"init"`}},
+		{"global completion", completeTop, []string{`"label":"while"`, `"label":"clock"`, `"label":"describe"`, `"label":"Square"`}},
+		{"document symbols", symbols, []string{`"name":"Shape"`, `"name":"describe","detail":"fun describe(shape, label) (arity 2)","kind":12`, `"children":[{"name":"init"`}},
+		{"unknown method", unknown, []string{`"code":-32601`}},
+		{"shutdown", shutdown, []string{"null"}},
+	}
+	for _, e := range expect {
+		got := string(replies.responses[e.id])
+		for _, want := range e.contains {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: expected %s in %s", e.name, want, got)
+			}
+		}
+	}
+
+	//"." completion is only properties, not keywords
+	if strings.Contains(string(replies.responses[completeDot]), `"label":"while"`) {
+		t.Errorf("method completion offered keywords: %s", replies.responses[completeDot])
+	}
+}
+
+// Hovers show the /** */ comment written above a declaration
+func TestHoverDocComment(t *testing.T) {
+	uri := "file:///docs.lox"
+	source := "/**\n * Area of a circle.\n * Uses pi = 3.\n */\nfun area(r) { return 3 * r * r; }\nclass Circle {\n  /** Twice the radius. */\n  diameter() { return 2; }\n}\n/* not a doc comment */\nvar plain = area(1);\n"
+	script := &lspScript{}
+	script.request("initialize", map[string]interface{}{})
+	script.notify("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]string{"uri": uri, "languageId": "lox", "text": source}})
+	hoverFun := script.request("textDocument/hover", position(uri, 10, 13))
+	hoverMethod := script.request("textDocument/hover", position(uri, 7, 3))
+	hoverVar := script.request("textDocument/hover", position(uri, 10, 5))
+	replies := runLSPScript(t, script)
+
+	if got := string(replies.responses[hoverFun]); !strings.Contains(got, "(arity 1)\\n```\\n\\nArea of a circle.\\nUses pi = 3.\"") {
+		t.Errorf("hover function: got %s", got)
+	}
+	if got := string(replies.responses[hoverMethod]); !strings.Contains(got, "\\n\\nTwice the radius.\"") {
+		t.Errorf("hover method: got %s", got)
+	}
+	if got := string(replies.responses[hoverVar]); !strings.Contains(got, "var plain\\n```\"") {
+		t.Errorf("hover var: got %s", got)
+	}
+}
+
+// Positions count UTF-16 code units both ways, so a character outside the BMP takes two
+func TestLanguageServerUTF16(t *testing.T) {
+	uri := "file:///emoji.lox"
+	source := "var s = \"😀\"; var n = ;\nprint \"😀😀\" + s;\n"
+	script := &lspScript{}
+	script.request("initialize", map[string]interface{}{})
+	script.notify("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]string{"uri": uri, "languageId": "lox", "text": source}})
+	references := script.request("textDocument/references", position(uri, 1, 15)) //"s" after two emoji
+	replies := runLSPScript(t, script)
+
+	if got := string(replies.notifications[0]["params"]); !strings.Contains(got, `"range":{"start":{"line":0,"character":22},"end":{"line":0,"character":23}}`) {
+		t.Errorf("diagnostics: got %s", got)
+	}
+	got := string(replies.responses[references])
+	for _, want := range []string{`{"start":{"line":0,"character":4},"end":{"line":0,"character":5}}`, `{"start":{"line":1,"character":15},"end":{"line":1,"character":16}}`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("references: expected %s in %s", want, got)
+		}
+	}
+}
+
+// A Content-Length past the limit is refused rather than allocated
+func TestMessageSizeLimit(t *testing.T) {
+	in := bufio.NewReader(strings.NewReader("Content-Length: 99999999999\r\n\r\n{}"))
+	if _, err := readMessage(in); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("expected the oversized message refused, got %v", err)
+	}
+}
@@ -4,12 +4,21 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 //Struct to store all the file tests
@@ -24,7 +33,10 @@ func TestRunner(t *testing.T) {
 		{"multi-line string", "print \"hello\nworld\";", "hello\nworld\n"},
 		{"number test", "print 678.098;", "678.098\n"},
 		{"nil test", "print nil and 34;", "nil\n"},
-		{"no semicolon error", "print 89", "[line 1] Error at end: Expect ';' after value.\n"},
+		{"no semicolon error", "print 89", "error[E201]: Expect ';' after value.\n --> <stdin>:1:9\n  |\n1 | print 89\n  |         ^\n"},
+		{"unexpected char error", "var a = 1;\nprint a; #", "error[E101]: Unexpected character.\n --> <stdin>:2:10\n  |\n2 | print a; #\n  |          ^\n"},
+		{"runtime error", "print \"a\" - 1;", "error[E401]: Operands must be numbers.\n --> <stdin>:1:11\n  |\n1 | print \"a\" - 1;\n  |           ^\n"},
+		{"resolution error", "{ var a = a; }", "error[E302]: Can't read local variable in its own initializer.\n --> <stdin>:1:11\n  |\n1 | { var a = a; }\n  |           ^\n"},
 		{"comment after code", "print 1 + 1; //comment!", "2\n"},
 		{"full line comment", `//hello
 			print "hello";`, "hello\n"},
@@ -158,6 +170,78 @@ func TestRunner(t *testing.T) {
 			}
 
 			BostonCream().cook();`, "Fry until golden brown.\nPipe full of custard and coat with chocolate.\n"},
+		{"unicode column", "print \"é\" - 1;", "error[E401]: Operands must be numbers.\n --> <stdin>:1:11\n  |\n1 | print \"é\" - 1;\n  |           ^\n"},
+		{"invalid utf-8", "print \"a\xffb\";", "error[E103]: Invalid UTF-8 encoding.\n --> <stdin>:1:9\n  |\n1 | print \"a\xffb\";\n  |         ^\n"},
+		{"truncated utf-8", "print \"a\xe2\x82b\";", "error[E103]: Invalid UTF-8 encoding.\n --> <stdin>:1:9\n  |\n1 | print \"a\xe2\x82b\";\n  |         ^^\n"},
+		{"len needs a string", "print len(3);", "error[E401]: len needs a string, list or map.\n --> <stdin>:1:12\n  |\n1 | print len(3);\n  |            ^\n"},
+		{"unknown escape", "print \"a\\qb\";", "error[E104]: Unknown escape sequence.\n --> <stdin>:1:9\n  |\n1 | print \"a\\qb\";\n  |         ^\n"},
+		{"empty interpolation", "print \"a ${} b\";", "error[E204]: Expect expression.\n --> <stdin>:1:12\n  |\n1 | print \"a ${} b\";\n  |            ^^^^\n"},
+		{"nested block comments", "/* outer /* inner */\nstill outer */ print 1;\n/*\n*/ print x;", "1\nerror[E402]: Undefined variable 'x'.\n --> <stdin>:4:10\n  |\n4 | */ print x;\n  |          ^\n"},
+		{"unterminated block comment", "print 1;\n/* a /* b */\nc", "error[E105]: Unterminated block comment.\n --> <stdin>:2:1\n  |\n2 | /* a /* b */\n  | ^^^^^^^^^^^^\n"},
+		{"digit separators", "print 1_000__000;", "error[E106]: Digit separators ('_') can only go between digits.\n --> <stdin>:1:7\n  |\n1 | print 1_000__000;\n  |       ^^^^^^^^^^\n"},
+		{"hex without digits", "print 0x;", "error[E106]: Expect digits after '0x'.\n --> <stdin>:1:7\n  |\n1 | print 0x;\n  |       ^^\n"},
+		{"exponent without digits", "print 1e;", "error[E106]: Invalid number literal '1e'.\n --> <stdin>:1:7\n  |\n1 | print 1e;\n  |       ^^\n"},
+		{"digit outside the base", "print 0b102;", "error[E106]: Invalid number literal '0b102'.\n --> <stdin>:1:7\n  |\n1 | print 0b102;\n  |       ^^^^^\n"},
+		{"integer division by zero", "print 1 ~/ 0;", "error[E404]: Division by zero.\n --> <stdin>:1:9\n  |\n1 | print 1 ~/ 0;\n  |         ^^\n"},
+		{"division by zero", "print 1 / 0;", "error[E404]: Division by zero.\n --> <stdin>:1:9\n  |\n1 | print 1 / 0;\n  |         ^\n"},
+		{"shift past the top", "print 1 << 63;", "error[E404]: Integer overflow.\n --> <stdin>:1:9\n  |\n1 | print 1 << 63;\n  |         ^^\n"},
+		{"shift out a set bit", "print 3 << 62;", "error[E404]: Integer overflow.\n --> <stdin>:1:9\n  |\n1 | print 3 << 62;\n  |         ^^\n"},
+		{"zero to a negative power", "print 0 ** -1;", "error[E404]: Division by zero.\n --> <stdin>:1:9\n  |\n1 | print 0 ** -1;\n  |         ^^\n"},
+		{"no real power", "print (-8) ** (1/3);", "error[E404]: Power has no real result.\n --> <stdin>:1:12\n  |\n1 | print (-8) ** (1/3);\n  |            ^^\n"},
+		{"index out of range", "var l = [1];\nprint l[1];", "error[E404]: Index 1 is out of range for length 1.\n --> <stdin>:2:10\n  |\n2 | print l[1];\n  |          ^\n"},
+		{"invalid increment target", "5++;", "error[E202]: Invalid '++' target.\n --> <stdin>:1:2\n  |\n1 | 5++;\n  |  ^^\n"},
+		{"list containing itself", "var l = [1];\nl[0] = l;\nprint l;", "[[...]]\n"},
+		{"assign through ?.", "var a;\na?.b = 1;", "error[E202]: Invalid assignment target.\n --> <stdin>:2:6\n  |\n2 | a?.b = 1;\n  |      ^\n"},
+		{"ternary needs a colon", "print true ? 1;", "error[E201]: Expect ':' after then branch of conditional expression.\n --> <stdin>:1:15\n  |\n1 | print true ? 1;\n  |               ^\n"},
+		{"break outside a loop", "fun f() {\n  break;\n}", "error[E306]: Can't use 'break' outside of a loop.\n --> <stdin>:2:3\n  |\n2 |   break;\n  |   ^^^^^\n"},
+		{"range step of 0", "for (var i in range(0, 1, 0)) print i;", "error[E404]: range step can't be 0.\n --> <stdin>:1:28\n  |\n1 | for (var i in range(0, 1, 0)) print i;\n  |                            ^\n"},
+		{"map containing itself", "var m = {};\nm[\"me\"] = m;\nprint m;", "{\"me\": {...}}\n"},
+		{"yield outside a function", "yield 1;", "error[E303]: Can't yield outside of a function.\n --> <stdin>:1:1\n  |\n1 | yield 1;\n  | ^^^^^\n"},
+		{"return a value from a generator", "fun f() {\n  yield 1;\n  return 2;\n}", "error[E303]: Can't return a value from a generator.\n --> <stdin>:3:3\n  |\n3 |   return 2;\n  |   ^^^^^^\n"},
+		{"generator resuming itself", "var g;\nfun f() { yield g.next(); }\ng = f();\ng.next();", "error[E404]: Generator 'f' is already running.\n --> <stdin>:2:24\n  |\n2 | fun f() { yield g.next(); }\n  |                        ^\n"},
+		{"error inside a generator", "fun f() {\n  yield 1;\n  yield nope;\n}\nvar g = f();\nprint g.next();\ng.next();", "1\nerror[E402]: Undefined variable 'nope'.\n --> <stdin>:3:9\n  |\n3 |   yield nope;\n  |         ^^^^\n"},
+		{"spawn needs a call", "spawn 1;", "error[E201]: Expect a call after 'spawn'.\n --> <stdin>:1:1\n  |\n1 | spawn 1;\n  | ^^^^^\n"},
+		{"await a non-task", "print await 1;", "error[E401]: Can only await a task.\n --> <stdin>:1:7\n  |\n1 | print await 1;\n  |       ^^^^^\n"},
+		{"spawn checks arity", "fun f(a) {}\nspawn f();", "error[E403]: Expected 1 arguments but got 0.\n --> <stdin>:2:9\n  |\n2 | spawn f();\n  |         ^\n"},
+		{"send on a closed channel", "var c = channel(1);\nc.close();\nc.send(1);", "error[E404]: Can't send on a closed channel.\n --> <stdin>:3:9\n  |\n3 | c.send(1);\n  |         ^\n"},
+		{"generator in another task", "fun g() { yield 1; }\nvar gen = g();\nfun use() { return gen.next(); }\nawait spawn use();", "error[E404]: Generator 'g' belongs to another task.\n --> <stdin>:3:29\n  |\n3 | fun use() { return gen.next(); }\n  |                             ^\n"},
+		{"this in a class method", "class A {\n  class make() { return this; }\n}", "error[E304]: Can't use 'this' in a class method.\n --> <stdin>:2:25\n  |\n2 |   class make() { return this; }\n  |                         ^^^^\n"},
+		{"super in a class method", "class A {}\nclass B < A {\n  class make() { return super.make(); }\n}", "error[E304]: Can't use 'super' in a class method.\n --> <stdin>:3:25\n  |\n3 |   class make() { return super.make(); }\n  |                         ^^^^^\n"},
+		{"setter parameters", "class A {\n  set x(a, b) {}\n}", "error[E201]: A setter takes exactly one parameter.\n --> <stdin>:2:7\n  |\n2 |   set x(a, b) {}\n  |       ^\n"},
+		{"method named set", "class A {\n  set(x) { return x; }\n}\nprint A().set(2);", "2\n"},
+		{"instance equals nil", "class A {}\nprint A() == nil;\nprint nil != A();", "false\ntrue\n"},
+		{"__str__ must return a string", "class A { __str__() { return 1; } } print A();", "error[E401]: __str__ must return a string.\n --> <stdin>:1:11\n  |\n1 | class A { __str__() { return 1; } } print A();\n  |           ^^^^^^^\n"},
+		{"__hash__ result", "class A { __hash__() { return [1]; } } var m = {}; m[A()] = 1;", "error[E401]: __hash__ must return a number, string, boolean or nil.\n --> <stdin>:1:57\n  |\n1 | class A { __hash__() { return [1]; } } var m = {}; m[A()] = 1;\n  |                                                         ^\n"},
+		{"__len__ result", "class A { __len__() { return -1; } } print len(A());", "error[E401]: __len__ must return a whole number of 0 or more.\n --> <stdin>:1:51\n  |\n1 | class A { __len__() { return -1; } } print len(A());\n  |                                                   ^\n"},
+		{"operator method arity", "class A { __add__() { return 1; } } print A() + 1;", "error[E403]: Expected 0 arguments but got 1.\n --> <stdin>:1:47\n  |\n1 | class A { __add__() { return 1; } } print A() + 1;\n  |                                               ^\n"},
+		{"no operator method", "class A {} print A() - 1;", "error[E401]: Operands must be numbers.\n --> <stdin>:1:22\n  |\n1 | class A {} print A() - 1;\n  |                      ^\n"},
+		{"assertEqual uses __eq__", "class A { __eq__(o) { return true; } } assertEqual(A(), 2); print \"ok\";", "ok\n"},
+		{"inconsistent method order", "class A {} class B < A {} class C < A with B {}", "error[E401]: Can't find a consistent method order for 'C'.\n --> <stdin>:1:33\n  |\n1 | class A {} class B < A {} class C < A with B {}\n  |                                 ^\n"},
+		{"trait listed twice", "class A {} class B with A, A {}", "error[E307]: A class can't inherit from 'A' twice.\n --> <stdin>:1:28\n  |\n1 | class A {} class B with A, A {}\n  |                            ^\n"},
+		{"class with itself", "class A with A {}", "error[E305]: A class can't inherit from itself.\n --> <stdin>:1:14\n  |\n1 | class A with A {}\n  |              ^\n"},
+		{"trait must be a class", "var x = 1; class A with x {}", "error[E401]: Trait must be a class.\n --> <stdin>:1:25\n  |\n1 | var x = 1; class A with x {}\n  |                         ^\n"},
+		{"with needs a trait", "class A with {}", "error[E201]: Expect trait name.\n --> <stdin>:1:14\n  |\n1 | class A with {}\n  |              ^\n"},
+		{"with is not reserved", "var with = 1; print with;", "1\n"},
+		{"getField on a missing field", "class A {} print getField(A(), \"x\");", "error[E402]: Undefined property 'x'.\n --> <stdin>:1:35\n  |\n1 | class A {} print getField(A(), \"x\");\n  |                                   ^\n"},
+		{"classOf needs an instance", "print classOf(1);", "error[E401]: classOf needs an instance.\n --> <stdin>:1:16\n  |\n1 | print classOf(1);\n  |                ^\n"},
+		{"isInstance needs a class", "print isInstance(1, 2);", "error[E401]: isInstance needs a value and a class.\n --> <stdin>:1:22\n  |\n1 | print isInstance(1, 2);\n  |                      ^\n"},
+		{"arity of a callable instance", "class A { __call__(a, b) {} } print arity(A());", "2\n"},
+		{"argument range", "fun f(a, b = 1) {} f();", "error[E403]: Expected 1 to 2 arguments but got 0.\n --> <stdin>:1:22\n  |\n1 | fun f(a, b = 1) {} f();\n  |                      ^\n"},
+		{"rest parameter arity", "fun f(a, ...r) {} f();", "error[E403]: Expected at least 1 arguments but got 0.\n --> <stdin>:1:21\n  |\n1 | fun f(a, ...r) {} f();\n  |                     ^\n"},
+		{"unknown named argument", "fun f(a) {} f(b: 1);", "error[E403]: No parameter named 'b'.\n --> <stdin>:1:15\n  |\n1 | fun f(a) {} f(b: 1);\n  |               ^\n"},
+		{"argument passed twice", "fun f(a) {} f(1, a: 2);", "error[E403]: Argument 'a' was passed twice.\n --> <stdin>:1:18\n  |\n1 | fun f(a) {} f(1, a: 2);\n  |                  ^\n"},
+		{"missing named argument", "fun f(a, b) {} f(b: 1);", "error[E403]: Missing argument for 'a'.\n --> <stdin>:1:22\n  |\n1 | fun f(a, b) {} f(b: 1);\n  |                      ^\n"},
+		{"named argument to a native", "print len(x: 1);", "error[E403]: Only functions declared in Lox take named arguments.\n --> <stdin>:1:11\n  |\n1 | print len(x: 1);\n  |           ^\n"},
+		{"spread needs a list", "fun f(a) {} f(...1);", "error[E401]: Can only spread a list.\n --> <stdin>:1:15\n  |\n1 | fun f(a) {} f(...1);\n  |               ^^^\n"},
+		{"rest parameter last", "fun f(...a, b) {}", "error[E201]: The rest parameter must be the last one.\n --> <stdin>:1:10\n  |\n1 | fun f(...a, b) {}\n  |          ^\n"},
+		{"defaults last", "fun f(a = 1, b) {}", "error[E201]: Parameters with default values must come after the ones without.\n --> <stdin>:1:14\n  |\n1 | fun f(a = 1, b) {}\n  |              ^\n"},
+		{"named arguments last", "fun f(a, b) {} f(a: 1, 2);", "error[E201]: Named arguments must come after the others.\n --> <stdin>:1:24\n  |\n1 | fun f(a, b) {} f(a: 1, 2);\n  |                        ^\n"},
+		{"rest by name", "fun f(...r) {} f(r: 1);", "error[E403]: The rest parameter can't be passed by name.\n --> <stdin>:1:18\n  |\n1 | fun f(...r) {} f(r: 1);\n  |                  ^\n"},
+		{"setter with a rest parameter", "class A { set x(...v) {} }", "error[E201]: A setter takes exactly one parameter.\n --> <stdin>:1:15\n  |\n1 | class A { set x(...v) {} }\n  |               ^\n"},
+		//found by fuzzing (fuzz_test.go)
+		{"assign a call result", "fun f(x) { return x; }\nvar a;\na = f(1);\nprint a;", "1\n"},
+		{"function & class equality", "fun f() {}\nclass A {}\nprint f == f;\nprint A == A;\nprint f == A;", "true\ntrue\nfalse\n"},
+		{"stack overflow", "fun f() { f(); }\nf();", "error[E404]: Stack overflow.\n --> <stdin>:1:13\n  |\n1 | fun f() { f(); }\n  |             ^\n"},
 	}
 
 	for _, testCase := range tests {
@@ -166,7 +250,9 @@ func TestRunner(t *testing.T) {
 		r, w, _ := os.Pipe()
 		os.Stdout = w
 
+		//errors go to stderr, but the expected outputs have them after what was printed
 		runner := newRunner()
+		runner.errOut = w
 		runner.run(testCase.srcCode)
 
 		w.Close()
@@ -182,6 +268,60 @@ func TestRunner(t *testing.T) {
 	fmt.Print("\n")
 }
 
+//Diagnostics go to stderr, so JSON errors can be read apart from what the script prints
+func TestDiagnosticsOnStderr(t *testing.T) {
+	ogStdout, ogStderr := os.Stdout, os.Stderr
+	outR, outW, _ := os.Pipe()
+	errR, errW, _ := os.Pipe()
+	os.Stdout, os.Stderr = outW, errW
+
+	runner := newRunner()
+	runner.errorFormat = JSON_FORMAT
+	runner.run("print \"hi\"; print 1 - nil;")
+
+	outW.Close()
+	errW.Close()
+	os.Stdout, os.Stderr = ogStdout, ogStderr
+	stdout, _ := ioutil.ReadAll(outR)
+	stderr, _ := ioutil.ReadAll(errR)
+
+	if string(stdout) != "hi\n" {
+		t.Errorf("Stdout: got %s, expected only the script's output", strconv.Quote(string(stdout)))
+	}
+	if !strings.HasPrefix(string(stderr), "{") || !strings.Contains(string(stderr), "Operands must be numbers.") {
+		t.Errorf("Stderr: got %s, expected the JSON diagnostic", strconv.Quote(string(stderr)))
+	}
+}
+
+//Checks the one-line and JSON renderings of the same diagnostic
+func TestErrorFormats(t *testing.T) {
+	tests := []struct{
+		format string
+		expectedOutput string
+	}{
+		{SHORT_FORMAT, "test.lox:1:13: error[E402]: Undefined variable 'b'.\n"},
+		{JSON_FORMAT, `{"severity":"error","phase":"runtime","code":"E402","file":"test.lox","line":1,"column":13,"endColumn":14,"message":"Undefined variable 'b'."}` + "\n"},
+	}
+
+	for _, testCase := range tests {
+		var output strings.Builder
+		runner := newRunner()
+		runner.file = "test.lox"
+		runner.errorFormat = testCase.format
+		runner.errOut = &output
+		runner.run("var a = 1 + b;")
+
+		if output.String() != testCase.expectedOutput {
+			t.Errorf("Output error for format %s: got %s, expected %s", testCase.format, strconv.Quote(output.String()), strconv.Quote(testCase.expectedOutput))
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in test_results from the current output")
+
+//Runs every file in tests/. Files with "// expect" annotations are checked against them
+//(printed lines, each diagnostic's phase, line & message, and the exit code); files with a
+//golden file in test_results must also print exactly that. -update rewrites the golden files
 func TestFileRunner(t *testing.T) {
 	//get the files stored in the test folder
 	filepaths, err := filepath.Glob(filepath.Join("tests", "*.lox"))
@@ -202,29 +342,780 @@ func TestFileRunner(t *testing.T) {
 				t.Fatal("Error reading test file:", err)
 			}
 
+			//run with output & errors kept apart, as the annotations check them separately
+			var stdout, stderr strings.Builder
+			runner := newRunner()
+			runner.file = f
+			runner.interpreter.out = &stdout
+			runner.errOut = &stderr
+			runner.run(string(test))
+
+			expect := parseExpectations(string(test))
+			if expect != nil {
+				expected, actual := expect.compare(stdout.String(), runner.reported, runner.exitCode())
+				if expected != actual {
+					t.Errorf("%s does not match its annotations:\n%s", f, unifiedDiff(expected, actual))
+				}
+			}
+
 			//get the correct output from text file
 			correctFile := filepath.Join("test_results", testName+"_results.txt")
+			output := stdout.String() + stderr.String()
+			if *update && (expect == nil || fileExists(correctFile)) {
+				if err := os.WriteFile(correctFile, []byte(output), 0644); err != nil {
+					t.Fatal("Error writing expected output:", err)
+				}
+				return
+			}
 			expected, err := os.ReadFile(correctFile)
-			if err != nil {
+			if os.IsNotExist(err) && expect != nil {
+				return //the annotations are the whole test
+			} else if err != nil {
 				t.Fatal("Error reading expected output:", err)
 			}
 
-			//now run the real code, same as in testRun
-			ogOs := os.Stdout
-			r, w, _ := os.Pipe()
-			os.Stdout = w
+			//compare
+			if output != string(expected) {
+				t.Errorf("%s does not match %s (go test -update to accept the new output):\n%s", f, correctFile, unifiedDiff(string(expected), output))
+			}
+		})
+	}
+}
 
-			runner := newRunner()
-			runner.run(string(test))
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
 
-			w.Close()
-			output, _ := ioutil.ReadAll(r)
-			os.Stdout = ogOs
+/**EXPECT ANNOTATIONS**/
+//Like the Crafting Interpreters suite:
+//	print 1 + 2; // expect: 3
+//	print nil - 1; // expect runtime error: Operands must be numbers.
+//	var = 1; // expect parse error at line 4: Expect a variable name.
+//An error is expected on its own line unless "at line N" says otherwise, and the message
+//can be left off. The exit code follows from the errors: 65 for static ones, 70 for runtime
+var expectOutput = regexp.MustCompile(`// expect: ?(.*)$`)
+var expectError = regexp.MustCompile(`// expect (scan|parse|resolve|runtime) error(?: at line (\d+))?(?:: ?(.*))?$`)
 
-			//compare
-			if string(output) != string(expected) {
-				t.Errorf("Error at test %s: got %s expected %s", testName, strconv.Quote(string(output)), strconv.Quote(string(expected)))
+type expectedError struct {
+	phase string
+	line  int
+	msg   string //"" when any message will do
+}
+
+type expectations struct {
+	output []string
+	errors []expectedError
+}
+
+//nil when the file has no annotations
+func parseExpectations(source string) *expectations {
+	var expect expectations
+	found := false
+	for i, line := range strings.Split(source, "\n") {
+		if match := expectOutput.FindStringSubmatch(line); match != nil {
+			expect.output = append(expect.output, match[1])
+			found = true
+		} else if match := expectError.FindStringSubmatch(line); match != nil {
+			e := expectedError{phase: match[1], line: i + 1, msg: match[3]}
+			if match[2] != "" {
+				e.line, _ = strconv.Atoi(match[2])
 			}
-		})
+			expect.errors = append(expect.errors, e)
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &expect
+}
+
+//Writes what was expected and what happened in the same shape, ready to diff
+func (expect *expectations) compare(stdout string, reported []Diagnostic, exitCode int) (string, string) {
+	var expected, actual strings.Builder
+	for _, line := range expect.output {
+		fmt.Fprintln(&expected, line)
+	}
+	actual.WriteString(stdout)
+
+	describe := func(phase string, line int, msg string) string {
+		return fmt.Sprintf("[line %d] %s error: %s\n", line, phase, msg)
+	}
+	wantCode := 0
+	for i, e := range expect.errors {
+		msg := e.msg
+		if msg == "" && i < len(reported) && reported[i].phase.String() == e.phase && reported[i].line == e.line {
+			msg = reported[i].msg //no message given, so whatever was reported on that line matches
+		}
+		expected.WriteString(describe(e.phase, e.line, msg))
+		if e.phase == "runtime" {
+			wantCode = 70
+		} else {
+			wantCode = 65
+		}
+	}
+	for _, d := range reported {
+		actual.WriteString(describe(d.phase.String(), d.line, d.msg))
+	}
+	fmt.Fprintf(&expected, "exit code %d\n", wantCode)
+	fmt.Fprintf(&actual, "exit code %d\n", exitCode)
+	return expected.String(), actual.String()
+}
+
+//Whether a test file is meant to fail before it can even be parsed
+func expectsSyntaxError(source string) bool {
+	expect := parseExpectations(source)
+	if expect == nil {
+		return false
+	}
+	for _, e := range expect.errors {
+		if e.phase == "scan" || e.phase == "parse" {
+			return true
+		}
 	}
+	return false
+}
+
+/**DIFFS**/
+//Line by line unified diff (3 lines of context) from the longest common subsequence
+func unifiedDiff(expected, actual string) string {
+	a := strings.SplitAfter(expected, "\n")
+	b := strings.SplitAfter(actual, "\n")
+	if a[len(a)-1] == "" {
+		a = a[:len(a)-1]
+	}
+	if b[len(b)-1] == "" {
+		b = b[:len(b)-1]
+	}
+
+	//lcs[i][j] is the longest common run of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type edit struct {
+		kind byte //' ', '-' or '+'
+		line string
+		i, j int  //position in a & b before this line
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			edits = append(edits, edit{' ', a[i], i, j})
+			i, j = i+1, j+1
+		} else if j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]) {
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		} else {
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString("--- expected\n+++ actual\n")
+	for start := 0; start < len(edits); {
+		//find the next change and take it, its neighbours, and 3 lines either side
+		first := start
+		for first < len(edits) && edits[first].kind == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+		from := first - 3
+		if from < start {
+			from = start
+		}
+		to := first
+		for k := first; k < len(edits) && k-to <= 6; k++ {
+			if edits[k].kind != ' ' {
+				to = k
+			}
+		}
+		to += 4
+		if to > len(edits) {
+			to = len(edits)
+		}
+
+		var removed, added int
+		for _, e := range edits[from:to] {
+			if e.kind != '+' {
+				removed++
+			}
+			if e.kind != '-' {
+				added++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", edits[from].i+1, removed, edits[from].j+1, added)
+		for _, e := range edits[from:to] {
+			out.WriteByte(e.kind)
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+	return out.String()
+}
+
+//Formats every test file twice: the second pass must change nothing,
+//and the formatted program must still print the same thing
+func TestFormatter(t *testing.T) {
+	filepaths, err := filepath.Glob(filepath.Join("tests", "*.lox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range filepaths {
+		source, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal("Error reading test file:", err)
+		}
+
+		once, diagnostics := formatSource(string(source))
+		if diagnostics != nil && expectsSyntaxError(string(source)) {
+			continue
+		} else if diagnostics != nil {
+			t.Errorf("Could not format %s: %v", f, diagnostics)
+			continue
+		}
+		twice, _ := formatSource(once)
+		if once != twice {
+			t.Errorf("Formatting %s is not idempotent: got %s then %s", f, strconv.Quote(once), strconv.Quote(twice))
+		}
+
+		if captureRun(once) != captureRun(string(source)) {
+			t.Errorf("Formatting %s changed its output", f)
+		}
+	}
+
+	//messy layout in, canonical layout out
+	messy := "class A<B{  // the class\nm(a,b){return a+-b;}\n\n\n  /* spaced */ n(){}}\nif(x){print 1;}else if (y) print 2; else {}\n"
+	expected := "class A < B { // the class\n  m(a, b) {\n    return a + -b;\n  }\n\n  /* spaced */\n  n() {}\n}\nif (x) {\n  print 1;\n} else if (y) print 2;\nelse {}\n"
+	if got, _ := formatSource(messy); got != expected {
+		t.Errorf("Formatting error: got %s, expected %s", strconv.Quote(got), strconv.Quote(expected))
+	}
+
+	//expressions print on one line, so comments inside them move to the end of it
+	inside := "var x = 1 + /* one */ 2 // end\n  + 3;\nprint foo(a, // first\n  b);\n"
+	expected = "var x = 1 + 2 + 3; /* one */ // end\nprint foo(a, b); // first\n"
+	if got, _ := formatSource(inside); got != expected {
+		t.Errorf("Formatting error: got %s, expected %s", strconv.Quote(got), strconv.Quote(expected))
+	}
+}
+
+//glox fmt keeps errors out of what it prints, and -w rewrites files in place
+func TestFormatCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if status := runFormat(nil, strings.NewReader("print (1;\n"), &stdout, &stderr); status != 65 {
+		t.Errorf("expected status 65 for a syntax error, got %d", status)
+	}
+	if stdout.Len() != 0 || !strings.Contains(stderr.String(), "error[E201]") {
+		t.Errorf("expected the error on stderr only, got stdout %q and stderr %q", stdout.String(), stderr.String())
+	}
+
+	path := filepath.Join(t.TempDir(), "messy.lox")
+	ioutil.WriteFile(path, []byte("print  1 ;\n"), 0644)
+	stdout.Reset()
+	stderr.Reset()
+	if status := runFormat([]string{"-w", path, path + ".missing"}, nil, &stdout, &stderr); status != 1 {
+		t.Errorf("expected status 1 with a missing file, got %d", status)
+	}
+	if written, _ := ioutil.ReadFile(path); string(written) != "print 1;\n" {
+		t.Errorf("expected the file rewritten, got %q", written)
+	}
+	if stdout.Len() != 0 || !strings.Contains(stderr.String(), "could not read") {
+		t.Errorf("expected the missing file reported on stderr, got stdout %q and stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+//Drives the debugger through a breakpoint, printing, locals, the stack and stepping out
+func TestDebugger(t *testing.T) {
+	source := "fun add(a, b) {\n  var sum = a + b;\n  return sum;\n}\nvar x = add(1, 2);\nvar y = x * 2;\n"
+	commands := "break 2\nc\np a + b\nlocals\nstack\nout\np x\np nope\nc\n"
+	expected := `stopped at test.lox:1: fun add(a, b) {
+(glox) breakpoint at test.lox:2: var sum = a + b;
+(glox) stopped at test.lox:2: var sum = a + b;
+(glox) 3
+(glox)   [0] a = 1
+  [0] b = 2
+(glox) #0 add at test.lox:2
+#1 <script> at test.lox:5
+(glox) stopped at test.lox:6: var y = x * 2;
+(glox) 3
+(glox) Undefined variable 'nope'.
+(glox) `
+
+	var output strings.Builder
+	runner := newRunner()
+	runner.file = "test.lox"
+	runner.errOut = &output
+	runner.interpreter.tracer = newDebugger("test.lox", source, newDebugConsole(strings.NewReader(commands), &output))
+	runner.run(source)
+
+	if output.String() != expected {
+		t.Errorf("Debugger transcript: got %s, expected %s", strconv.Quote(output.String()), strconv.Quote(expected))
+	}
+	if runner.hadRuntimeError || runner.interpreter.globals.values["y"] != int64(6) {
+		t.Errorf("Program didn't finish normally under the debugger")
+	}
+}
+
+//Printing an expression while paused leaves the program's resolved variables alone, even
+//where the expression's tokens sit at the same line and column as the program's
+func TestDebuggerPrintKeepsLocals(t *testing.T) {
+	source := "fun g() { return len(\"ab\"); }\nfun f(len) {\n  {\n    {\n      print len;\n    }\n  }\n}\nf(1);\nprint g();\n"
+	commands := "break 5\nc\np [1, 2, 3, 4, 50][len]\nc\n" //len at g's column 18
+	expected := `stopped at test.lox:1: fun g() { return len("ab"); }
+(glox) breakpoint at test.lox:5: print len;
+(glox) stopped at test.lox:5: print len;
+(glox) 2
+(glox) 1
+2
+`
+
+	var output strings.Builder
+	runner := newRunner()
+	runner.file = "test.lox"
+	runner.errOut = &output
+	runner.interpreter.out = &output
+	runner.interpreter.tracer = newDebugger("test.lox", source, newDebugConsole(strings.NewReader(commands), &output))
+	runner.run(source)
+
+	if output.String() != expected {
+		t.Errorf("Debugger transcript: got %s, expected %s", strconv.Quote(output.String()), strconv.Quote(expected))
+	}
+	if runner.hadRuntimeError {
+		t.Errorf("Printing in the debugger broke a later lookup")
+	}
+}
+
+//Showing values while paused runs __str__, but never stops inside it or fails the script
+func TestDebuggerProtocolMethods(t *testing.T) {
+	source := "class P {\n  __str__() {\n    return \"p\";\n  }\n}\nclass Bad {\n  __str__() {\n    return 1;\n  }\n}\nfun f(p, bad) {\n  return p;\n}\nf(P(), Bad());\n"
+	commands := "break 3\nbreak 12\nc\nlocals\np bad\nc\n"
+	expected := `stopped at test.lox:1: class P {
+(glox) breakpoint at test.lox:3: return "p";
+(glox) breakpoint at test.lox:12: return p;
+(glox) stopped at test.lox:12: return p;
+(glox)   [0] bad = Bad instance
+  [0] p = p
+(glox) Bad instance
+(glox) `
+
+	var output strings.Builder
+	runner := newRunner()
+	runner.file = "test.lox"
+	runner.errOut = &output
+	runner.interpreter.tracer = newDebugger("test.lox", source, newDebugConsole(strings.NewReader(commands), &output))
+	runner.run(source)
+
+	if output.String() != expected {
+		t.Errorf("Debugger transcript: got %s, expected %s", strconv.Quote(output.String()), strconv.Quote(expected))
+	}
+	if runner.hadRuntimeError {
+		t.Errorf("A failing __str__ in the debugger counted against the script")
+	}
+}
+
+//Call counts & stacks are exact even though the times aren't
+func TestProfiler(t *testing.T) {
+	source := "fun fib(n) {\n  if (n < 2) return n;\n  return fib(n - 1) + fib(n - 2);\n}\nclass Box { init() { this.start = clock(); } }\nvar box = Box();\nvar result = fib(5);\n"
+	runner := newRunner()
+	profiler := newProfiler("fib.lox")
+	runner.interpreter.tracer = profiler
+	runner.run(source)
+	profiler.finish()
+
+	var summary, folded, pprof strings.Builder
+	profiler.writeSummary(&summary)
+	profiler.writeFolded(&folded)
+	var zipped bytes.Buffer
+	if err := profiler.writePprof(&zipped); err != nil {
+		t.Fatal("writing pprof:", err)
+	}
+	reader, err := gzip.NewReader(&zipped)
+	if err != nil {
+		t.Fatal("pprof output isn't gzipped:", err)
+	}
+	raw, _ := ioutil.ReadAll(reader)
+	pprof.Write(raw)
+
+	checks := []struct {
+		output string
+		name   string
+		wants  []string
+	}{
+		{summary.String(), "summary", []string{"Profile of fib.lox", "fib                            15", "Box                             1", "clock                           1", "fib.lox:2"}},
+		{folded.String(), "folded", []string{"<script>;fib;fib;fib;fib ", "<script>;Box;clock "}},
+		{pprof.String(), "pprof", []string{"statements", "nanoseconds", "fib.lox", "script"}},
+	}
+	for _, check := range checks {
+		for _, want := range check.wants {
+			if !strings.Contains(check.output, want) {
+				t.Errorf("%s: expected %q in %s", check.name, want, check.output)
+			}
+		}
+	}
+
+	//every native shows up in stacks under the name it's defined as
+	for name, value := range newInterpreter().globals.values {
+		if callee, ok := value.(LoxCallable); ok && callee.calleeName() != name {
+			t.Errorf("native %s calls itself %s", name, callee.calleeName())
+		}
+	}
+}
+
+//A task and the main program taking turns in the same function keep their stacks apart
+func TestProfilerTasks(t *testing.T) {
+	source := "fun spin(n) { var i = 0; while (i < n) i = i + 1; }\nfun worker() { spin(5000); }\nfun mainwork() { spin(5000); }\nvar task = spawn worker();\nmainwork();\nawait task;\n"
+	runner := newRunner()
+	profiler := newProfiler("tasks.lox")
+	runner.interpreter.tracer = profiler
+	runner.run(source)
+	profiler.finish()
+
+	var folded strings.Builder
+	profiler.writeFolded(&folded)
+	for _, want := range []string{"<script>;mainwork;spin ", "\nworker;spin "} {
+		if !strings.Contains("\n"+folded.String(), want) {
+			t.Errorf("expected %q in %s", want, folded.String())
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(folded.String()), "\n") {
+		if strings.Contains(line, "worker") && !strings.HasPrefix(line, "worker") {
+			t.Errorf("task frames mixed into another stack: %s", line)
+		}
+	}
+	if len(profiler.tasks) != 0 {
+		t.Errorf("finished tasks should leave no stacks behind, %d left", len(profiler.tasks))
+	}
+}
+
+//Two runs down different branches of the same file, merged through LCOV
+func TestCoverage(t *testing.T) {
+	source := "fun sign(n) {\n  if (n < 0) return -1;\n  return n > 0 and 1;\n}\nvar i = 0;\nwhile (i < 2) i = i + 1;\nprint sign(X);\n"
+	run := func(x string) *LcovRecord {
+		src := strings.Replace(source, "X", x, 1)
+		coverage := newCoverage("sign.lox")
+		runner := newRunner()
+		runner.interpreter.out = ioutil.Discard
+		runner.interpreter.tracer = coverage
+		runner.run(src)
+		return coverage.record(newParser(newScanner(src).scanTokens()).parse())
+	}
+
+	first := run("5")
+	var lcov strings.Builder
+	writeLcov(&lcov, map[string]*LcovRecord{first.file: first})
+	records, err := readLcov(strings.NewReader(lcov.String()))
+	if err != nil {
+		t.Fatal("reading back LCOV:", err)
+	}
+	merged := records[first.file]
+	merged.merge(run("-5"))
+
+	var output strings.Builder
+	writeLcov(&output, records)
+	expected := []string{
+		"DA:1,2", "DA:2,3", "DA:3,1", "DA:6,6", //a line counts every statement on it
+		"BRDA:2,0,0,1", "BRDA:2,0,1,1", //if went both ways
+		"BRDA:3,0,0,1", "BRDA:3,0,1,0", //and always evaluated its right side
+		"BRDA:6,0,0,4", "BRDA:6,0,1,2",
+		"BRF:6\nBRH:5\nLF:6\nLH:6\nend_of_record",
+	}
+	for _, want := range expected {
+		if !strings.Contains(output.String(), want+"\n") {
+			t.Errorf("expected %q in %s", want, output.String())
+		}
+	}
+}
+
+//A passing test, a failing assertion and a runtime error, each on its own interpreter
+func TestTestRunner(t *testing.T) {
+	dir := t.TempDir()
+	source := "var count = 0;\nfun test_adds() {\n  count = count + 1;\n  assertEqual(count, 1);\n}\n" +
+		"fun test_isolated() {\n  count = count + 1;\n  print count;\n  assertEqual(count, 2);\n}\n" +
+		"fun helper() {\n  return nil + 1;\n}\n" +
+		"fun test_throws() {\n  assertEqual(assertThrows(helper), \"Operands must be two numbers or two strings.\");\n}\n" +
+		"fun test_collections() {\n  assertEqual([1, [2, 3]], [1, [2, 3]]);\n  assertEqual({\"a\": [1], 2: nil}, {2: nil, \"a\": [1]});\n}\n" +
+		"fun test_message() {\n  assert(count > 5, \"count is too small\");\n}\n"
+	ioutil.WriteFile(filepath.Join(dir, "math_test.lox"), []byte(source), 0644)
+	report := filepath.Join(dir, "report.xml")
+
+	var output strings.Builder
+	if code := runTests([]string{"--junit=" + report, dir}, &output); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	file := filepath.Join(dir, "math_test.lox")
+	expected := []string{
+		"--- FAIL: test_isolated (" + file + ")",
+		"    1\n    " + file + ":9:23: Expected 2 but got 1.\n", //the line of the assertion, with what was printed before it
+		"--- FAIL: test_message (" + file + ")",
+		"    " + file + ":22:41: count is too small\n",
+		"FAIL\t3 passed, 2 failed\n",
+	}
+	for _, want := range expected {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("expected %q in %s", want, output.String())
+		}
+	}
+	if strings.Contains(output.String(), "helper") {
+		t.Errorf("only test_ functions should run, got %s", output.String())
+	}
+
+	xml, _ := ioutil.ReadFile(report)
+	for _, want := range []string{`<testsuite name="` + file + `" tests="5" failures="2"`, `<testcase name="test_adds"`,
+		`<failure message="Expected 2 but got 1." type="E405">` + file + `:9:23: Expected 2 but got 1.</failure>`} {
+		if !strings.Contains(string(xml), want) {
+			t.Errorf("expected %q in %s", want, xml)
+		}
+	}
+}
+
+//Suspended generators each hold a goroutine, so check that breaking out of them, dropping
+//them and closing them all give those back
+func TestGeneratorCleanup(t *testing.T) {
+	before := runtime.NumGoroutine()
+	runner := newRunner()
+	runner.interpreter.out = ioutil.Discard
+	runner.run("fun naturals() {\n  var i = 0;\n  while (true) yield i++;\n}\n" +
+		"for (var i in range(0, 50, 1)) for (var n in naturals()) if (n == i) break;\n")
+	settled := func(want int) bool {
+		for tries := 0; tries < 100; tries++ {
+			if runtime.NumGoroutine() <= want {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	if !settled(before) {
+		t.Errorf("breaking out of for-in leaked generators: %d goroutines, started with %d", runtime.NumGoroutine(), before)
+	}
+
+	//dropped generators get closed once they're collected and another generator starts
+	runner.run("for (var i in range(0, 50, 1)) naturals().next();\n")
+	itpr := runner.interpreter
+	for tries := 0; tries < 10; tries++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		itpr.generatorMu.Lock()
+		queued := len(itpr.abandoned)
+		itpr.generatorMu.Unlock()
+		if queued >= 50 {
+			break
+		}
+	}
+	runner.run("var kept = naturals();\nkept.next();\n")
+	if !settled(before + 1) {
+		t.Errorf("dropped generators weren't closed: %d goroutines, started with %d", runtime.NumGoroutine(), before)
+	}
+
+	itpr.closeGenerators()
+	if !settled(before) {
+		t.Errorf("closeGenerators left %d goroutines, started with %d", runtime.NumGoroutine(), before)
+	}
+}
+
+//Tasks share globals, instances, lists and maps; run under -race this checks the GIL really
+//keeps them apart, that a sleeping task lets the others run and that a busy task still gives
+//way. The order things happen in shows that, not the clock, so a slow machine can't fail them
+func TestConcurrency(t *testing.T) {
+	tests := []struct {
+		testName       string
+		srcCode        string
+		expectedOutput string
+	}{
+		{"sleeping tasks overlap", "var order = channel(6);\nfun nap() {\n  order.send(\"start\");\n  sleep(50);\n  order.send(\"end\");\n}\n" +
+			"var a = spawn nap();\nvar b = spawn nap();\nvar c = spawn nap();\nfor (var i in range(0, 6, 1)) print order.recv();\n" +
+			"await a;\nawait b;\nawait c;", "start\nstart\nstart\nend\nend\nend\n"},
+		{"shared state", "class Counter { init() { this.n = 0; this.seen = {}; this.log = [0]; } }\nvar c = Counter();\n" +
+			"fun work(id) {\n  for (var i in range(0, 2000, 1)) {\n    c.n++;\n    c.seen[id] = i;\n    c.log[0] += 1;\n  }\n  return id;\n}\n" +
+			"var tasks = [];\nfor (var i in range(0, 8, 1)) tasks = [spawn work(i), tasks];\nvar ids = 0;\n" +
+			"while (len(tasks) == 2) {\n  ids += await tasks[0];\n  tasks = tasks[1];\n}\nprint c.n;\nprint c.log[0];\nprint len(c.seen);\nprint ids;", "16000\n16000\n8\n28\n"},
+		{"busy task gives way", "var ran = false;\nfun mark() { ran = true; }\nspawn mark();\n" +
+			"while (!ran) {}\nprint ran;", "true\n"},
+		{"pipeline", "fun gen(n) { for (var i in range(0, n, 1)) yield i; }\n" +
+			"fun stage(input, output, f) {\n  for (var v in input) output.send(f(v));\n  output.close();\n}\n" +
+			"fun source(output) {\n  for (var v in gen(100)) output.send(v);\n  output.close();\n}\n" +
+			"var a = channel(0);\nvar b = channel(5);\nvar c = channel(0);\nspawn source(a);\n" +
+			"fun double(x) { return x * 2; }\nfun inc(x) { return x + 1; }\nspawn stage(a, b, double);\nspawn stage(b, c, inc);\n" +
+			"var sum = 0;\nfor (var v in c) sum += v;\nprint sum;", "10000\n"},
+	}
+
+	for _, testCase := range tests {
+		if got := captureRun(testCase.srcCode); got != testCase.expectedOutput {
+			t.Errorf("Output error at Test %s: got %s, expected %s", testCase.testName, strconv.Quote(got), strconv.Quote(testCase.expectedOutput))
+		}
+	}
+
+	//a task started on one REPL line keeps running while the next is resolved and run
+	var output bytes.Buffer
+	runner := newRunner()
+	runner.interpreter.out = &output
+	runner.run("var results = channel(1);\nfun later() { sleep(50); results.send(\"later\"); }\nspawn later();")
+	runner.run("fun more(a, b) { return a + b; }\nprint more(1, 2);")
+	runner.run("print results.recv();")
+	if output.String() != "3\nlater\n" {
+		t.Errorf("Output error at Test REPL tasks: got %s", strconv.Quote(output.String()))
+	}
+}
+
+//What a whole program leaves running when the script ends: tasks are waited for, stuck ones
+//dropped, and failures nothing awaited are reported. Waiting with everything else waiting is a deadlock
+func TestUnfinishedTasks(t *testing.T) {
+	tests := []struct {
+		testName       string
+		srcCode        string
+		expectedOutput string
+		errorLines     []int
+		exitCode       int
+	}{
+		{"output after the script", "fun late() { sleep(20); print \"late\"; }\nspawn late();\nprint \"early\";", "early\nlate\n", nil, 0},
+		{"unawaited failure", "fun fail() {\n  sleep(20);\n  return nil + 1;\n}\nspawn fail();\nprint \"done\";", "done\n", []int{3}, 70},
+		{"awaited failure reported once", "fun fail() { return nil + 1; }\nvar task = spawn fail();\nawait task;", "", []int{1}, 70},
+		{"stuck task", "var ch = channel(0);\nfun stuck() { ch.recv(); print \"never\"; }\nspawn stuck();\nprint \"done\";", "done\n", nil, 0},
+		{"deadlock awaiting", "var c = channel(0); fun f(){ return c.recv(); } print await spawn f();", "", []int{1}, 70},
+		{"deadlock alone", "var c = channel(0); c.recv();", "", []int{1}, 70},
+		{"waiting on a sleeper", "var c = channel(0);\nfun f() { sleep(30); c.send(1); }\nspawn f();\nprint c.recv();", "1\n", nil, 0},
+	}
+
+	for _, testCase := range tests {
+		var output, errors bytes.Buffer
+		runner := newRunner()
+		runner.interpreter.out = &output
+		runner.errOut = &errors
+		runner.run(testCase.srcCode)
+		runner.finishTasks(testCase.srcCode)
+
+		var lines []int
+		for _, d := range runner.reported {
+			lines = append(lines, d.line)
+		}
+		if output.String() != testCase.expectedOutput {
+			t.Errorf("Output error at Test %s: got %s, expected %s", testCase.testName, strconv.Quote(output.String()), strconv.Quote(testCase.expectedOutput))
+		}
+		if !reflect.DeepEqual(lines, testCase.errorLines) || runner.exitCode() != testCase.exitCode {
+			t.Errorf("Error at Test %s: got errors on lines %v and exit code %d, expected %v and %d\n%s", testCase.testName, lines, runner.exitCode(), testCase.errorLines, testCase.exitCode, errors.String())
+		}
+	}
+}
+
+//REPL lines and programs run one after another on the same Interpreter each keep their own
+//resolved variables, even where their tokens sit at the same line & column
+func TestReusedInterpreter(t *testing.T) {
+	var output, errors bytes.Buffer
+	runner := newRunner()
+	runner.interpreter.out = &output
+	runner.errOut = &errors
+	runner.run("var a = \"global\";")
+	runner.run("{var a=1; {print a;}}")
+	runner.run("           print a;") //a at the column the last line's inner a was at
+	if output.String() != "1\nglobal\n" || runner.hadRuntimeError {
+		t.Errorf("REPL lines: got %s and errors %s", strconv.Quote(output.String()), strconv.Quote(errors.String()))
+	}
+
+	output.Reset()
+	itpr := newInterpreter()
+	itpr.out = &output
+	for _, source := range []string{"var a = \"global\";", "{var a=1; {print a;}}", "           print a;"} {
+		if diagnostics := prepare(source).run(itpr); diagnostics != nil {
+			t.Errorf("program %s failed: %v", strconv.Quote(source), diagnostics)
+		}
+	}
+	if output.String() != "1\nglobal\n" {
+		t.Errorf("programs: got %s", strconv.Quote(output.String()))
+	}
+}
+
+//One prepared program run by many Interpreters at once, next to whole runs from scratch;
+//run under -race this checks Interpreters share nothing and a Program is only read
+func TestParallelInterpreters(t *testing.T) {
+	source := "class Shape {\n  init(name) { this.name = name; }\n  describe() { return \"${this.name} with ${this.sides()} sides\"; }\n}\n" +
+		"class Square < Shape {\n  init() { super.init(\"square\"); }\n  sides() { return 4; }\n}\n" +
+		"fun counter() {\n  var n = 0;\n  fun next() { n++; return n; }\n  return next;\n}\n" +
+		"fun evens(limit) { for (var i in range(0, limit, 2)) yield i; }\n" +
+		"fun total(xs) { var sum = 0; for (var x in xs) sum += x; return sum; }\n" +
+		"var c = counter();\nc();\nprint c();\nprint Square().describe();\nvar seen = {};\n" +
+		"for (var e in evens(10)) seen[e] = e * e;\nprint seen;\nprint await spawn total([1, 2, 3]);\n"
+	expected := "2\nsquare with 4 sides\n{0: 0, 2: 4, 4: 16, 6: 36, 8: 64}\n6\n"
+	program := prepare(source)
+	if program.hadError {
+		t.Fatalf("prepare failed: %v", program.diagnostics)
+	}
+	failing := prepare("var a = 1;\nprint a + nil;")
+
+	const RUNS = 32
+	outputs := make([]string, RUNS)
+	errors := make([][]Diagnostic, RUNS)
+	fresh := make([]string, RUNS)
+	var wg sync.WaitGroup
+	for i := 0; i < RUNS; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var output bytes.Buffer
+			itpr := newInterpreter()
+			itpr.out = &output
+			if diagnostics := program.run(itpr); diagnostics != nil {
+				t.Errorf("run %d failed: %v", i, diagnostics)
+			}
+			//a second program on the same interpreter sees the first one's globals
+			errors[i] = failing.run(itpr)
+			outputs[i] = output.String()
+
+			//and whole runs, from scanning on, side by side with the prepared ones
+			var runOutput bytes.Buffer
+			runner := newRunner()
+			runner.errOut = ioutil.Discard
+			runner.interpreter.out = &runOutput
+			runner.run(fmt.Sprintf("var n = %d;\nfun twice(x) { return x * 2; }\nprint twice(n);", i))
+			fresh[i] = runOutput.String()
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < RUNS; i++ {
+		if outputs[i] != expected {
+			t.Errorf("run %d printed %s, expected %s", i, strconv.Quote(outputs[i]), strconv.Quote(expected))
+		}
+		if len(errors[i]) != 1 || errors[i][0].msg != "Operands must be two numbers or two strings." || errors[i][0].line != 2 {
+			t.Errorf("run %d: expected one error on line 2, got %v", i, errors[i])
+		}
+		if want := fmt.Sprintf("%d\n", i*2); fresh[i] != want {
+			t.Errorf("fresh run %d printed %s, expected %s", i, strconv.Quote(fresh[i]), strconv.Quote(want))
+		}
+	}
+}
+
+//Runs source on a fresh runner and returns everything it printed
+func captureRun(source string) string {
+	ogOs := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+
+	runner := newRunner()
+	runner.run(source)
+
+	w.Close()
+	output, _ := ioutil.ReadAll(r)
+	os.Stdout = ogOs
+	return string(output)
 }
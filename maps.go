@@ -0,0 +1,85 @@
+/*
+* Lox's built-in map: {key: value} literals, map[key] to read (nil when the key isn't there)
+* and map[key] = value to add or change. Keys remember the order they were added in, so
+* printing and iterating a map is predictable. Like lists, maps are shared by reference
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"reflect"
+	"strings"
+)
+
+type LoxMap struct {
+	keys   []interface{}
+	values []interface{}
+	index  map[interface{}][]int //hashed key -> positions in keys & values; only __hash__ shares one
+}
+
+func newLoxMap() *LoxMap {
+	return &LoxMap{index: make(map[interface{}][]int)}
+}
+
+// The Go map key for a Lox value: numbers by value (so 1 and 1.0 are the same key),
+// instances with __hash__ by their hash, and lists, maps and other instances by identity
+func (itpr *Interpreter) hashKey(at Token, key interface{}) interface{} {
+	if hashed, ok := itpr.overloadedHash(at, key); ok {
+		return hashed
+	}
+	if f, isFloat := key.(float64); isFloat {
+		if i, whole := toInt(f); whole {
+			return i
+		}
+	}
+	if key != nil && !reflect.TypeOf(key).Comparable() {
+		itpr.error(&RuntimeError{token: at, code: E_TYPE, msg: "Functions and classes can't be map keys."})
+	}
+	return key
+}
+
+// Where key is in m, or -1. Equal __hash__ values only put keys in the same bucket; it
+// takes __eq__ to make them the same key
+func (itpr *Interpreter) mapFind(m *LoxMap, at Token, key interface{}, hashed interface{}) int {
+	_, overloaded := hashed.(instanceHash)
+	for _, i := range m.index[hashed] {
+		if !overloaded || m.keys[i] == key || itpr.isEqual(at, m.keys[i], key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (itpr *Interpreter) mapGet(m *LoxMap, at Token, key interface{}) interface{} {
+	if i := itpr.mapFind(m, at, key, itpr.hashKey(at, key)); i >= 0 {
+		return m.values[i]
+	}
+	return nil
+}
+
+func (itpr *Interpreter) mapSet(m *LoxMap, at Token, key interface{}, value interface{}) {
+	hashed := itpr.hashKey(at, key)
+	if i := itpr.mapFind(m, at, key, hashed); i >= 0 {
+		m.values[i] = value
+		return
+	}
+	m.index[hashed] = append(m.index[hashed], len(m.keys))
+	m.keys = append(m.keys, key)
+	m.values = append(m.values, value)
+}
+
+// {"a": 1, 2: [3]}
+func (itpr *Interpreter) stringifyMap(m *LoxMap, open map[interface{}]bool) string {
+	if open[m] {
+		return "{...}"
+	}
+	open[m] = true
+	defer delete(open, m)
+
+	parts := make([]string, len(m.keys))
+	for i, key := range m.keys {
+		parts[i] = itpr.stringifyElement(key, open) + ": " + itpr.stringifyElement(m.values[i], open)
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
@@ -0,0 +1,273 @@
+/*
+* Lox's two kinds of number: int64 for whole-number literals and float64 for the rest.
+* Ints stay ints through + - * ~/ (and fail loudly on overflow), anything touching a float
+* becomes a float, and / always gives a float so 7 / 2 is still 3.5 like the reference Lox.
+* The bit operators only take ints
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+const (
+	MSG_OVERFLOW       = "Integer overflow."
+	MSG_DIVIDE_BY_ZERO = "Division by zero."
+	MSG_NEGATIVE_SHIFT = "Shift count can't be negative."
+	MSG_NOT_REAL       = "Power has no real result."
+)
+
+func isNumber(value interface{}) bool {
+	switch value.(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+func toFloat(value interface{}) float64 {
+	if i, isInt := value.(int64); isInt {
+		return float64(i)
+	}
+	return value.(float64)
+}
+
+// Whole numbers as a plain int, for natives that take counts and indexes
+func toInt(value interface{}) (int64, bool) {
+	switch n := value.(type) {
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// + - * / ~/ % ** on two numbers; msg is set instead when the result doesn't fit
+func arithmetic(op TokenType, left interface{}, right interface{}) (result interface{}, msg string) {
+	l, lInt := left.(int64)
+	r, rInt := right.(int64)
+	switch op {
+	case SLASH:
+		if toFloat(right) == 0 {
+			return nil, MSG_DIVIDE_BY_ZERO
+		}
+		return toFloat(left) / toFloat(right), ""
+	case TILDE_SLASH:
+		return integerDivide(left, right)
+	case PERCENT:
+		return remainder(left, right)
+	case STAR_STAR:
+		return power(left, right)
+	}
+	if !lInt || !rInt {
+		switch op {
+		case PLUS:
+			return toFloat(left) + toFloat(right), ""
+		case MINUS:
+			return toFloat(left) - toFloat(right), ""
+		}
+		return toFloat(left) * toFloat(right), ""
+	}
+
+	switch op {
+	case PLUS:
+		sum := l + r
+		if (l > 0 && r > 0 && sum < 0) || (l < 0 && r < 0 && sum >= 0) {
+			return nil, MSG_OVERFLOW
+		}
+		return sum, ""
+	case MINUS:
+		difference := l - r
+		if (l >= 0 && r < 0 && difference < 0) || (l < 0 && r > 0 && difference >= 0) {
+			return nil, MSG_OVERFLOW
+		}
+		return difference, ""
+	}
+	product, fits := multiply(l, r)
+	if !fits {
+		return nil, MSG_OVERFLOW
+	}
+	return product, ""
+}
+
+func multiply(l int64, r int64) (int64, bool) {
+	product := l * r
+	if l != 0 && (product/l != r || (l == -1 && r == math.MinInt64) || (r == -1 && l == math.MinInt64)) {
+		return 0, false
+	}
+	return product, true
+}
+
+// % keeps the sign of the left side, so (a ~/ b) * b + a % b == a
+func remainder(left interface{}, right interface{}) (interface{}, string) {
+	l, lInt := left.(int64)
+	r, rInt := right.(int64)
+	if lInt && rInt {
+		if r == 0 {
+			return nil, MSG_DIVIDE_BY_ZERO
+		}
+		return l % r, ""
+	}
+
+	if toFloat(right) == 0 {
+		return nil, MSG_DIVIDE_BY_ZERO
+	}
+	return math.Mod(toFloat(left), toFloat(right)), ""
+}
+
+// An int to a non-negative int power stays an int (by squaring, so huge exponents are quick),
+// anything else goes through math.Pow. 0 to a negative power is 1 / 0 so it's the same error,
+// and a negative base to a fractional power (-8 ** (1/3)) is an error rather than NaN
+func power(left interface{}, right interface{}) (interface{}, string) {
+	base, baseInt := left.(int64)
+	exponent, exponentInt := right.(int64)
+	if !baseInt || !exponentInt || exponent < 0 {
+		if toFloat(left) == 0 && toFloat(right) < 0 {
+			return nil, MSG_DIVIDE_BY_ZERO
+		}
+		result := math.Pow(toFloat(left), toFloat(right))
+		if math.IsNaN(result) && !math.IsNaN(toFloat(left)) && !math.IsNaN(toFloat(right)) {
+			return nil, MSG_NOT_REAL
+		}
+		return result, ""
+	}
+
+	result := int64(1)
+	fits := true
+	for exponent > 0 {
+		if exponent&1 == 1 {
+			if result, fits = multiply(result, base); !fits {
+				return nil, MSG_OVERFLOW
+			}
+		}
+		exponent >>= 1
+		if exponent > 0 {
+			if base, fits = multiply(base, base); !fits {
+				return nil, MSG_OVERFLOW
+			}
+		}
+	}
+	return result, ""
+}
+
+// & | ^ << >> on two ints; >> by 64 or more shifts everything out, and << is an overflow
+// as soon as it would shift away a set bit (or change the sign), like + - and *
+func bitwise(op TokenType, l int64, r int64) (interface{}, string) {
+	switch op {
+	case AMPERSAND:
+		return l & r, ""
+	case PIPE:
+		return l | r, ""
+	case CARET:
+		return l ^ r, ""
+	}
+
+	if r < 0 {
+		return nil, MSG_NEGATIVE_SHIFT
+	}
+	if op == LESS_LESS {
+		shifted := l << uint64(r)
+		if r >= 64 && l != 0 || r < 64 && shifted>>uint64(r) != l {
+			return nil, MSG_OVERFLOW
+		}
+		return shifted, ""
+	}
+	return l >> uint64(r), ""
+}
+
+// ~/ divides and truncates towards zero, always giving an int
+func integerDivide(left interface{}, right interface{}) (interface{}, string) {
+	l, lInt := left.(int64)
+	r, rInt := right.(int64)
+	if lInt && rInt {
+		if r == 0 {
+			return nil, MSG_DIVIDE_BY_ZERO
+		}
+		if l == math.MinInt64 && r == -1 {
+			return nil, MSG_OVERFLOW
+		}
+		return l / r, ""
+	}
+
+	if toFloat(right) == 0 {
+		return nil, MSG_DIVIDE_BY_ZERO
+	}
+	quotient, fits := toInt(math.Trunc(toFloat(left) / toFloat(right)))
+	if !fits {
+		return nil, MSG_OVERFLOW
+	}
+	return quotient, ""
+}
+
+// -1, 0 or 1; an int against an int or a float is compared exactly, two floats as floats
+func compareNumbers(left interface{}, right interface{}) int {
+	l, lInt := left.(int64)
+	r, rInt := right.(int64)
+	if lInt && !rInt && !math.IsNaN(right.(float64)) {
+		return compareIntFloat(l, right.(float64))
+	}
+	if rInt && !lInt && !math.IsNaN(left.(float64)) {
+		return -compareIntFloat(r, left.(float64))
+	}
+	if !lInt || !rInt {
+		lf, rf := toFloat(left), toFloat(right)
+		switch {
+		case lf < rf:
+			return -1
+		case lf > rf:
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// Going through float64 would round big ints (2^53 + 1 == 2^53.0), so the float is brought
+// to an int instead: past the int range it's bigger or smaller than any int, and otherwise
+// its floor is exact and tells which side the int is on
+func compareIntFloat(i int64, f float64) int {
+	switch {
+	case f >= math.MaxInt64: //2^63, the first float past the top
+		return -1
+	case f < math.MinInt64:
+		return 1
+	}
+	floor := int64(math.Floor(f))
+	switch {
+	case i < floor:
+		return -1
+	case i > floor:
+		return 1
+	case f != math.Floor(f):
+		return -1
+	}
+	return 0
+}
+
+// Whole floats print without a decimal point or exponent (3.0 is "3", 1e21 is all 22 digits),
+// the rest in the shortest form that reads back the same
+func formatNumber(value interface{}) string {
+	if i, isInt := value.(int64); isInt {
+		return strconv.FormatInt(i, 10)
+	}
+	f := value.(float64)
+	if f == math.Trunc(f) && !math.IsInf(f, 0) {
+		if f == 0 && math.Signbit(f) {
+			return "-0"
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -1,35 +1,33 @@
 /*
 * Parses together given strings into the correct grammar with correct precedence
 * Created: 9/16
-* Modified: 10/7
+* Modified: 10/19
  */
 
 package main
 
 import (
 	"fmt"
+	"strings"
 )
 
 type ParseError struct {
 	token Token
+	code  string
 	msg   string
 }
 
-// Displays full Parse Error
-func (pe *ParseError) error() string {
-	var errLoc string
-	if pe.token.kind == EOF {
-		errLoc = "at end"
-	} else {
-		errLoc = "at '" + pe.token.lexeme + "'"
-	}
-	return fmt.Sprintf("[line %d] Error %v: %v", pe.token.line, errLoc, pe.msg)
+// Converts to the shared diagnostic shape, pointing at the offending token
+func (pe *ParseError) diagnostic() Diagnostic {
+	return newDiagnostic(PARSE_PHASE, pe.code, pe.token, pe.msg)
 }
 
 type Parser struct {
-	tokens   []Token
-	cur      int
-	hadError bool
+	tokens      []Token
+	cur         int
+	hadError    bool
+	diagnostics []Diagnostic
+	sawYield    bool //a yield in the function body being parsed
 }
 
 // Constructor
@@ -53,24 +51,55 @@ func (p *Parser) expression() Expr {
 	return p.assignment()
 }
 
-// assignment → ( call "." )? IDENTIFIER "=" assignment | logic_or ;
+// assignment → ( call "." IDENTIFIER | call "[" expression "]" | IDENTIFIER )
+//					( "=" | "+=" | "-=" | "*=" | "/=" ) assignment | conditional ;
 func (p *Parser) assignment() Expr {
-	expr := p.or()
+	expr := p.conditional()
 
-	if p.match(EQUAL) {
+	if p.match(EQUAL, PLUS_EQUAL, MINUS_EQUAL, STAR_EQUAL, SLASH_EQUAL) {
 		equals := p.previous()
 		value := p.assignment()
 
 		_, ok := expr.(VariableExpr)
 		if ok {
 			name := expr.(VariableExpr).name
-			return AssignExpr{name: name, value: value}
+			return AssignExpr{name: name, value: value, operator: equals}
 		} else if _, ok := expr.(GetExpr); ok {
 			get := expr.(GetExpr)
-			return SetExpr{object: get.object, name: get.name, value: value}
+			return SetExpr{object: get.object, name: get.name, value: value, operator: equals}
+		} else if index, ok := expr.(IndexExpr); ok {
+			return IndexSetExpr{object: index.object, bracket: index.bracket, index: index.index, value: value, operator: equals}
 		}
 
-		p.error(&ParseError{token: equals, msg: "Invalid assignment target."})
+		p.error(&ParseError{token: equals, code: E_INVALID_TARGET, msg: "Invalid assignment target."})
+	}
+
+	return expr
+}
+
+//conditional → coalesce ( "?" expression ":" conditional )? ;
+func (p *Parser) conditional() Expr {
+	expr := p.coalesce()
+
+	if p.match(QUESTION) {
+		question := p.previous()
+		thenBranch := p.expression()
+		p.consume(COLON, "Expect ':' after then branch of conditional expression.")
+		elseBranch := p.conditional()
+		expr = ConditionalExpr{condition: expr, question: question, thenBranch: thenBranch, elseBranch: elseBranch}
+	}
+
+	return expr
+}
+
+//coalesce → logic_or ( "??" logic_or )* ;
+func (p *Parser) coalesce() Expr {
+	expr := p.or()
+
+	for p.match(QUESTION_QUESTION) {
+		operator := p.previous()
+		right := p.or()
+		expr = LogicalExpr{left: expr, operator: operator, right: right}
 	}
 
 	return expr
@@ -115,11 +144,63 @@ func (p *Parser) equality() Expr {
 	return expr
 }
 
-// comparison → term ( ( ">" | ">=" | "<" | "<=" ) term )* ;
+// comparison → bit_or ( ( ">" | ">=" | "<" | "<=" ) bit_or )* ;
 func (p *Parser) comparison() Expr {
-	expr := p.term()
+	expr := p.bitOr()
 
 	for p.match(GREATER, GREATER_EQUAL, LESS, LESS_EQUAL) {
+		operator := p.previous()
+		right := p.bitOr()
+		expr = BinaryExpr{left: expr, operator: operator, right: right}
+	}
+
+	return expr
+}
+
+// bit_or → bit_xor ( "|" bit_xor )* ;
+func (p *Parser) bitOr() Expr {
+	expr := p.bitXor()
+
+	for p.match(PIPE) {
+		operator := p.previous()
+		right := p.bitXor()
+		expr = BinaryExpr{left: expr, operator: operator, right: right}
+	}
+
+	return expr
+}
+
+// bit_xor → bit_and ( "^" bit_and )* ;
+func (p *Parser) bitXor() Expr {
+	expr := p.bitAnd()
+
+	for p.match(CARET) {
+		operator := p.previous()
+		right := p.bitAnd()
+		expr = BinaryExpr{left: expr, operator: operator, right: right}
+	}
+
+	return expr
+}
+
+// bit_and → shift ( "&" shift )* ;
+func (p *Parser) bitAnd() Expr {
+	expr := p.shift()
+
+	for p.match(AMPERSAND) {
+		operator := p.previous()
+		right := p.shift()
+		expr = BinaryExpr{left: expr, operator: operator, right: right}
+	}
+
+	return expr
+}
+
+// shift → term ( ( "<<" | ">>" ) term )* ;
+func (p *Parser) shift() Expr {
+	expr := p.term()
+
+	for p.match(LESS_LESS, GREATER_GREATER) {
 		operator := p.previous()
 		right := p.term()
 		expr = BinaryExpr{left: expr, operator: operator, right: right}
@@ -141,11 +222,11 @@ func (p *Parser) term() Expr {
 	return expr
 }
 
-// factor → unary ( ( "/" | "*" ) unary )* ;
+// factor → unary ( ( "/" | "*" | "~/" | "%" ) unary )* ;
 func (p *Parser) factor() Expr {
 	expr := p.unary()
 
-	for p.match(SLASH, STAR) {
+	for p.match(SLASH, STAR, TILDE_SLASH, PERCENT) {
 		operator := p.previous()
 		right := p.unary()
 		expr = BinaryExpr{left: expr, operator: operator, right: right}
@@ -154,20 +235,72 @@ func (p *Parser) factor() Expr {
 	return expr
 }
 
-// unary → ( "!" | "-" ) unary | call ;
+// unary → ( "!" | "-" | "~" ) unary | ( "++" | "--" ) unary | "await" unary | "spawn" call | power ;
 func (p *Parser) unary() Expr {
-	if p.match(BANG, MINUS) {
+	if p.match(BANG, MINUS, TILDE) {
 		operator := p.previous()
 		right := p.unary()
 		return UnaryExpr{operator: operator, right: right}
 	}
+	if p.match(PLUS_PLUS, MINUS_MINUS) {
+		operator := p.previous()
+		target := p.unary()
+		return p.update(operator, target, true)
+	}
+	if p.match(AWAIT) {
+		keyword := p.previous()
+		return AwaitExpr{keyword: keyword, value: p.unary()}
+	}
+	if p.match(SPAWN) {
+		keyword := p.previous()
+		call, ok := p.call().(CallExpr)
+		if !ok {
+			p.error(&ParseError{token: keyword, code: E_SYNTAX, msg: "Expect a call after 'spawn'."})
+		}
+		return SpawnExpr{keyword: keyword, call: call}
+	}
+
+	return p.power()
+}
+
+// power → postfix ( "**" unary )? ; (right associative, and -2 ** 2 is -(2 ** 2))
+func (p *Parser) power() Expr {
+	expr := p.postfix()
+
+	if p.match(STAR_STAR) {
+		operator := p.previous()
+		right := p.unary()
+		expr = BinaryExpr{left: expr, operator: operator, right: right}
+	}
 
-	return p.call()
+	return expr
 }
 
-//call → primary ( "(" arguments? ")" | "." IDENTIFIER )* ;
+// postfix → call ( "++" | "--" )? ;
+func (p *Parser) postfix() Expr {
+	expr := p.call()
+
+	if p.match(PLUS_PLUS, MINUS_MINUS) {
+		return p.update(p.previous(), expr, false)
+	}
+
+	return expr
+}
+
+// ++ and -- need something they can assign back to
+func (p *Parser) update(operator Token, target Expr, prefix bool) Expr {
+	switch target.(type) {
+	case VariableExpr, GetExpr, IndexExpr:
+		return UpdateExpr{target: target, operator: operator, prefix: prefix}
+	}
+	p.error(&ParseError{token: operator, code: E_INVALID_TARGET, msg: fmt.Sprintf("Invalid '%s' target.", operator.lexeme)})
+	return nil
+}
+
+//call → primary ( "(" arguments? ")" | ( "." | "?." ) IDENTIFIER | "[" expression "]" )* ;
 func (p *Parser) call() Expr {
 	expr := p.primary()
+	optional := false
 
 	for {
 		if p.match(LEFT_PAREN) {
@@ -175,44 +308,83 @@ func (p *Parser) call() Expr {
 		} else if p.match(DOT) {
 			name := p.consume(IDENTIFIER, "Expect property name after '.'.")
 			expr = GetExpr{object: expr, name: name}
+		} else if p.match(QUESTION_DOT) {
+			name := p.consume(IDENTIFIER, "Expect property name after '?.'.")
+			expr = GetExpr{object: expr, name: name, optional: true}
+			optional = true
+		} else if p.match(LEFT_BRACKET) {
+			index := p.expression()
+			bracket := p.consume(RIGHT_BRACKET, "Expect ']' after index.")
+			expr = IndexExpr{object: expr, bracket: bracket, index: index}
 		} else {
 			break
 		}
 	}
 
+	//a nil found by any ?. makes the whole chain nil
+	if optional {
+		return OptionalChainExpr{expression: expr}
+	}
 	return expr
 }
 
 //Basically the argument part of the grammar
-//argument → expression ( "," expression )* ;
+//arguments → argument ( "," argument )* ;
+//argument → "..." expression | IDENTIFIER ":" expression | expression ; (named ones go last)
 func (p *Parser) finishCall(callee Expr) Expr {
 	var arguments []Expr
+	var spreads, names []Token
+	sawName := false
 	if !p.check(RIGHT_PAREN) {
 		for {
 			//do
 			if (len(arguments) >= 255) {
-				p.error(&ParseError{token: p.peek(), msg: "Can't have more than 255 arguments."})
+				p.error(&ParseError{token: p.peek(), code: E_TOO_MANY, msg: "Can't have more than 255 arguments."})
+			}
+			var spread, name Token
+			if p.check(IDENTIFIER) && p.tokens[p.cur+1].kind == COLON {
+				name = p.advance()
+				p.advance()
+				sawName = true
+			} else if sawName {
+				p.error(&ParseError{token: p.peek(), code: E_SYNTAX, msg: "Named arguments must come after the others."})
+			} else if p.match(ELLIPSIS) {
+				spread = p.previous()
 			}
 			arguments = append(arguments, p.expression())
+			spreads = append(spreads, spread)
+			names = append(names, name)
 			//while
 			if !p.match(COMMA) {break}
 		}
 	}
 
 	paren := p.consume(RIGHT_PAREN, "Expect ')' after arguments.")
-	return CallExpr{callee: callee, paren: paren, arguments: arguments}
+	call := CallExpr{callee: callee, paren: paren, arguments: arguments}
+	for i := range arguments {
+		if spreads[i].kind == ELLIPSIS || names[i].kind == IDENTIFIER {
+			call.spreads, call.names = spreads, names
+			break
+		}
+	}
+	return call
 }
 
 // primary → "true" | "false" | "nil" | "this"
-//			| NUMBER | STRING | IDENTIFIER | "(" expression ")"
-//			| "super" "." IDENTIFIER ;
+//			| NUMBER | STRING | interpolation | IDENTIFIER | "(" expression ")"
+//			| "[" ( expression ( "," expression )* ","? )? "]"
+//			| "{" ( entry ( "," entry )* ","? )? "}" | "super" "." IDENTIFIER ;
+// entry → expression ":" expression ;
 func (p *Parser) primary() Expr {
-	if p.match(FALSE) {return LiteralExpr{value: false}}
-	if p.match(TRUE) {return LiteralExpr{value: true}}
-	if p.match(NIL) {return LiteralExpr{value: nil}}
+	if p.match(FALSE) {return LiteralExpr{value: false, token: p.previous()}}
+	if p.match(TRUE) {return LiteralExpr{value: true, token: p.previous()}}
+	if p.match(NIL) {return LiteralExpr{value: nil, token: p.previous()}}
 
 	if p.match(NUMBER, STRING) {
-		return LiteralExpr{value: p.previous().literal}
+		return LiteralExpr{value: p.previous().literal, token: p.previous()}
+	}
+	if p.match(INTERPOLATION) {
+		return p.interpolation()
 	}
 	if p.match(SUPER) {
 		keyword := p.previous()
@@ -227,21 +399,47 @@ func (p *Parser) primary() Expr {
 		return VariableExpr{name: p.previous()}
 	}
 	if p.match(LEFT_PAREN) {
+		paren := p.previous()
 		expr := p.expression()
 		p.consume(RIGHT_PAREN, "Expect ')' after expression.")
-		return GroupingExpr{expression: expr}
+		return GroupingExpr{paren: paren, expression: expr}
+	}
+	if p.match(LEFT_BRACKET) {
+		return p.list()
+	}
+	if p.match(LEFT_BRACE) {
+		return p.mapLiteral()
 	}
 
 	//throws a parse error
-	p.error(&ParseError{token: p.peek(), msg: "Error: expected an expression"})
+	p.error(&ParseError{token: p.peek(), code: E_EXPECTED_EXPR, msg: "Expect expression."})
 	return nil
 }
 
+// interpolation → INTERPOLATION expression ( INTERPOLATION expression )* INTERPOLATION_END ;
+// (the scanner ends each INTERPOLATION at a "${" and starts the next piece at its "}")
+func (p *Parser) interpolation() Expr {
+	segments := []Token{p.previous()}
+	var exprs []Expr
+	for {
+		exprs = append(exprs, p.expression())
+		if !p.match(INTERPOLATION) {
+			break
+		}
+		segments = append(segments, p.previous())
+	}
+	segments = append(segments, p.consume(INTERPOLATION_END, "Expect '}' after interpolated expression."))
+	return InterpolationExpr{segments: segments, exprs: exprs}
+}
+
 // declaration → classDecl | funDecl | varDecl | statement ;
 func (p *Parser) declaration() Stmt {
 	defer func() {
 		//only goes here if theres a parse error
 		if err := recover(); err != nil {
+			if _, isParseError := err.(*ParseError); !isParseError {
+				panic(err) //a bug in the parser, not the script
+			}
 			p.hadError = true
 			p.synchronize()
 		}
@@ -254,8 +452,10 @@ func (p *Parser) declaration() Stmt {
 	return p.statement()
 }
 
-//classDecl → "class" IDENTIFIER ("<" IDENTIFIER)? "{" function* "}" ;
+//classDecl → "class" IDENTIFIER ("<" IDENTIFIER)? ("with" IDENTIFIER ("," IDENTIFIER)*)? "{" (varDecl | method)* "}" ;
+//("with" isn't reserved, it only means something here)
 func (p *Parser) classDeclaration() Stmt {
+	doc := docComment(p.previous())
 	name := p.consume(IDENTIFIER, "Expect class name.")
 
 	var super *VariableExpr
@@ -264,46 +464,110 @@ func (p *Parser) classDeclaration() Stmt {
 		super = &VariableExpr{name: p.previous()}
 	}
 
+	var traits []VariableExpr
+	if p.check(IDENTIFIER) && p.peek().lexeme == "with" {
+		p.advance()
+		for {
+			traits = append(traits, VariableExpr{name: p.consume(IDENTIFIER, "Expect trait name.")})
+			if !p.match(COMMA) {break}
+		}
+	}
+
 	p.consume(LEFT_BRACE, "Expect '{' before class body.")
 
 	var methods []FunctionStmt
+	var fields []VarStmt
 	for (!p.check(RIGHT_BRACE) && !p.isAtEnd()) {
-		methods = append(methods, p.function("method"))
+		if p.match(VAR) {
+			fields = append(fields, p.varDeclaration().(VarStmt))
+			continue
+		}
+		methods = append(methods, p.method())
 	}
-	p.consume(RIGHT_BRACE, "Expect '}' after class body.")
+	closing := p.consume(RIGHT_BRACE, "Expect '}' after class body.")
 
-	return ClassStmt{name: name, superclass: super, methods: methods}
+	return ClassStmt{name: name, superclass: super, traits: traits, methods: methods, fields: fields, closing: closing, doc: doc}
 }
 
-//function → IDENTIFIER "(" parameters? ")" block ;
+//method → "class"? "set"? function ; ("set" only counts when a name follows it)
+func (p *Parser) method() FunctionStmt {
+	doc := docComment(p.peek())
+	isStatic := p.match(CLASS)
+	isSetter := p.check(IDENTIFIER) && p.peek().lexeme == "set" && p.tokens[p.cur+1].kind == IDENTIFIER
+	if isSetter {p.advance()}
+
+	method := p.function("method")
+	if method.doc == "" {method.doc = doc}
+	method.isStatic = isStatic
+	method.isSetter = isSetter
+	if isSetter && isStatic {
+		p.error(&ParseError{token: method.name, code: E_SYNTAX, msg: "A class method can't be a setter."})
+	}
+	if isSetter && (method.isGetter || len(method.params) != 1 || method.hasRest) {
+		p.error(&ParseError{token: method.name, code: E_SYNTAX, msg: "A setter takes exactly one parameter."})
+	}
+	return method
+}
+
+//function → IDENTIFIER ( "(" parameters? ")" )? block ; (only methods can leave out the parameters)
 func (p *Parser) function(kind string) FunctionStmt {
+	//a function's doc comment sits before "fun", a method's before its name
+	doc := docComment(p.previous())
+	if kind == "method" {
+		doc = docComment(p.peek())
+	}
 	name := p.consume(IDENTIFIER, fmt.Sprintf("Expect %s name.", kind))
-	p.consume(LEFT_PAREN, fmt.Sprintf("Expect '(' after %s name.", kind)) 
 
-	//parse parameters
+	//a method straight into its body is a getter
+	isGetter := kind == "method" && p.check(LEFT_BRACE)
 	var parameters []Token
-	if !p.check(RIGHT_PAREN) {
-		for {
-			//do
-			if (len(parameters) >= 255) {
-				p.error(&ParseError{token: p.peek(), msg: "Can't have more than 255 parameters"})
+	var defaults []Expr
+	sawDefault, hasRest := false, false
+	if !isGetter {
+		p.consume(LEFT_PAREN, fmt.Sprintf("Expect '(' after %s name.", kind)) 
+
+		//parse parameters: name, name = default or (last) ...name
+		if !p.check(RIGHT_PAREN) {
+			for {
+				//do
+				if (len(parameters) >= 255) {
+					p.error(&ParseError{token: p.peek(), code: E_TOO_MANY, msg: "Can't have more than 255 parameters."})
+				}
+
+				hasRest = p.match(ELLIPSIS)
+				parameters = append(parameters, p.consume(IDENTIFIER, "Expect parameter name."))
+				var value Expr
+				if !hasRest && p.match(EQUAL) {
+					value = p.expression()
+					sawDefault = true
+				} else if !hasRest && sawDefault {
+					p.error(&ParseError{token: p.previous(), code: E_SYNTAX, msg: "Parameters with default values must come after the ones without."})
+				}
+				defaults = append(defaults, value)
+				if hasRest && p.check(COMMA) {
+					p.error(&ParseError{token: p.previous(), code: E_SYNTAX, msg: "The rest parameter must be the last one."})
+				}
+				//while
+				if !p.match(COMMA) {break}
 			}
+		} 
+		p.consume(RIGHT_PAREN, "Expect ')' after parameters.")
+	}
+	if !sawDefault {defaults = nil}
 
-			parameters = append(parameters, p.consume(IDENTIFIER, "Expect parameter name."))
-			//while
-			if !p.match(COMMA) {break}
-		}
-	} 
-	p.consume(RIGHT_PAREN, "Expect ')' after parameters.")
-
-	//parse body
+	//parse body (any yield in it makes this a generator)
 	p.consume(LEFT_BRACE, fmt.Sprintf("Expect '{' before %s body.", kind))
+	enclosingYield := p.sawYield
+	p.sawYield = false
 	body := p.block()
-	return FunctionStmt{name: name, params: parameters, body: body}
+	isGenerator := p.sawYield
+	p.sawYield = enclosingYield
+	return FunctionStmt{name: name, params: parameters, defaults: defaults, hasRest: hasRest, body: body, closing: p.previous(), doc: doc, isGenerator: isGenerator, isGetter: isGetter}
 }
 
 //varDecl → "var" IDENTIFIER ( "=" expression )? ";" ;
 func (p *Parser) varDeclaration() Stmt {
+	doc := docComment(p.previous())
 	name := p.consume(IDENTIFIER, "Expect a variable name.")
 
 	var initializer Expr
@@ -314,30 +578,82 @@ func (p *Parser) varDeclaration() Stmt {
 	}
 
 	p.consume(SEMICOLON, "Expect ';' after variable declaration.")
-	return VarStmt{name: name, initializer: initializer}
+	return VarStmt{name: name, initializer: initializer, doc: doc}
 }
 
 
+//The rest of a [a, b, c] literal, which can have a trailing comma
+func (p *Parser) list() Expr {
+	bracket := p.previous()
+	var elements []Expr
+	for !p.check(RIGHT_BRACKET) {
+		elements = append(elements, p.expression())
+		if !p.match(COMMA) {break}
+	}
+	closing := p.consume(RIGHT_BRACKET, "Expect ']' after list elements.")
+	return ListExpr{bracket: bracket, elements: elements, closing: closing}
+}
+
+//The rest of a {key: value} literal (a "{" where a statement can start is a block instead)
+func (p *Parser) mapLiteral() Expr {
+	brace := p.previous()
+	var keys, values []Expr
+	for !p.check(RIGHT_BRACE) {
+		keys = append(keys, p.expression())
+		p.consume(COLON, "Expect ':' after map key.")
+		values = append(values, p.expression())
+		if !p.match(COMMA) {break}
+	}
+	closing := p.consume(RIGHT_BRACE, "Expect '}' after map entries.")
+	return MapExpr{brace: brace, keys: keys, values: values, closing: closing}
+}
+
 /**STATEMENTS**/
 //statement → exprStmt | forStmt | ifStmt | printStmt | returnStmt | whileStmt | block;
 func (p *Parser) statement() Stmt {
 	//check statement type & call correct method
+	if p.match(BREAK) {return p.loopJump(BreakStmt{keyword: p.previous()})}
+	if p.match(CONTINUE) {return p.loopJump(ContinueStmt{keyword: p.previous()})}
 	if p.match(FOR) {return p.forStatement()}
 	if p.match(IF) {return p.ifStatement()}
 	if p.match(PRINT) {return p.printStatement()}
 	if p.match(RETURN) {return p.returnStatement()}
 	if p.match(WHILE) {return p.whileStatement()}
-	if p.match(LEFT_BRACE) {return BlockStmt{statements: p.block()}}
+	if p.match(YIELD) {return p.yieldStatement()}
+	if p.match(LEFT_BRACE) {
+		brace := p.previous()
+		statements := p.block()
+		return BlockStmt{brace: brace, statements: statements, closing: p.previous()}
+	}
 
 	return p.expressionStatement()
 }
 
+//breakStmt → "break" ";" ; continueStmt → "continue" ";" ;
+func (p *Parser) loopJump(stmt Stmt) Stmt {
+	p.consume(SEMICOLON, fmt.Sprintf("Expect ';' after '%s'.", p.previous().lexeme))
+	return stmt
+}
+
 //forStmt → "for" "(" ( varDecl | exprStmt | ";" )
 //			expression? ";"
-//	 		expression? ")" statement ;
+//	 		expression? ")" statement
+//			| "for" "(" "var" IDENTIFIER "in" expression ")" statement ;
 func (p *Parser) forStatement() Stmt {
+	keyword := p.previous()
 	p.consume (LEFT_PAREN, "Expect '(' after 'for'.")
 
+	//for (var x in ...) is told apart by the "in" two tokens on
+	if p.check(VAR) && p.cur+2 < len(p.tokens) && p.tokens[p.cur+2].kind == IN {
+		p.advance()
+		name := p.consume(IDENTIFIER, "Expect variable name.")
+		p.advance() //in
+		iterable := p.expression()
+		p.consume(RIGHT_PAREN, "Expect ')' after for-in clause.")
+		body := p.statement()
+		return ForInStmt{keyword: keyword, name: name, iterable: iterable, body: body}
+	}
+
 	//initializer clause
 	var initializer Stmt
 	if p.match(SEMICOLON) {
@@ -361,12 +677,13 @@ func (p *Parser) forStatement() Stmt {
 	//body
 	body := p.statement()
 
-	return ForStmt{initializer: initializer, condition: condition, increment: increment, body: body}
+	return ForStmt{keyword: keyword, initializer: initializer, condition: condition, increment: increment, body: body}
 }
 
 //ifStmt → "if" "(" expression ")" statement 
 //		( "else" statement )? ;
 func (p *Parser) ifStatement() Stmt {
+	keyword := p.previous()
 	p.consume(LEFT_PAREN, "Expect '(' after 'if'.")
 	condition := p.expression()
 	p.consume(RIGHT_PAREN, "Expect ')' after if condition.")
@@ -377,7 +694,7 @@ func (p *Parser) ifStatement() Stmt {
 		elseBranch = p.statement()
 	}
 
-	return IfStmt{condition: condition, thenBranch: thenBranch, elseBranch: elseBranch}
+	return IfStmt{keyword: keyword, condition: condition, thenBranch: thenBranch, elseBranch: elseBranch}
 }
 
 //exprStmt → expression ";" ;
@@ -401,9 +718,10 @@ func (p *Parser) block() []Stmt {
 
 //printStmt → "print" expression ";" ;
 func (p *Parser) printStatement() Stmt {
+	keyword := p.previous()
 	value := p.expression()
 	p.consume(SEMICOLON, "Expect ';' after value.")
-	return PrintStmt{expression: value}
+	return PrintStmt{keyword: keyword, expression: value}
 }
 
 //returnStmt → "return" expression? ";" ;
@@ -420,15 +738,29 @@ func (p *Parser) returnStatement() Stmt {
 
 //while → "while" "(" expression ")" statement ;
 func (p *Parser) whileStatement() Stmt {
+	keyword := p.previous()
 	p.consume(LEFT_PAREN, "Expect '(' after 'while'.")
 	condition := p.expression()
 	p.consume(RIGHT_PAREN, "Expect ')' after condition.")
 	body := p.statement()
 
-	return WhileStmt{condition: condition, body: body}
+	return WhileStmt{keyword: keyword, condition: condition, body: body}
 }
 
 
+//yieldStmt → "yield" expression? ";" ;
+func (p *Parser) yieldStatement() Stmt {
+	keyword := p.previous()
+	p.sawYield = true
+	var value Expr = nil
+	if !p.check(SEMICOLON) {
+		value = p.expression()
+	}
+
+	p.consume(SEMICOLON, "Expect ';' after yield value.")
+	return YieldStmt{keyword: keyword, value: value}
+}
+
 /**HELPER FUNCTIONS**/
 // Checks if the current token matches any of the given types, then consumes if true
 func (p *Parser) match(types ...TokenType) bool {
@@ -482,14 +814,14 @@ func (p *Parser) consume(tokType TokenType, message string) Token {
 	}
 
 	//creates a new ParseError//
-	p.error(&ParseError{token: p.peek(), msg: message})
+	p.error(&ParseError{token: p.peek(), code: E_SYNTAX, msg: message})
 	return Token{}
 }
 
-// passes the error to the main class
+// records the error for the runner to report, then unwinds to declaration()
 func (p *Parser) error(err *ParseError) {
 	p.hadError = true
-	fmt.Println(err.error())
+	p.diagnostics = append(p.diagnostics, err.diagnostic())
 	panic(err)
 }
 
@@ -504,17 +836,33 @@ func (p *Parser) synchronize() {
 		}
 
 		switch p.peek().kind {
-		case CLASS:
-		case FUN:
-		case VAR:
-		case FOR:
-		case IF:
-		case WHILE:
-		case PRINT:
-		case RETURN:
+		case CLASS, FUN, VAR, FOR, IF, WHILE, PRINT, RETURN, BREAK, CONTINUE, YIELD:
 			return
 		}
 
 		p.advance()
 	}
 }
+
+/**DOC COMMENTS**/
+// Text of the /** */ comment right before a declaration's first token, "" if there isn't one.
+// Leading "*"s on each line are dropped, like Javadoc
+func docComment(first Token) string {
+	comments := first.comments()
+	if len(comments) == 0 {
+		return ""
+	}
+	c := comments[len(comments)-1]
+	if !c.block || c.trailing || !strings.HasPrefix(c.text, "/**") || c.text == "/**/" {
+		return ""
+	}
+
+	text := strings.TrimSuffix(strings.TrimPrefix(c.text, "/**"), "*/")
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		line = strings.TrimSpace(strings.TrimPrefix(line, "*"))
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
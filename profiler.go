@@ -0,0 +1,419 @@
+/*
+* Profiler ("glox --profile=out file.lox"). Attaches to the interpreter as its Tracer and
+* charges the time between one event (statement, call, return) and the next to whatever
+* stack & line were running. Every task keeps its own stack, so tasks taking turns under the
+* GIL never mix their frames with the main program's. Writes folded stacks for flame graphs, a pprof profile and
+* a text summary of call counts and self/cumulative time
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SCRIPT_FRAME = "<script>"
+
+type ProfileFrame struct {
+	name string
+	line int //line the frame is on (for callers, the line of the call)
+}
+
+// Everything charged to one exact stack
+type ProfileSample struct {
+	frames     []ProfileFrame //outermost first
+	nanos      int64
+	statements int64
+}
+
+type Profiler struct {
+	file    string
+	stack   []ProfileFrame                   //the main program's
+	tasks   map[*Interpreter]*[]ProfileFrame //each running task's, outermost being the function it was spawned with
+	running *[]ProfileFrame                  //the stack of whoever sent the last event
+	samples map[string]*ProfileSample        //keyed by stackKey()
+	calls   map[string]int
+	start   time.Time
+	last    time.Time
+}
+
+func newProfiler(file string) *Profiler {
+	now := time.Now()
+	p := &Profiler{file: file, stack: []ProfileFrame{{name: SCRIPT_FRAME}}, tasks: make(map[*Interpreter]*[]ProfileFrame),
+		samples: make(map[string]*ProfileSample), calls: map[string]int{SCRIPT_FRAME: 1}, start: now, last: now}
+	p.running = &p.stack
+	return p
+}
+
+/**TRACER HOOKS**/
+func (p *Profiler) enterStmt(itpr *Interpreter, stmt Stmt) {
+	if _, isBlock := stmt.(BlockStmt); isBlock {
+		return
+	}
+	stack := p.switchTo(itpr)
+	(*stack)[len(*stack)-1].line = stmtLine(stmt)
+	p.sample(*stack).statements++
+}
+
+func (p *Profiler) enterCall(itpr *Interpreter, callee LoxCallable, paren Token) {
+	stack := p.switchTo(itpr)
+	name := callee.calleeName()
+	p.calls[name]++
+	//natives have no lines of their own
+	*stack = append(*stack, ProfileFrame{name: name})
+}
+
+func (p *Profiler) exitCall(itpr *Interpreter, callee LoxCallable) {
+	stack := p.switchTo(itpr)
+	*stack = (*stack)[:len(*stack)-1]
+	if len(*stack) == 0 {
+		delete(p.tasks, itpr) //the task is done
+	}
+}
+
+func (p *Profiler) branch(itpr *Interpreter, at Token, taken bool) {}
+
+// Charges whoever ran up to now, then hands the clock to itpr and gives back its stack
+func (p *Profiler) switchTo(itpr *Interpreter) *[]ProfileFrame {
+	p.charge()
+	p.running = p.stackOf(itpr)
+	return p.running
+}
+
+func (p *Profiler) stackOf(itpr *Interpreter) *[]ProfileFrame {
+	if itpr.task == nil {
+		return &p.stack
+	}
+	stack, exists := p.tasks[itpr]
+	if !exists {
+		stack = &[]ProfileFrame{}
+		p.tasks[itpr] = stack
+	}
+	return stack
+}
+
+// Gives the time since the last event to the stack that was running
+func (p *Profiler) charge() {
+	now := time.Now()
+	if stack := *p.running; len(stack) > 0 { //a task that just finished has nothing left to charge
+		p.sample(stack).nanos += now.Sub(p.last).Nanoseconds()
+	}
+	p.last = now
+}
+
+func (p *Profiler) sample(stack []ProfileFrame) *ProfileSample {
+	key := stackKey(stack)
+	s, exists := p.samples[key]
+	if !exists {
+		s = &ProfileSample{frames: append([]ProfileFrame(nil), stack...)}
+		p.samples[key] = s
+	}
+	return s
+}
+
+func stackKey(frames []ProfileFrame) string {
+	var key strings.Builder
+	for i, f := range frames {
+		if i > 0 {
+			key.WriteByte(';')
+		}
+		key.WriteString(f.name)
+		key.WriteByte(':')
+		key.WriteString(strconv.Itoa(f.line))
+	}
+	return key.String()
+}
+
+// Charges the tail end of the run; call once the program is done
+func (p *Profiler) finish() {
+	p.charge()
+}
+
+// Samples in a fixed order so every output is stable
+func (p *Profiler) sortedSamples() []*ProfileSample {
+	keys := make([]string, 0, len(p.samples))
+	for key := range p.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	samples := make([]*ProfileSample, len(keys))
+	for i, key := range keys {
+		samples[i] = p.samples[key]
+	}
+	return samples
+}
+
+/**FOLDED STACKS**/
+// One "outer;inner;leaf microseconds" line per stack, the input flamegraph.pl & friends take
+func (p *Profiler) writeFolded(w io.Writer) {
+	totals := make(map[string]int64)
+	var order []string
+	for _, s := range p.sortedSamples() {
+		names := make([]string, len(s.frames))
+		for i, f := range s.frames {
+			names[i] = f.name
+		}
+		key := strings.Join(names, ";")
+		if _, seen := totals[key]; !seen {
+			order = append(order, key)
+		}
+		totals[key] += s.nanos / 1000
+	}
+	for _, key := range order {
+		fmt.Fprintf(w, "%s %d\n", key, totals[key])
+	}
+}
+
+/**SUMMARY**/
+type ProfileEntry struct {
+	name       string
+	calls      int
+	self       int64
+	cumulative int64
+	statements int64
+}
+
+// Per-function self & cumulative time (recursive frames only count once towards cumulative)
+func (p *Profiler) functions() []*ProfileEntry {
+	entries := make(map[string]*ProfileEntry)
+	entry := func(name string) *ProfileEntry {
+		if entries[name] == nil {
+			entries[name] = &ProfileEntry{name: name, calls: p.calls[name]}
+		}
+		return entries[name]
+	}
+	for _, s := range p.samples {
+		leaf := entry(s.frames[len(s.frames)-1].name)
+		leaf.self += s.nanos
+		leaf.statements += s.statements
+		seen := make(map[string]bool)
+		for _, f := range s.frames {
+			if !seen[f.name] {
+				seen[f.name] = true
+				entry(f.name).cumulative += s.nanos
+			}
+		}
+	}
+
+	list := make([]*ProfileEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].self != list[j].self {
+			return list[i].self > list[j].self
+		}
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+// Self time per source line, across every stack
+func (p *Profiler) lines() []*ProfileEntry {
+	entries := make(map[int]*ProfileEntry)
+	for _, s := range p.samples {
+		line := s.frames[len(s.frames)-1].line
+		if line == 0 {
+			continue //inside a native
+		}
+		if entries[line] == nil {
+			entries[line] = &ProfileEntry{name: fmt.Sprintf("%s:%d", p.file, line)}
+		}
+		entries[line].self += s.nanos
+		entries[line].statements += s.statements
+	}
+
+	list := make([]*ProfileEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].self != list[j].self {
+			return list[i].self > list[j].self
+		}
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+func (p *Profiler) writeSummary(w io.Writer) {
+	total := p.last.Sub(p.start)
+	fmt.Fprintf(w, "Profile of %s: %v total\n\n", p.file, total.Round(time.Microsecond))
+
+	fmt.Fprintf(w, "%-24s %8s %12s %7s %12s %7s\n", "function", "calls", "self", "self%", "cumulative", "cum%")
+	for _, e := range p.functions() {
+		fmt.Fprintf(w, "%-24s %8d %12v %6.1f%% %12v %6.1f%%\n", e.name, e.calls, roundNanos(e.self), percent(e.self, total),
+			roundNanos(e.cumulative), percent(e.cumulative, total))
+	}
+
+	fmt.Fprintf(w, "\n%-24s %8s %12s %7s\n", "line", "stmts", "self", "self%")
+	for i, e := range p.lines() {
+		if i == 20 {
+			break //the top of the list is what matters
+		}
+		fmt.Fprintf(w, "%-24s %8d %12v %6.1f%%\n", e.name, e.statements, roundNanos(e.self), percent(e.self, total))
+	}
+}
+
+func roundNanos(nanos int64) time.Duration {
+	return time.Duration(nanos).Round(time.Microsecond)
+}
+
+func percent(nanos int64, total time.Duration) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return 100 * float64(nanos) / float64(total.Nanoseconds())
+}
+
+/**PPROF**/
+// Writes a gzipped profile.proto (github.com/google/pprof/proto/profile.proto) by hand,
+// with two sample values per stack: statements executed and nanoseconds spent
+func (p *Profiler) writePprof(w io.Writer) error {
+	var strs []string
+	index := make(map[string]int64)
+	str := func(s string) int64 {
+		if i, exists := index[s]; exists {
+			return i
+		}
+		index[s] = int64(len(strs))
+		strs = append(strs, s)
+		return index[s]
+	}
+	str("")
+
+	var profile protoBuffer
+	valueType := func(field int, kind string, unit string) {
+		var vt protoBuffer
+		vt.varintField(1, uint64(str(kind)))
+		vt.varintField(2, uint64(str(unit)))
+		profile.bytesField(field, vt.Bytes())
+	}
+	valueType(1, "statements", "count")
+	valueType(1, "time", "nanoseconds")
+
+	functions := make(map[string]uint64)
+	locations := make(map[ProfileFrame]uint64)
+	var functionMsgs, locationMsgs [][]byte
+	location := func(f ProfileFrame) uint64 {
+		if id, exists := locations[f]; exists {
+			return id
+		}
+		fnID, exists := functions[f.name]
+		if !exists {
+			fnID = uint64(len(functions) + 1)
+			functions[f.name] = fnID
+			var fn protoBuffer
+			fn.varintField(1, fnID)
+			//pprof strips <...> from names like C++ templates, so <script> would come out blank
+			name := strings.Trim(f.name, "<>")
+			fn.varintField(2, uint64(str(name)))
+			fn.varintField(3, uint64(str(name)))
+			fn.varintField(4, uint64(str(p.file)))
+			functionMsgs = append(functionMsgs, fn.Bytes())
+		}
+
+		id := uint64(len(locations) + 1)
+		locations[f] = id
+		var line, loc protoBuffer
+		line.varintField(1, fnID)
+		line.varintField(2, uint64(f.line))
+		loc.varintField(1, id)
+		loc.bytesField(4, line.Bytes())
+		locationMsgs = append(locationMsgs, loc.Bytes())
+		return id
+	}
+
+	for _, s := range p.sortedSamples() {
+		var ids, values protoBuffer
+		for i := len(s.frames) - 1; i >= 0; i-- { //leaf first
+			ids.varint(location(s.frames[i]))
+		}
+		values.varint(uint64(s.statements))
+		values.varint(uint64(s.nanos))
+
+		var sample protoBuffer
+		sample.bytesField(1, ids.Bytes())
+		sample.bytesField(2, values.Bytes())
+		profile.bytesField(2, sample.Bytes())
+	}
+	for _, loc := range locationMsgs {
+		profile.bytesField(4, loc)
+	}
+	for _, fn := range functionMsgs {
+		profile.bytesField(5, fn)
+	}
+	for _, s := range strs {
+		profile.bytesField(6, []byte(s))
+	}
+	profile.varintField(9, uint64(p.start.UnixNano()))
+	profile.varintField(10, uint64(p.last.Sub(p.start).Nanoseconds()))
+	//every string used here is already in the table from the sample types
+	valueType(11, "time", "nanoseconds")
+	profile.varintField(12, 1)
+
+	zipped := gzip.NewWriter(w)
+	if _, err := zipped.Write(profile.Bytes()); err != nil {
+		return err
+	}
+	return zipped.Close()
+}
+
+// Just enough protobuf encoding for the profile: varints & length-delimited fields
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	b.WriteByte(byte(v))
+}
+
+func (b *protoBuffer) varintField(field int, v uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(v)
+}
+
+func (b *protoBuffer) bytesField(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+/**OUTPUT FILES**/
+// out.folded, out.pb.gz and the summary (on summary)
+func (p *Profiler) save(out string, summary io.Writer) error {
+	p.finish()
+
+	folded, err := os.Create(out + ".folded")
+	if err != nil {
+		return err
+	}
+	p.writeFolded(folded)
+	folded.Close()
+
+	pprof, err := os.Create(out + ".pb.gz")
+	if err != nil {
+		return err
+	}
+	defer pprof.Close()
+	if err := p.writePprof(pprof); err != nil {
+		return err
+	}
+
+	p.writeSummary(summary)
+	fmt.Fprintf(summary, "\nWrote %s.folded (flame graph stacks) and %s.pb.gz (go tool pprof)\n", out, out)
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+* Prepared programs: source scanned, parsed and resolved once, then run as many times as
+* needed, on as many Interpreters as needed, at the same time if need be.
+*
+* The contract for hosts running Lox from several goroutines:
+*   - a Program never changes after prepare, so any number of goroutines can share one
+*   - an Interpreter (with the tasks it spawns) is driven by one goroutine at a time, and two
+*     Interpreters share nothing, so each goroutine can safely run its own
+*   - values (functions, instances, lists...) belong to the Interpreter that made them and
+*     shouldn't be handed to another one
+*   - package level tables (keywords, escapes, compoundOperators, operatorMethods,
+*     reflectionNatives) are only ever read, and the scans counter is only touched atomically
+* Created: 10/19
+ */
+
+package main
+
+type Program struct {
+	statements  []Stmt
+	locals      map[Token]int //the resolver's output, copied into each Interpreter that runs it
+	diagnostics []Diagnostic  //scan, parse and resolve errors
+	hadError    bool
+}
+
+// Scans, parses and resolves source, stopping after the first stage with errors
+func prepare(source string) *Program {
+	scanner := newScanner(source)
+	parser := newParser(scanner.scanTokens())
+	program := &Program{statements: parser.parse()}
+	program.diagnostics = append(scanner.diagnostics, parser.diagnostics...)
+	if scanner.hadError || parser.hadError {
+		program.hadError = true
+		return program
+	}
+
+	//the resolver hands what it finds to an Interpreter, so give it one just to hold them
+	holder := &Interpreter{locals: make(map[Token]int)}
+	resolver := newResolver(holder)
+	resolver.resolveStmts(program.statements)
+	program.locals = holder.locals
+	program.diagnostics = append(program.diagnostics, resolver.diagnostics...)
+	program.hadError = resolver.hadError
+	return program
+}
+
+// Runs the program on itpr and returns the runtime errors it raised. A program with errors
+// doesn't run; its errors from prepare come back instead
+func (p *Program) run(itpr *Interpreter) []Diagnostic {
+	if p.hadError {
+		return p.diagnostics
+	}
+
+	//tasks from earlier runs on itpr may still be reading its locals
+	itpr.acquire()
+	for name, depth := range p.locals {
+		itpr.resolve(name, depth)
+	}
+	itpr.release()
+
+	itpr.interpret(p.statements)
+	diagnostics := itpr.diagnostics
+	itpr.diagnostics = nil
+	return diagnostics
+}
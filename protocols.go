@@ -0,0 +1,111 @@
+/*
+* Protocol methods: a class can take part in operators and built-ins by defining methods
+* with double underscore names. a + b calls a.__add__(b) (the left operand decides, though
+* a comparison the left side can't do is tried reflected: a > b as b.__lt__(a)), == and
+* != use __eq__, print and interpolation use __str__, len() uses __len__, obj[i] uses
+* __getitem__, obj(args) uses __call__ and map keys use __hash__ with __eq__
+* Created: 10/19
+ */
+
+package main
+
+// The method each overloadable binary operator calls on its left operand
+var operatorMethods = map[TokenType]string{
+	PLUS: "__add__", MINUS: "__sub__", STAR: "__mul__", SLASH: "__div__", PERCENT: "__mod__",
+	LESS: "__lt__", LESS_EQUAL: "__le__", GREATER: "__gt__", GREATER_EQUAL: "__ge__",
+}
+
+// The instance's protocol method bound to it, if value is an instance whose class has one
+func protocolMethod(value interface{}, name string) (LoxFunction, bool) {
+	inst, ok := value.(*LoxInstance)
+	if !ok {
+		return LoxFunction{}, false
+	}
+	method := inst.class.findMethod(name)
+	if method == nil {
+		return LoxFunction{}, false
+	}
+	return method.bind(inst), true
+}
+
+// The comparison that asks the same question from the right operand's side
+var reflectedMethods = map[string]string{
+	"__lt__": "__gt__", "__gt__": "__lt__", "__le__": "__ge__", "__ge__": "__le__",
+}
+
+// left op right through left's operator method, or for comparisons right's reflected one;
+// handled is false when neither side has one
+func (itpr *Interpreter) overloadedBinary(operator Token, left interface{}, right interface{}) (result interface{}, handled bool) {
+	name, overloadable := operatorMethods[operator.kind]
+	if !overloadable {
+		return nil, false
+	}
+	if method, ok := protocolMethod(left, name); ok {
+		return itpr.call(method, []interface{}{right}, operator), true
+	}
+	reflected, comparison := reflectedMethods[name]
+	if method, ok := protocolMethod(right, reflected); comparison && ok {
+		return itpr.call(method, []interface{}{left}, operator), true
+	}
+	return nil, false
+}
+
+// l == r through whichever side has __eq__, the left one first
+func (itpr *Interpreter) overloadedEqual(at Token, l interface{}, r interface{}) (equal bool, handled bool) {
+	if method, ok := protocolMethod(l, "__eq__"); ok {
+		return itpr.isTruthy(itpr.call(method, []interface{}{r}, at)), true
+	}
+	if method, ok := protocolMethod(r, "__eq__"); ok {
+		return itpr.isTruthy(itpr.call(method, []interface{}{l}, at)), true
+	}
+	return false, false
+}
+
+// What __str__ returns; errors about the call itself point at the method's name, since
+// print and interpolation have no call site of their own
+func (itpr *Interpreter) overloadedString(object interface{}) (string, bool) {
+	method, ok := protocolMethod(object, "__str__")
+	if !ok {
+		return "", false
+	}
+	at := method.declaration.name
+	str, isString := itpr.call(method, nil, at).(string)
+	if !isString {
+		itpr.error(&RuntimeError{token: at, code: E_TYPE, msg: "__str__ must return a string."})
+	}
+	return str, true
+}
+
+// Map keys made from __hash__, kept apart from plain values equal to the hash
+type instanceHash struct {
+	hash interface{}
+}
+
+// The key an instance with __hash__ is stored under. Instances with equal hashes share it,
+// and the map tells them apart with __eq__
+func (itpr *Interpreter) overloadedHash(at Token, key interface{}) (interface{}, bool) {
+	method, ok := protocolMethod(key, "__hash__")
+	if !ok {
+		return nil, false
+	}
+	hash := itpr.call(method, nil, at)
+	switch hash.(type) {
+	case nil, bool, string, int64, float64:
+		return instanceHash{hash: itpr.hashKey(at, hash)}, true
+	}
+	itpr.error(&RuntimeError{token: at, code: E_TYPE, msg: "__hash__ must return a number, string, boolean or nil."})
+	return nil, false
+}
+
+// len(obj) through __len__, which has to give back a whole number that isn't negative
+func (itpr *Interpreter) overloadedLength(at Token, object interface{}) (int64, bool) {
+	method, ok := protocolMethod(object, "__len__")
+	if !ok {
+		return 0, false
+	}
+	n, whole := toInt(itpr.call(method, nil, at))
+	if !whole || n < 0 {
+		itpr.error(&RuntimeError{token: at, code: E_TYPE, msg: "__len__ must return a whole number of 0 or more."})
+	}
+	return n, true
+}
@@ -0,0 +1,180 @@
+/*
+* Reflection natives, for asking at runtime what a value is: type(x), classOf(inst),
+* className(cls), superclassOf(cls), methods(cls), fields(inst), hasField(inst, name),
+* getField(inst, name), setField(inst, name, value), isInstance(x, cls), arity(fn) and
+* maxArity(fn).
+* Enough to write serializers and test helpers in Lox itself
+* Created: 10/19
+ */
+
+package main
+
+import "sort"
+
+// Defined as globals by newInterpreter; none of them keep any state
+var reflectionNatives = []*nativeMethod{
+	{name: "type", params: 1, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		return typeName(args[0])
+	}},
+	{name: "classOf", params: 1, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		return itpr.instanceArg(args[0], "classOf needs an instance.").class
+	}},
+	{name: "className", params: 1, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		return itpr.classArg(args[0], "className needs a class.").name
+	}},
+	{name: "superclassOf", params: 1, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		class := itpr.classArg(args[0], "superclassOf needs a class.")
+		if class.superclass == nil {
+			return nil
+		}
+		return *class.superclass
+	}},
+	//instance methods (getters too) the class declares or inherits, in alphabetical order
+	{name: "methods", params: 1, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		class := itpr.classArg(args[0], "methods needs a class.")
+		seen := make(map[string]bool)
+		for _, c := range append([]*LoxClass{&class}, class.ancestors...) {
+			for name := range c.methods {
+				seen[name] = true
+			}
+		}
+		return sortedNames(seen)
+	}},
+	{name: "fields", params: 1, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		inst := itpr.instanceArg(args[0], "fields needs an instance.")
+		seen := make(map[string]bool)
+		for name := range inst.fields {
+			seen[name] = true
+		}
+		return sortedNames(seen)
+	}},
+	//only fields count, not methods
+	{name: "hasField", params: 2, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		inst, name := itpr.fieldArgs(args, "hasField needs an instance and a field name.")
+		_, exists := inst.fields[name.lexeme]
+		return exists
+	}},
+	//like inst.name, so methods come back bound and getters run
+	{name: "getField", params: 2, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		inst, name := itpr.fieldArgs(args, "getField needs an instance and a field name.")
+		return itpr.property(inst, name)
+	}},
+	//like inst.name = value, so setters run
+	{name: "setField", params: 3, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		inst, name := itpr.fieldArgs(args, "setField needs an instance and a field name.")
+		itpr.setProperty(inst, name, args[2])
+		return args[2]
+	}},
+	//true when the value's class is cls or inherits from it (through a superclass or a trait)
+	{name: "isInstance", params: 2, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		class := itpr.classArg(args[1], "isInstance needs a value and a class.")
+		inst, ok := args[0].(*LoxInstance)
+		if !ok {
+			return false
+		}
+		for _, c := range append([]*LoxClass{&inst.class}, inst.class.ancestors...) {
+			if sameClass(*c, class) {
+				return true
+			}
+		}
+		return false
+	}},
+	//the fewest arguments, leaving out parameters with defaults and ...rest
+	{name: "arity", params: 1, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		min, _ := arityRange(itpr.callableArg(args[0], "arity needs a function or class."))
+		return int64(min)
+	}},
+	//the most arguments, or nil when a ...rest parameter takes any number
+	{name: "maxArity", params: 1, fn: func(itpr *Interpreter, args []interface{}) interface{} {
+		_, max := arityRange(itpr.callableArg(args[0], "maxArity needs a function or class."))
+		if max < 0 {
+			return nil
+		}
+		return int64(max)
+	}},
+}
+
+// What type(x) calls a value
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case int64, float64:
+		return "number"
+	case string:
+		return "string"
+	case *LoxList:
+		return "list"
+	case *LoxMap:
+		return "map"
+	case LoxRange:
+		return "range"
+	case LoxClass:
+		return "class"
+	case *LoxInstance:
+		return "instance"
+	case *LoxGenerator:
+		return "generator"
+	case *LoxTask:
+		return "task"
+	case *LoxChannel:
+		return "channel"
+	case LoxCallable:
+		return "function"
+	}
+	return "unknown"
+}
+
+func (itpr *Interpreter) instanceArg(value interface{}, msg string) *LoxInstance {
+	inst, ok := value.(*LoxInstance)
+	if !ok {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: msg})
+	}
+	return inst
+}
+
+// A function, class or instance with __call__, as what calling it would run
+func (itpr *Interpreter) callableArg(value interface{}, msg string) LoxCallable {
+	if method, ok := protocolMethod(value, "__call__"); ok {
+		value = method
+	}
+	function, ok := value.(LoxCallable)
+	if !ok {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: msg})
+	}
+	return function
+}
+
+func (itpr *Interpreter) classArg(value interface{}, msg string) LoxClass {
+	class, ok := value.(LoxClass)
+	if !ok {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: msg})
+	}
+	return class
+}
+
+// An instance and a property name, the name as a token at the call site for errors
+func (itpr *Interpreter) fieldArgs(args []interface{}, msg string) (*LoxInstance, Token) {
+	inst := itpr.instanceArg(args[0], msg)
+	name, ok := args[1].(string)
+	if !ok {
+		itpr.error(&RuntimeError{token: itpr.callSite, code: E_TYPE, msg: msg})
+	}
+	at := itpr.callSite
+	return inst, Token{kind: IDENTIFIER, lexeme: name, line: at.line, column: at.column}
+}
+
+func sortedNames(names map[string]bool) *LoxList {
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	list := &LoxList{}
+	for _, name := range sorted {
+		list.elements = append(list.elements, name)
+	}
+	return list
+}
@@ -2,14 +2,11 @@
 // * Looks ahead at variable usage to help with scoping.
 // * As of 10/7: issue seems to be that maps aren't initialized properly before adding things
 // * Created: 10/7
+// * Modified: 10/19
 //  */
 
 package main
 
-import (
-	"fmt"
-)
-
 //Go does not have a prebuilt stack structure, so doing it ourselves
 type Stack struct {
 	items []interface{}
@@ -65,7 +62,12 @@ type Resolver struct {
 	scopes Stack
 	curFunction FunctionType
 	curClass ClassType
+	loopDepth int //loops around the code being resolved, inside the current function
+	inGenerator bool //the current function has a yield in it
+	inStatic bool //inside a "class" method, where there's no this
 	hadError bool
+	diagnostics []Diagnostic
+	symbols *SymbolTable //only filled in for tooling, nil when just running code
 }
 
 func newResolver(itpr *Interpreter) *Resolver {
@@ -80,6 +82,20 @@ func (r *Resolver) visitBlockStmt(stmt BlockStmt) interface{} {
 	return nil
 }
 
+func (r *Resolver) visitBreakStmt(stmt BreakStmt) interface{} {
+	if r.loopDepth == 0 {
+		r.error(stmt.keyword, E_BAD_LOOP_JUMP, "Can't use 'break' outside of a loop.")
+	}
+	return nil
+}
+
+func (r *Resolver) visitContinueStmt(stmt ContinueStmt) interface{} {
+	if r.loopDepth == 0 {
+		r.error(stmt.keyword, E_BAD_LOOP_JUMP, "Can't use 'continue' outside of a loop.")
+	}
+	return nil
+}
+
 func (r *Resolver) visitClassStmt(stmt ClassStmt) interface{} {
 	enclosingClass := r.curClass
 	r.curClass = REGCLASS
@@ -87,21 +103,65 @@ func (r *Resolver) visitClassStmt(stmt ClassStmt) interface{} {
 	r.declare(stmt.name)
 	r.define(stmt.name)
 
-	if (stmt.superclass != nil && stmt.name.lexeme == stmt.superclass.name.lexeme) {
-		r.error(stmt.superclass.name, "A class can't inherit from itself.")
+	var class *Symbol
+	if r.symbols != nil {
+		class = &Symbol{name: stmt.name, kind: CLASS_SYMBOL, doc: stmt.doc}
+		if stmt.superclass != nil {
+			class.superclass = stmt.superclass.name.lexeme
+		}
+		for _, trait := range stmt.traits {
+			class.traits = append(class.traits, trait.name.lexeme)
+		}
+		r.symbols.declare(class)
 	}
 
+	//the superclass and traits together
+	bases := stmt.traits
 	if stmt.superclass != nil {
+		bases = append([]VariableExpr{*stmt.superclass}, bases...)
+	}
+	seen := make(map[string]bool)
+	for _, base := range bases {
+		if stmt.name.lexeme == base.name.lexeme {
+			r.error(base.name, E_SELF_INHERIT, "A class can't inherit from itself.")
+		} else if seen[base.name.lexeme] {
+			r.error(base.name, E_DUPLICATE_BASE, "A class can't inherit from '" + base.name.lexeme + "' twice.")
+		}
+		seen[base.name.lexeme] = true
+	}
+
+	if len(bases) > 0 {
 		r.curClass = SUBCLASS
-		r.resolveExpr(stmt.superclass)
+		for _, base := range bases {
+			r.resolveExpr(base)
+		}
 		r.beginScope()
 		r.peekScopes()["super"] = true
 	}
 
+	//class methods aren't bound to an instance, so they sit outside the scope with this
+	enclosingStatic := r.inStatic
+	for _, method := range stmt.methods {
+		if r.symbols != nil {
+			r.symbols.declareMethod(class, &Symbol{name: method.name, kind: METHOD_SYMBOL, params: method.params, required: required(method), rest: method.hasRest, doc: method.doc, modifier: methodModifier(method)})
+		}
+		if method.isStatic {
+			r.inStatic = true
+			r.resolveFunction(method, METHOD)
+		}
+	}
+	r.inStatic = false
+
 	r.beginScope()
 	r.peekScopes()["this"] = true
 
+	for _, field := range stmt.fields {
+		if field.initializer != nil {
+			r.resolveExpr(field.initializer)
+		}
+	}
 	for _, method := range stmt.methods {
+		if method.isStatic {continue}
 		var declaration FunctionType = METHOD
 		if method.name.lexeme == "init" {
 			declaration = INITIALIZER
@@ -110,7 +170,8 @@ func (r *Resolver) visitClassStmt(stmt ClassStmt) interface{} {
 	}
 
 	r.endScope()
-	if stmt.superclass != nil {
+	r.inStatic = enclosingStatic
+	if len(bases) > 0 {
 		r.endScope()
 	}
 
@@ -118,6 +179,25 @@ func (r *Resolver) visitClassStmt(stmt ClassStmt) interface{} {
 	return nil
 }
 
+//How many parameters have to be given, for tooling
+func required(function FunctionStmt) int {
+	min, _ := function.arityRange()
+	return min
+}
+
+//How tooling labels a method that isn't a plain one
+func methodModifier(method FunctionStmt) string {
+	switch {
+	case method.isStatic:
+		return "class"
+	case method.isGetter:
+		return "get"
+	case method.isSetter:
+		return "set"
+	}
+	return ""
+}
+
 func (r *Resolver) visitExpressionStmt(stmt ExpressionStmt) interface{} {
 	r.resolveExpr(stmt.expression)
 	return nil
@@ -133,14 +213,32 @@ func (r *Resolver) visitForStmt(stmt ForStmt) interface{} {
 	if stmt.increment != nil {
 		r.resolveExpr(stmt.increment)
 	}
-	r.resolveStmt(stmt.body)
+	r.loopBody(stmt.body)
 	
 	return nil
 }
 
+func (r *Resolver) visitForInStmt(stmt ForInStmt) interface{} {
+	r.resolveExpr(stmt.iterable)
+
+	//the loop variable gets its own scope, a fresh one each time around at runtime
+	r.beginScope()
+	r.declare(stmt.name)
+	r.define(stmt.name)
+	if r.symbols != nil {
+		r.symbols.declare(&Symbol{name: stmt.name, kind: VAR_SYMBOL})
+	}
+	r.loopBody(stmt.body)
+	r.endScope()
+	return nil
+}
+
 func (r *Resolver) visitFunctionStmt(stmt FunctionStmt) interface{} {
 	r.declare(stmt.name)
 	r.define(stmt.name)
+	if r.symbols != nil {
+		r.symbols.declare(&Symbol{name: stmt.name, kind: FUNCTION_SYMBOL, params: stmt.params, required: required(stmt), rest: stmt.hasRest, doc: stmt.doc})
+	}
 
 	r.resolveFunction(stmt, FUNCTION)
 	return nil
@@ -162,36 +260,54 @@ func (r *Resolver) visitPrintStmt(stmt PrintStmt) interface{} {
 
 func (r *Resolver) visitReturnStmt(stmt ReturnStmt) interface{} {
 	if (r.curFunction == NOFUNC) {
-		r.error(stmt.keyword, "Can't return from top-level code.")
+		r.error(stmt.keyword, E_BAD_RETURN, "Can't return from top-level code.")
 	}
 
 	if (stmt.value != nil) {
 		if r.curFunction == INITIALIZER {
-			r.error(stmt.keyword, "Can't return a value from an initializer.")
+			r.error(stmt.keyword, E_BAD_RETURN, "Can't return a value from an initializer.")
+		} else if r.inGenerator {
+			r.error(stmt.keyword, E_BAD_RETURN, "Can't return a value from a generator.")
 		}
 		r.resolveExpr(stmt.value)
 	}
 	return nil
 }
 
+func (r *Resolver) visitYieldStmt(stmt YieldStmt) interface{} {
+	if r.curFunction == NOFUNC {
+		r.error(stmt.keyword, E_BAD_RETURN, "Can't yield outside of a function.")
+	} else if r.curFunction == INITIALIZER {
+		r.error(stmt.keyword, E_BAD_RETURN, "Can't yield from an initializer.")
+	}
+
+	if stmt.value != nil {
+		r.resolveExpr(stmt.value)
+	}
+	return nil
+}
+
 func (r *Resolver) visitVarStmt(stmt VarStmt) interface{} {
 	r.declare(stmt.name)
 	if (stmt.initializer != nil) {
 		r.resolveExpr(stmt.initializer)
 	}
 	r.define(stmt.name)
+	if r.symbols != nil {
+		r.symbols.declare(&Symbol{name: stmt.name, kind: VAR_SYMBOL, doc: stmt.doc})
+	}
 	return nil
 }
 
 func (r *Resolver) visitWhileStmt(stmt WhileStmt) interface{} {
 	r.resolveExpr(stmt.condition)
-	r.resolveStmt(stmt.body)
+	r.loopBody(stmt.body)
 	return nil
 }
 
 func (r *Resolver) visitAssignExpr(expr AssignExpr) interface{} {
 	r.resolveExpr(expr.value)
-	r.resolveLocal(expr, expr.name)
+	r.resolveLocal(expr.name)
 	return nil
 }
 
@@ -210,6 +326,13 @@ func (r *Resolver) visitCallExpr(expr CallExpr) interface{} {
 	return nil
 }
 
+func (r *Resolver) visitConditionalExpr(expr ConditionalExpr) interface{} {
+	r.resolveExpr(expr.condition)
+	r.resolveExpr(expr.thenBranch)
+	r.resolveExpr(expr.elseBranch)
+	return nil
+}
+
 func (r *Resolver) visitGetExpr(expr GetExpr) interface{} {
 	r.resolveExpr(expr.object)
 	return nil
@@ -220,6 +343,41 @@ func (r *Resolver) visitGroupingExpr(expr GroupingExpr) interface{} {
 	return nil
 }
 
+func (r *Resolver) visitIndexExpr(expr IndexExpr) interface{} {
+	r.resolveExpr(expr.object)
+	r.resolveExpr(expr.index)
+	return nil
+}
+
+func (r *Resolver) visitIndexSetExpr(expr IndexSetExpr) interface{} {
+	r.resolveExpr(expr.value)
+	r.resolveExpr(expr.object)
+	r.resolveExpr(expr.index)
+	return nil
+}
+
+func (r *Resolver) visitInterpolationExpr(expr InterpolationExpr) interface{} {
+	for _, e := range expr.exprs {
+		r.resolveExpr(e)
+	}
+	return nil
+}
+
+func (r *Resolver) visitListExpr(expr ListExpr) interface{} {
+	for _, element := range expr.elements {
+		r.resolveExpr(element)
+	}
+	return nil
+}
+
+func (r *Resolver) visitMapExpr(expr MapExpr) interface{} {
+	for i, key := range expr.keys {
+		r.resolveExpr(key)
+		r.resolveExpr(expr.values[i])
+	}
+	return nil
+}
+
 func (r *Resolver) visitLiteralExpr(expr LiteralExpr) interface{} {
 	return nil //no vars to resolve
 }
@@ -230,6 +388,11 @@ func (r *Resolver) visitLogicalExpr(expr LogicalExpr) interface{} {
 	return nil
 }
 
+func (r *Resolver) visitOptionalChainExpr(expr OptionalChainExpr) interface{} {
+	r.resolveExpr(expr.expression)
+	return nil
+}
+
 func (r *Resolver) visitSetExpr(expr SetExpr) interface{} {
 	r.resolveExpr(expr.value)
 	r.resolveExpr(expr.object)
@@ -238,22 +401,28 @@ func (r *Resolver) visitSetExpr(expr SetExpr) interface{} {
 
 func (r *Resolver) visitSuperExpr(expr SuperExpr) interface{} {
 	if r.curClass == NOCLASS {
-		r.error(expr.keyword, "Can't use 'super' outside of a class.")
+		r.error(expr.keyword, E_BAD_THIS_SUPER, "Can't use 'super' outside of a class.")
 	} else if r.curClass != SUBCLASS {
-		r.error(expr.keyword, "Can't use 'super' in a class with no superclass")
+		r.error(expr.keyword, E_BAD_THIS_SUPER, "Can't use 'super' in a class with no superclass.")
+	} else if r.inStatic {
+		r.error(expr.keyword, E_BAD_THIS_SUPER, "Can't use 'super' in a class method.")
 	}
 
-	r.resolveLocal(expr, expr.keyword)
+	r.resolveLocal(expr.keyword)
 	return nil
 }
 
 func (r *Resolver) visitThisExpr(expr ThisExpr) interface{} {
 	if r.curClass == NOCLASS {
-		r.error(expr.keyword, "Can't use 'this' outside of a class.")
+		r.error(expr.keyword, E_BAD_THIS_SUPER, "Can't use 'this' outside of a class.")
+		return nil
+	}
+	if r.inStatic {
+		r.error(expr.keyword, E_BAD_THIS_SUPER, "Can't use 'this' in a class method.")
 		return nil
 	}
 
-	r.resolveLocal(expr, expr.keyword)
+	r.resolveLocal(expr.keyword)
 	return nil
 }
 
@@ -262,15 +431,30 @@ func (r *Resolver) visitUnaryExpr(expr UnaryExpr) interface{} {
 	return nil
 }
 
+func (r *Resolver) visitAwaitExpr(expr AwaitExpr) interface{} {
+	r.resolveExpr(expr.value)
+	return nil
+}
+
+func (r *Resolver) visitSpawnExpr(expr SpawnExpr) interface{} {
+	r.resolveExpr(expr.call)
+	return nil
+}
+
+func (r *Resolver) visitUpdateExpr(expr UpdateExpr) interface{} {
+	r.resolveExpr(expr.target)
+	return nil
+}
+
 func (r *Resolver) visitVariableExpr(expr VariableExpr) interface{} {
 	if !r.scopes.isEmpty() {
 		defined, declared := r.peekScopes()[expr.name.lexeme]
 		//if it exists but isn't yet defined, throw an error
 		if (declared && !defined) {
-			r.error(expr.name, "Can't read local variable in its own intiializer")
+			r.error(expr.name, E_SELF_INIT, "Can't read local variable in its own initializer.")
 		}
 	}
-	r.resolveLocal(expr, expr.name)
+	r.resolveLocal(expr.name)
 	return nil
 }
 
@@ -284,6 +468,8 @@ func (r *Resolver) resolveStmts(statements []Stmt) {
 
 //Turn resolver into stmt visitor
 func (r *Resolver) resolveStmt(stmt Stmt) {
+	//tooling resolves code with parse errors, which leaves holes in the tree
+	if stmt == nil {return}
 	stmt.accept(r)
 }
 
@@ -296,19 +482,40 @@ func (r *Resolver) resolveExpr(expr Expr) {
 func (r *Resolver) resolveFunction(fun FunctionStmt, ftype FunctionType) {
 	enclosingFunction := r.curFunction
 	r.curFunction = ftype
+	//a function body can't break out of a loop it's declared in
+	enclosingLoops := r.loopDepth
+	r.loopDepth = 0
+	enclosingGenerator := r.inGenerator
+	r.inGenerator = fun.isGenerator
 
 	r.beginScope()
-	for _, p := range fun.params {
+	for i, p := range fun.params {
+		//a default can use the parameters before it
+		if fun.defaults != nil && fun.defaults[i] != nil {
+			r.resolveExpr(fun.defaults[i])
+		}
 		r.declare(p)
 		r.define(p)
+		if r.symbols != nil {
+			r.symbols.declare(&Symbol{name: p, kind: PARAM_SYMBOL})
+		}
 	}
 	r.resolveStmts(fun.body)
 	r.endScope()
 	r.curFunction = enclosingFunction
+	r.loopDepth = enclosingLoops
+	r.inGenerator = enclosingGenerator
+}
+
+//Resolves a loop's body, where break & continue are allowed
+func (r *Resolver) loopBody(body Stmt) {
+	r.loopDepth++
+	r.resolveStmt(body)
+	r.loopDepth--
 }
 
 //Resolves the given variable
-func (r *Resolver) resolveLocal(expr Expr, name Token) {
+func (r *Resolver) resolveLocal(name Token) {
 	for i := r.scopes.size - 1; i >= 0; i-- {
 		//"contains key"
 		// _, exists := r.scopes.getAt(i).(map[string]bool)[name.lexeme]
@@ -320,10 +527,18 @@ func (r *Resolver) resolveLocal(expr Expr, name Token) {
 		_, exists := s[name.lexeme]
 		if exists {
 			varDepth := r.scopes.size - 1 - i
-			r.interpreter.resolve(expr, varDepth)
+			r.interpreter.resolve(name, varDepth)
+			if r.symbols != nil {
+				r.symbols.reference(name, i)
+			}
 			return
 		}
 	}
+
+	//not local, so it must be a global (or undefined)
+	if r.symbols != nil {
+		r.symbols.referenceGlobal(name)
+	}
 }
 
 /**HELPERS**/
@@ -332,24 +547,26 @@ func (r *Resolver) peekScopes() map[string]bool{
 	return r.scopes.peek().(map[string]bool)
 }
 
-//prints the error messages
-func (r *Resolver) error(token Token, msg string) {
-	var loc string
-	if (token.kind == EOF) {loc = "end"
-	} else {loc = token.lexeme}
-
-	fmt.Printf("[line %d] Resolution Error at \"%s\": %s\n", token.line, loc, msg)
+//records the error for the runner to report (resolution keeps going afterwards)
+func (r *Resolver) error(token Token, code string, msg string) {
+	r.diagnostics = append(r.diagnostics, newDiagnostic(RESOLVE_PHASE, code, token, msg))
 	r.hadError = true
 }
 
 //Creates new block scope
 func (r *Resolver) beginScope() {
 	r.scopes.push(make(map[string]bool))
+	if r.symbols != nil {
+		r.symbols.beginScope()
+	}
 }
 
 //Exits the current scope
 func (r *Resolver) endScope() {
 	r.scopes.pop()
+	if r.symbols != nil {
+		r.symbols.endScope()
+	}
 }
 
 //Adds new var to innermost scope so it takes precendence over those in outer
@@ -362,7 +579,7 @@ func (r *Resolver) declare(name Token) {
 		//don't add if already exists
 		_, exists := s[name.lexeme]
 		if (exists) {
-			r.error(name, "Already a variable with this name in this scope.")
+			r.error(name, E_REDECLARED, "Already a variable with this name in this scope.")
 		}
 		//else
 		s[name.lexeme] = false
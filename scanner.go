@@ -2,46 +2,68 @@
 * Scanner file to scan through a given input file and break
 * down its lexical grammar. Not using Lex!
 * Created: 9/6
-* Modified: 10/2
+* Modified: 10/19
  */
 
 package main
 
 import (
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Scanner struct {
 	source            string
 	tokens            []Token
 	start, curr, line int
+	lineStart         int //offset where the current line begins, for columns
+	startLine         int //line & column of the lexeme being scanned
+	startColumn       int
 	hadError          bool
+	diagnostics       []Diagnostic
+	comments          []Comment //waiting to be attached to the next token
+	interpolations    []int     //one per "${" still open, innermost last: how many { } it has open inside
+	scan              uint64    //stamped on every token, from scans
 }
 
+// Numbers each Scanner, so the resolver's locals (keyed by token) can't mix up two REPL
+// lines or two programs that put a variable at the same line & column
+var scans uint64
+
 // Constructer
 func newScanner(src string) *Scanner {
-	return &Scanner{source: src, start: 0, curr: 0, line: 1, hadError: false}
+	return &Scanner{source: src, start: 0, curr: 0, line: 1, hadError: false, scan: atomic.AddUint64(&scans, 1)}
 }
 
 // Hash Map for reserved words
 var keywords = map[string]TokenType{
-	"and":    AND,
-	"class":  CLASS,
-	"else":   ELSE,
-	"false":  FALSE,
-	"for":    FOR,
-	"fun":    FUN,
-	"if":     IF,
-	"nil":    NIL,
-	"or":     OR,
-	"print":  PRINT,
-	"return": RETURN,
-	"super":  SUPER,
-	"this":   THIS,
-	"true":   TRUE,
-	"var":    VAR,
-	"while":  WHILE,
+	"and":      AND,
+	"break":    BREAK,
+	"class":    CLASS,
+	"continue": CONTINUE,
+	"else":     ELSE,
+	"false":    FALSE,
+	"for":      FOR,
+	"fun":      FUN,
+	"if":       IF,
+	"in":       IN,
+	"nil":      NIL,
+	"or":       OR,
+	"print":    PRINT,
+	"return":   RETURN,
+	"super":    SUPER,
+	"this":     THIS,
+	"true":     TRUE,
+	"var":      VAR,
+	"while":    WHILE,
+	"yield":    YIELD,
+	"spawn":    SPAWN,
+	"await":    AWAIT,
 }
 
 // Scans the tokens in the raw source code string
@@ -50,11 +72,12 @@ func (s *Scanner) scanTokens() []Token {
 	for !s.isAtEnd() {
 		//determine lexeme
 		s.start = s.curr
+		s.startLine, s.startColumn = s.line, s.column(s.curr)
 		s.scanToken()
 	}
 
 	//add null token to list
-	s.tokens = append(s.tokens, Token{kind: EOF, lexeme: "", literal: nil, line: s.line})
+	s.tokens = append(s.tokens, Token{kind: EOF, lexeme: "", literal: nil, line: s.line, column: s.column(s.curr), trivia: s.takeTrivia(), scan: s.scan})
 	return s.tokens
 }
 
@@ -70,21 +93,47 @@ func (s *Scanner) scanToken() {
 	case ')':
 		s.addBasicToken(RIGHT_PAREN)
 	case '{':
+		if open := len(s.interpolations); open > 0 {
+			s.interpolations[open-1]++
+		}
 		s.addBasicToken(LEFT_BRACE)
 	case '}':
+		//the } that closes a "${" carries on with the rest of the string
+		if open := len(s.interpolations); open > 0 {
+			if s.interpolations[open-1] == 0 {
+				s.interpolations = s.interpolations[:open-1]
+				s.addString()
+				return
+			}
+			s.interpolations[open-1]--
+		}
 		s.addBasicToken(RIGHT_BRACE)
 	case ',':
 		s.addBasicToken(COMMA)
 	case '.':
-		s.addBasicToken(DOT)
-	case '-':
-		s.addBasicToken(MINUS)
-	case '+':
-		s.addBasicToken(PLUS)
+		if s.peek() == '.' && s.peekNext() == '.' {
+			s.advance()
+			s.advance()
+			s.addBasicToken(ELLIPSIS)
+		} else {
+			s.addBasicToken(DOT)
+		}
 	case ';':
 		s.addBasicToken(SEMICOLON)
-	case '*':
-		s.addBasicToken(STAR)
+	case '[':
+		s.addBasicToken(LEFT_BRACKET)
+	case ']':
+		s.addBasicToken(RIGHT_BRACKET)
+	case '%':
+		s.addBasicToken(PERCENT)
+	case '&':
+		s.addBasicToken(AMPERSAND)
+	case '|':
+		s.addBasicToken(PIPE)
+	case '^':
+		s.addBasicToken(CARET)
+	case ':':
+		s.addBasicToken(COLON)
 
 	//check for 2 char lexemes
 	case '!':
@@ -104,15 +153,57 @@ func (s *Scanner) scanToken() {
 	case '<':
 		if s.match('=') {
 			s.addBasicToken(LESS_EQUAL)
+		} else if s.match('<') {
+			s.addBasicToken(LESS_LESS)
 		} else {
 			s.addBasicToken(LESS)
 		}
 	case '>':
 		if s.match('=') {
 			s.addBasicToken(GREATER_EQUAL)
+		} else if s.match('>') {
+			s.addBasicToken(GREATER_GREATER)
 		} else {
 			s.addBasicToken(GREATER)
 		}
+	case '?':
+		if s.match('?') {
+			s.addBasicToken(QUESTION_QUESTION)
+		} else if s.match('.') {
+			s.addBasicToken(QUESTION_DOT)
+		} else {
+			s.addBasicToken(QUESTION)
+		}
+	case '~':
+		if s.match('/') {
+			s.addBasicToken(TILDE_SLASH) //integer division
+		} else {
+			s.addBasicToken(TILDE)
+		}
+	case '-':
+		if s.match('-') {
+			s.addBasicToken(MINUS_MINUS)
+		} else if s.match('=') {
+			s.addBasicToken(MINUS_EQUAL)
+		} else {
+			s.addBasicToken(MINUS)
+		}
+	case '+':
+		if s.match('+') {
+			s.addBasicToken(PLUS_PLUS)
+		} else if s.match('=') {
+			s.addBasicToken(PLUS_EQUAL)
+		} else {
+			s.addBasicToken(PLUS)
+		}
+	case '*':
+		if s.match('*') {
+			s.addBasicToken(STAR_STAR)
+		} else if s.match('=') {
+			s.addBasicToken(STAR_EQUAL)
+		} else {
+			s.addBasicToken(STAR)
+		}
 
 	//special case for /
 	case '/':
@@ -121,12 +212,13 @@ func (s *Scanner) scanToken() {
 			for s.peek() != '\n' && !s.isAtEnd() {
 				s.advance()
 			}
+			s.addComment(false)
 
 			//challenge: implement /**/ comments
 		} else if s.match('*') {
-			for s.peek() != '*' && s.peekNext() != '/' && !s.isAtEnd() {
-				s.advance()
-			}
+			s.blockComment()
+		} else if s.match('=') {
+			s.addBasicToken(SLASH_EQUAL)
 		} else {
 			s.addBasicToken(SLASH)
 		}
@@ -136,7 +228,7 @@ func (s *Scanner) scanToken() {
 	case '\r':
 	case '\t':
 	case '\n':
-		s.line++
+		s.newLine()
 
 	//strings
 	case '"':
@@ -152,20 +244,36 @@ func (s *Scanner) scanToken() {
 		} else if s.isAlpha(c) {
 			s.addIdentifier()
 
-		} else {
-			s.error(s.curr, "Unexpected char")
+		} else if !s.invalidByte(s.start) { //already reported by advance()
+			s.error(E_UNEXPECTED_CHAR, "Unexpected character.")
 		}
 
 	}
 }
 
-// Return next character in source, advance curr iterater
+// Return next character in source (a whole UTF-8 code point), advance curr iterater past it
 func (s *Scanner) advance() rune {
-	next := rune(s.source[s.curr])
-	s.curr++
+	if s.invalidByte(s.curr) {
+		//one error for the whole bad sequence: a truncated code point leaves continuation bytes that would each fail too
+		end := s.curr + 1
+		for end < len(s.source) && end-s.curr < utf8.UTFMax && !utf8.RuneStart(s.source[end]) {
+			end++
+		}
+		s.errorSpan(s.curr, end, E_INVALID_UTF8, "Invalid UTF-8 encoding.")
+		s.curr = end
+		return utf8.RuneError
+	}
+	next, size := utf8.DecodeRuneInString(s.source[s.curr:])
+	s.curr += size
 	return next
 }
 
+// Whether the byte at offset can't start a UTF-8 code point (a real U+FFFD in the source is fine)
+func (s *Scanner) invalidByte(offset int) bool {
+	r, size := utf8.DecodeRuneInString(s.source[offset:])
+	return r == utf8.RuneError && size == 1
+}
+
 /**ADDERS**/
 
 // Create new token for the current lexeme with a "nil" ltieral
@@ -177,53 +285,220 @@ func (s *Scanner) addBasicToken(kind TokenType) {
 func (s *Scanner) addToken(kind TokenType, literal interface{}) {
 	//extract lexeme
 	text := s.source[s.start:s.curr]
-	s.tokens = append(s.tokens, Token{kind: kind, lexeme: text, literal: literal, line: s.line})
+	s.tokens = append(s.tokens, Token{kind: kind, lexeme: text, literal: literal, line: s.startLine, column: s.startColumn, trivia: s.takeTrivia(), scan: s.scan})
+}
+
+// Consumes a /* */ comment up to the "*/" that matches its "/*", so they nest
+func (s *Scanner) blockComment() {
+	for depth := 1; depth > 0; {
+		if s.isAtEnd() {
+			s.error(E_UNTERMINATED_COMMENT, "Unterminated block comment.")
+			return
+		}
+		c := s.advance()
+		switch {
+		case c == '\n':
+			s.newLine()
+		case c == '/' && s.peek() == '*':
+			s.advance()
+			depth++
+		case c == '*' && s.peek() == '/':
+			s.advance()
+			depth--
+		}
+	}
+	s.addComment(true)
 }
 
-// Adds a string token
+// Keeps the comment just scanned so it can ride along on the next token
+func (s *Scanner) addComment(block bool) {
+	trailing := len(s.tokens) > 0 && s.tokens[len(s.tokens)-1].line == s.startLine
+	s.comments = append(s.comments, Comment{text: s.source[s.start:s.curr], line: s.startLine, column: s.startColumn, block: block, trailing: trailing})
+}
+
+// Hands over any comments waiting for a token
+func (s *Scanner) takeTrivia() *Trivia {
+	if len(s.comments) == 0 {
+		return nil
+	}
+	trivia := &Trivia{comments: s.comments}
+	s.comments = nil
+	return trivia
+}
+
+// Adds a string token, or for "a ${b} c" one INTERPOLATION token per piece ending in "${"
+// and an INTERPOLATION_END for the last, with b's tokens in between. The literal has escapes applied
 func (s *Scanner) addString() {
+	var value strings.Builder
 	//while still in string & not at end, keep consuming
 	for s.peek() != '"' && !s.isAtEnd() {
-		if s.peek() == '\n' {
-			s.line++
+		c := s.advance()
+		switch {
+		case c == '\n':
+			s.newLine()
+			value.WriteRune(c)
+		case c == '\\':
+			s.escape(&value)
+		case c == '$' && s.peek() == '{':
+			s.advance()
+			s.addToken(INTERPOLATION, value.String())
+			s.interpolations = append(s.interpolations, 0)
+			return
+		default:
+			value.WriteRune(c)
 		}
-		s.advance()
 	}
 
 	//if didn't close "" before end of line, throw error
 	if s.isAtEnd() {
-		s.error(s.curr, "Unterminated string")
+		s.error(E_UNTERMINATED_STRING, "Unterminated string.")
 		return
 	}
 
 	s.advance() //consumes closing "
 
 	//add whole string to token list
-	value := s.source[s.start+1 : s.curr-1]
-	s.addToken(STRING, value)
+	if s.source[s.start] == '}' {
+		s.addToken(INTERPOLATION_END, value.String())
+	} else {
+		s.addToken(STRING, value.String())
+	}
+}
+
+var escapes = map[rune]rune{'n': '\n', 't': '\t', 'r': '\r', '0': 0, '"': '"', '\\': '\\', '$': '$'}
 
+// Reads the escape sequence after a backslash: \n \t \r \0 \" \\ \$ or \u{1F600}
+func (s *Scanner) escape(value *strings.Builder) {
+	backslash := s.curr - 1
+	if s.isAtEnd() {
+		return //reported as an unterminated string
+	}
+	c := s.advance()
+	if r, known := escapes[c]; known {
+		value.WriteRune(r)
+		return
+	}
+	if c != 'u' {
+		s.errorAt(backslash, E_BAD_ESCAPE, "Unknown escape sequence.")
+		if c == '\n' {
+			s.newLine()
+		}
+		return
+	}
+
+	//\u{...}: 1 to 6 hex digits naming a code point
+	if !s.match('{') {
+		s.errorAt(backslash, E_BAD_ESCAPE, "Expect '{' after '\\u'.")
+		return
+	}
+	digits := s.curr
+	for s.isHexDigit(s.peek()) {
+		s.advance()
+	}
+	hex := s.source[digits:s.curr]
+	code, err := strconv.ParseUint(hex, 16, 32)
+	if !s.match('}') || err != nil || len(hex) > 6 || code > unicode.MaxRune || (code >= 0xD800 && code <= 0xDFFF) {
+		s.errorAt(backslash, E_BAD_ESCAPE, "Invalid unicode escape; expect 1 to 6 hex digits naming a code point, like \\u{1F600}.")
+		return
+	}
+	value.WriteRune(rune(code))
 }
 
-// Adds a number token
+// Adds a number token: an int64 for 42, 0xFF, 0b1010 and 1_000_000, a float64 once there's
+// a fraction or exponent (1.5, 1.5e-3, 2E10). Letters or digits straight after one (1e,
+// 0b102, 12px) make the whole run a single invalid literal
 func (s *Scanner) addNumber() {
-	//keep advancing until no more numbers
-	for s.isDigit(s.peek()) {
+	errors := len(s.diagnostics)
+	value, complete := s.number()
+	if !complete || s.isAlphaNumeric(s.peek()) {
+		for s.isAlphaNumeric(s.peek()) {
+			s.advance()
+		}
+		if len(s.diagnostics) == errors {
+			s.error(E_BAD_NUMBER, fmt.Sprintf("Invalid number literal '%s'.", s.source[s.start:s.curr]))
+		}
+	}
+	//still a number after an error, so the parser doesn't pile more errors on top
+	s.addToken(NUMBER, value)
+}
+
+// Scans a number's digits and gives back its value; complete is false when it stops
+// partway, like an exponent with no digits
+func (s *Scanner) number() (value interface{}, complete bool) {
+	//0x & 0b prefixes
+	if prefix := s.peek(); s.source[s.start] == '0' && (prefix == 'x' || prefix == 'X' || prefix == 'b' || prefix == 'B') {
+		base, isDigit := 16, s.isHexDigit
+		if prefix == 'b' || prefix == 'B' {
+			base, isDigit = 2, s.isBinaryDigit
+		}
 		s.advance()
+		digits := s.digits(isDigit)
+		if digits == "" {
+			s.error(E_BAD_NUMBER, fmt.Sprintf("Expect digits after '%s'.", s.source[s.start:s.curr]))
+			return int64(0), true
+		}
+		return s.integer(digits, base), true
 	}
 
+	//keep advancing until no more numbers (rescanning the first so separators are checked from it)
+	s.curr = s.start
+	text := s.digits(s.isDigit)
+	isFloat := false
+
 	//check for decimal
 	if s.peek() == '.' && s.isDigit(s.peekNext()) {
 		//consume .
 		s.advance()
 		//get fractional parts
-		for s.isDigit(s.peek()) {
-			s.advance()
+		text += "." + s.digits(s.isDigit)
+		isFloat = true
+	}
+
+	//exponent, which needs digits (1e and 1e+ are incomplete)
+	if e := s.peek(); e == 'e' || e == 'E' {
+		s.advance()
+		sign := ""
+		if s.peek() == '+' || s.peek() == '-' {
+			sign = string(s.advance())
+		}
+		if s.isDigit(s.peek()) {
+			text += "e" + sign + s.digits(s.isDigit)
+			isFloat = true
+		} else {
+			return float64(0), false
 		}
 	}
 
+	if !isFloat {
+		return s.integer(text, 10), true
+	}
 	//convert number string to float
-	value, _ := strconv.ParseFloat(s.source[s.start:s.curr], 64)
-	s.addToken(NUMBER, value)
+	float, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		s.error(E_BAD_NUMBER, "Number literal is too large.")
+	}
+	return float, true
+}
+
+// Digits (for a base) with optional _ separators, which have to sit between two digits
+func (s *Scanner) digits(isDigit func(rune) bool) string {
+	start := s.curr
+	for isDigit(s.peek()) || s.peek() == '_' {
+		s.advance()
+	}
+	run := s.source[start:s.curr]
+	if strings.HasPrefix(run, "_") || strings.HasSuffix(run, "_") || strings.Contains(run, "__") {
+		s.error(E_BAD_NUMBER, "Digit separators ('_') can only go between digits.")
+	}
+	return strings.ReplaceAll(run, "_", "")
+}
+
+func (s *Scanner) integer(digits string, base int) int64 {
+	value, err := strconv.ParseInt(digits, base, 64)
+	if err != nil {
+		s.error(E_BAD_NUMBER, fmt.Sprintf("Integer literal is too large; the largest is %d.", int64(math.MaxInt64)))
+	}
+	return value
 }
 
 // Adds a longer lexeme token
@@ -259,12 +534,13 @@ func (s *Scanner) match(expected rune) bool {
 	}
 
 	//or if chars dont match
-	if rune(s.source[s.curr]) != expected {
+	next, size := utf8.DecodeRuneInString(s.source[s.curr:])
+	if next != expected {
 		return false
 	}
 
 	//must be true otherwise, consume next char
-	s.curr++
+	s.curr += size
 	return true
 }
 
@@ -273,18 +549,24 @@ func (s *Scanner) peek() rune {
 	if s.isAtEnd() {
 		return '\000'
 	}
-	return rune(s.source[s.curr])
+	next, _ := utf8.DecodeRuneInString(s.source[s.curr:])
+	return next
 }
 
 // Lookahead for next next character
 func (s *Scanner) peekNext() rune {
 	//return nil if reach out of bounds
-	if (s.curr + 1) >= len(s.source) {
+	if s.isAtEnd() {
+		return '\000'
+	}
+	_, size := utf8.DecodeRuneInString(s.source[s.curr:])
+	if s.curr+size >= len(s.source) {
 		return '\000'
 	}
 
 	//return 2 ahead
-	return rune(s.source[s.curr+1])
+	next, _ := utf8.DecodeRuneInString(s.source[s.curr+size:])
+	return next
 }
 
 // Checks if input is a number literal
@@ -292,19 +574,55 @@ func (s *Scanner) isDigit(c rune) bool {
 	return c >= '0' && c <= '9'
 }
 
+func (s *Scanner) isBinaryDigit(c rune) bool {
+	return c == '0' || c == '1'
+}
+
+// Checks if input can be part of a \u{...} escape
+func (s *Scanner) isHexDigit(c rune) bool {
+	return s.isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
 // Checks if character is a letter
 func (s *Scanner) isAlpha(c rune) bool {
-	//only allows a-z, A-Z, or underscores
-	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c == '_')
+	//a-z, A-Z, underscores, or a letter from any other script
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c == '_') || (c >= utf8.RuneSelf && unicode.IsLetter(c))
 }
 
 // Checks if is a number or a digit
 func (s *Scanner) isAlphaNumeric(c rune) bool {
-	return s.isAlpha(c) || s.isDigit(c)
+	//combining marks too, so a decomposed é (e + U+0301) stays one identifier
+	return s.isAlpha(c) || s.isDigit(c) || (c >= utf8.RuneSelf && unicode.IsMark(c))
+}
+
+// Bookkeeping after consuming a '\n'
+func (s *Scanner) newLine() {
+	s.line++
+	s.lineStart = s.curr
+}
+
+// 1-based column of a source offset on the current line, counted in code points
+func (s *Scanner) column(offset int) int {
+	return utf8.RuneCountInString(s.source[s.lineStart:offset]) + 1
 }
 
 /**Errors**/
-func (s *Scanner) error(line int, msg string) {
-	fmt.Println("[line ", line, "] Error: ", msg)
+// Records an error at the start of the lexeme being scanned
+func (s *Scanner) error(code string, msg string) {
+	token := Token{lexeme: s.source[s.start:s.curr], line: s.startLine, column: s.startColumn}
+	s.diagnostics = append(s.diagnostics, newDiagnostic(SCAN_PHASE, code, token, msg))
+	s.hadError = true
+}
+
+// Records an error at one character on the current line, rather than the whole lexeme
+func (s *Scanner) errorAt(offset int, code string, msg string) {
+	_, size := utf8.DecodeRuneInString(s.source[offset:])
+	s.errorSpan(offset, offset+size, code, msg)
+}
+
+// Records an error over the bytes [offset, end) of the current line
+func (s *Scanner) errorSpan(offset, end int, code string, msg string) {
+	token := Token{lexeme: s.source[offset:end], line: s.line, column: s.column(offset)}
+	s.diagnostics = append(s.diagnostics, newDiagnostic(SCAN_PHASE, code, token, msg))
 	s.hadError = true
 }
@@ -2,7 +2,7 @@
 * File to create the syntax tree for statements
 * Similar structure to the expression file
 * Created: 9/25
-* Modified: 10/7
+* Modified: 10/19
  */
 
 package main
@@ -14,13 +14,27 @@ type Stmt interface {
 
 // specific types
 type BlockStmt struct {
+	brace Token
 	statements []Stmt
+	closing Token
+}
+
+type BreakStmt struct {
+	keyword Token
 }
 
 type ClassStmt struct {
 	name Token
 	superclass *VariableExpr
-	methods []FunctionStmt
+	traits []VariableExpr //"with" classes whose methods (and fields) are mixed in
+	methods []FunctionStmt //static ones, getters and setters too
+	fields []VarStmt //"var name = value;", set on each new instance before init runs
+	closing Token
+	doc string //text of the /** */ comment just before it, if any
+}
+
+type ContinueStmt struct {
+	keyword Token
 }
 
 type ExpressionStmt struct {
@@ -29,25 +43,59 @@ type ExpressionStmt struct {
 
 //Im tired of dealing with that damn syntatic sugar!!!!!!!!!!!!!!
 type ForStmt struct {
+	keyword Token
 	initializer Stmt
 	condition Expr
 	increment Expr
 	body Stmt
 }
 
+//for (var name in iterable) body, with name bound afresh each time around
+type ForInStmt struct {
+	keyword Token
+	name Token
+	iterable Expr
+	body Stmt
+}
+
 type FunctionStmt struct {
 	name Token
 	params []Token
+	defaults []Expr //each parameter's default value (nil for none), or nil if no parameter has one
+	hasRest bool //the last parameter is "...name", a list of the arguments left over
 	body []Stmt
+	closing Token
+	doc string
+	isGenerator bool //there's a yield in the body (not counting nested functions)
+	isStatic bool //a "class" method, called on the class itself
+	isGetter bool //a method without a parameter list, run whenever it's read
+	isSetter bool //"set name(value)", run whenever name is assigned to
+}
+
+//How many arguments the function needs and takes (max is -1 with a rest parameter)
+func (f FunctionStmt) arityRange() (min int, max int) {
+	max = len(f.params)
+	if f.hasRest {
+		max--
+	}
+	for min < max && (f.defaults == nil || f.defaults[min] == nil) {
+		min++
+	}
+	if f.hasRest {
+		max = -1
+	}
+	return min, max
 }
 
 type IfStmt struct {
+	keyword Token
 	condition Expr
 	thenBranch Stmt
 	elseBranch Stmt
 }
 
 type PrintStmt struct {
+	keyword Token
 	expression Expr
 }
 
@@ -59,25 +107,36 @@ type ReturnStmt struct {
 type VarStmt struct {
 	name        Token
 	initializer Expr
+	doc         string
 }
 
 type WhileStmt struct {
+	keyword Token
 	condition Expr
 	body Stmt
 }
 
+type YieldStmt struct {
+	keyword Token
+	value Expr
+}
+
 /**VISITOR**/
 type StmtVisitor interface {
 	visitBlockStmt(stmt BlockStmt) interface{}
+	visitBreakStmt(stmt BreakStmt) interface{}
 	visitClassStmt(stmt ClassStmt) interface{}
+	visitContinueStmt(stmt ContinueStmt) interface{}
 	visitExpressionStmt(stmt ExpressionStmt) interface{}
 	visitForStmt(stmt ForStmt) interface{}
+	visitForInStmt(stmt ForInStmt) interface{}
 	visitFunctionStmt(stmt FunctionStmt) interface{}
 	visitIfStmt(stmt IfStmt) interface{}
 	visitPrintStmt(stmt PrintStmt) interface{}
 	visitReturnStmt(stmt ReturnStmt) interface{}
 	visitVarStmt(stmt VarStmt) interface{}
 	visitWhileStmt(stmt WhileStmt) interface{}
+	visitYieldStmt(stmt YieldStmt) interface{}
 }
 
 /**Accept funcs**/
@@ -85,10 +144,18 @@ func (s BlockStmt) accept(v StmtVisitor) interface{} {
 	return v.visitBlockStmt(s)
 }
 
+func (s BreakStmt) accept(v StmtVisitor) interface{} {
+	return v.visitBreakStmt(s)
+}
+
 func (s ClassStmt) accept(v StmtVisitor) interface{} {
 	return v.visitClassStmt(s)
 }
 
+func (s ContinueStmt) accept(v StmtVisitor) interface{} {
+	return v.visitContinueStmt(s)
+}
+
 func (s ExpressionStmt) accept(v StmtVisitor) interface{} {
 	return v.visitExpressionStmt(s)
 }
@@ -97,6 +164,10 @@ func (s ForStmt) accept(v StmtVisitor) interface{} {
 	return v.visitForStmt(s)
 }
 
+func (s ForInStmt) accept(v StmtVisitor) interface{} {
+	return v.visitForInStmt(s)
+}
+
 func (s FunctionStmt) accept(v StmtVisitor) interface{} {
 	return v.visitFunctionStmt(s)
 }
@@ -120,3 +191,88 @@ func (s VarStmt) accept(v StmtVisitor) interface{} {
 func (s WhileStmt) accept(v StmtVisitor) interface{} {
 	return v.visitWhileStmt(s)
 }
+
+func (s YieldStmt) accept(v StmtVisitor) interface{} {
+	return v.visitYieldStmt(s)
+}
+
+/**POSITIONS**/
+//First token of a statement (or near enough: the name of a declaration), for tooling that works a statement at a time
+func stmtToken(stmt Stmt) Token {
+	switch s := stmt.(type) {
+	case BlockStmt:
+		return s.brace
+	case BreakStmt:
+		return s.keyword
+	case ClassStmt:
+		return s.name
+	case ContinueStmt:
+		return s.keyword
+	case ExpressionStmt:
+		return exprToken(s.expression)
+	case ForStmt:
+		return s.keyword
+	case ForInStmt:
+		return s.keyword
+	case FunctionStmt:
+		return s.name
+	case IfStmt:
+		return s.keyword
+	case PrintStmt:
+		return s.keyword
+	case ReturnStmt:
+		return s.keyword
+	case VarStmt:
+		return s.name
+	case WhileStmt:
+		return s.keyword
+	case YieldStmt:
+		return s.keyword
+	}
+	return Token{}
+}
+
+//Line a statement starts on
+func stmtLine(stmt Stmt) int {
+	return stmtToken(stmt).line
+}
+
+//Line a statement ends on (as far as the tree can tell: the end of its last token before the ';')
+func stmtEndLine(stmt Stmt) int {
+	switch s := stmt.(type) {
+	case BlockStmt:
+		return s.closing.line
+	case ClassStmt:
+		return s.closing.line
+	case FunctionStmt:
+		return s.closing.line
+	case ForStmt:
+		return stmtEndLine(s.body)
+	case ForInStmt:
+		return stmtEndLine(s.body)
+	case WhileStmt:
+		return stmtEndLine(s.body)
+	case IfStmt:
+		if s.elseBranch != nil {
+			return stmtEndLine(s.elseBranch)
+		}
+		return stmtEndLine(s.thenBranch)
+	case ExpressionStmt:
+		return exprEndLine(s.expression)
+	case PrintStmt:
+		return exprEndLine(s.expression)
+	case ReturnStmt:
+		if s.value != nil {
+			return exprEndLine(s.value)
+		}
+	case YieldStmt:
+		if s.value != nil {
+			return exprEndLine(s.value)
+		}
+	case VarStmt:
+		if s.initializer != nil {
+			return exprEndLine(s.initializer)
+		}
+	}
+	return stmtLine(stmt)
+}
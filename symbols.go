@@ -0,0 +1,179 @@
+/*
+* Symbol table the resolver can fill in as it walks scopes, so tooling (the language server)
+* can answer "where is this declared?" and "who uses it?" without running anything
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type SymbolKind int
+
+const (
+	VAR_SYMBOL SymbolKind = iota
+	PARAM_SYMBOL
+	FUNCTION_SYMBOL
+	CLASS_SYMBOL
+	METHOD_SYMBOL
+)
+
+type Symbol struct {
+	name       Token
+	kind       SymbolKind
+	params     []Token   //functions & methods
+	required   int       //how many params have no default
+	rest       bool      //the last param is a rest parameter
+	superclass string    //classes
+	traits     []string  //classes
+	methods    []*Symbol //classes
+	container  *Symbol   //class a method belongs to
+	modifier   string    //"class", "set" or "get" for methods that aren't plain ones
+	references []Token
+	doc        string //the declaration's /** */ comment
+}
+
+// One line summary used for hovers and completion details
+func (sym *Symbol) describe() string {
+	switch sym.kind {
+	case FUNCTION_SYMBOL, METHOD_SYMBOL:
+		var params []string
+		fixed := len(sym.params)
+		if sym.rest {
+			fixed--
+		}
+		for i, p := range sym.params {
+			switch {
+			case i == fixed:
+				params = append(params, "..."+p.lexeme)
+			case i >= sym.required:
+				params = append(params, p.lexeme+"?")
+			default:
+				params = append(params, p.lexeme)
+			}
+		}
+		arity := fmt.Sprint(sym.required)
+		if sym.rest {
+			arity += "+"
+		} else if fixed > sym.required {
+			arity += fmt.Sprintf("-%d", fixed)
+		}
+		prefix := "fun "
+		if sym.kind == METHOD_SYMBOL {
+			prefix = sym.container.name.lexeme + "."
+			if sym.modifier == "get" {
+				return fmt.Sprintf("get %s%s", prefix, sym.name.lexeme)
+			}
+			if sym.modifier != "" {
+				prefix = sym.modifier + " " + prefix
+			}
+		}
+		return fmt.Sprintf("%s%s(%s) (arity %s)", prefix, sym.name.lexeme, strings.Join(params, ", "), arity)
+	case CLASS_SYMBOL:
+		header := "class " + sym.name.lexeme
+		if sym.superclass != "" {
+			header += " < " + sym.superclass
+		}
+		if len(sym.traits) > 0 {
+			header += " with " + strings.Join(sym.traits, ", ")
+		}
+		return header
+	case PARAM_SYMBOL:
+		return "parameter " + sym.name.lexeme
+	}
+	return "var " + sym.name.lexeme
+}
+
+type SymbolTable struct {
+	declarations []*Symbol //every symbol, in source order
+	globals      map[string]*Symbol
+	scopes       []map[string]*Symbol //mirrors the resolver's scope stack
+	unresolved   []Token              //global references, bound once the whole file is seen
+	lookup       map[Token]*Symbol    //declaration & reference tokens -> symbol
+}
+
+func newSymbolTable() *SymbolTable {
+	return &SymbolTable{globals: make(map[string]*Symbol), lookup: make(map[Token]*Symbol)}
+}
+
+/**Hooks called by the resolver**/
+func (st *SymbolTable) beginScope() {
+	st.scopes = append(st.scopes, make(map[string]*Symbol))
+}
+
+func (st *SymbolTable) endScope() {
+	st.scopes = st.scopes[:len(st.scopes)-1]
+}
+
+// Adds a symbol to the innermost scope (or the globals at top level)
+func (st *SymbolTable) declare(sym *Symbol) {
+	st.declarations = append(st.declarations, sym)
+	st.lookup[sym.name] = sym
+	if len(st.scopes) == 0 {
+		if _, exists := st.globals[sym.name.lexeme]; !exists {
+			st.globals[sym.name.lexeme] = sym
+		}
+		return
+	}
+	st.scopes[len(st.scopes)-1][sym.name.lexeme] = sym
+}
+
+// Methods aren't variables, so they hang off their class instead of a scope
+func (st *SymbolTable) declareMethod(class *Symbol, method *Symbol) {
+	method.container = class
+	class.methods = append(class.methods, method)
+	st.declarations = append(st.declarations, method)
+	st.lookup[method.name] = method
+}
+
+// Records a use that the resolver found in scope number depth (counting from the outside)
+func (st *SymbolTable) reference(name Token, scope int) {
+	sym := st.scopes[scope][name.lexeme]
+	if sym == nil {
+		return //this & super have no declaration to point at
+	}
+	sym.references = append(sym.references, name)
+	st.lookup[name] = sym
+}
+
+// Records a use that wasn't found in any local scope
+func (st *SymbolTable) referenceGlobal(name Token) {
+	st.unresolved = append(st.unresolved, name)
+}
+
+// Binds the global references now that every top level declaration is known
+func (st *SymbolTable) finish() {
+	for _, name := range st.unresolved {
+		if sym, exists := st.globals[name.lexeme]; exists {
+			sym.references = append(sym.references, name)
+			st.lookup[name] = sym
+		}
+	}
+	st.unresolved = nil
+}
+
+/**Queries**/
+// Finds the symbol whose declaration or reference covers line:column
+// (a cursor sitting just after a name still counts as on it)
+func (st *SymbolTable) symbolAt(line int, column int) (*Symbol, Token) {
+	for token, sym := range st.lookup {
+		if token.line == line && column >= token.column && column <= token.column+len([]rune(token.lexeme)) {
+			return sym, token
+		}
+	}
+	return nil, Token{}
+}
+
+// Every method of every class, used to complete after a "."
+func (st *SymbolTable) allMethods() []*Symbol {
+	var methods []*Symbol
+	for _, sym := range st.declarations {
+		if sym.kind == METHOD_SYMBOL {
+			methods = append(methods, sym)
+		}
+	}
+	return methods
+}
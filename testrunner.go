@@ -0,0 +1,272 @@
+/*
+* Test runner ("glox test [dir|file...]"). Every top level "fun test_*()" in a .lox file is a
+* test; each one gets a fresh Interpreter that runs the file's top level and then calls it.
+* Failures point at the assertion that failed, and --junit writes a report for CI
+* Created: 10/19
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const TEST_PREFIX = "test_"
+
+type TestResult struct {
+	file     string
+	name     string
+	passed   bool
+	failure  *Diagnostic //first error, nil when it passed
+	output   string      //whatever the test printed
+	duration time.Duration
+}
+
+// Runs every test in one file. A file that doesn't scan, parse or resolve fails as a whole
+func runTestFile(path string) []TestResult {
+	start := time.Now()
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []TestResult{{file: path, name: filepath.Base(path), failure: &Diagnostic{file: path, msg: "could not read file"}}}
+	}
+
+	//parsed and resolved once, however many tests there are
+	program := prepare(string(source))
+	if len(program.diagnostics) > 0 {
+		failure := program.diagnostics[0]
+		failure.file = path
+		return []TestResult{{file: path, name: filepath.Base(path), failure: &failure, duration: time.Since(start)}}
+	}
+
+	var results []TestResult
+	for _, stmt := range program.statements {
+		fun, isFun := stmt.(FunctionStmt)
+		if isFun && strings.HasPrefix(fun.name.lexeme, TEST_PREFIX) {
+			results = append(results, runTest(path, program, fun))
+		}
+	}
+	return results
+}
+
+// One test on its own interpreter: the file's top level, then a call to the test function
+func runTest(path string, program *Program, test FunctionStmt) TestResult {
+	start := time.Now()
+	result := TestResult{file: path, name: test.name.lexeme}
+	if len(test.params) > 0 {
+		result.failure = &Diagnostic{file: path, line: test.name.line, column: test.name.column, msg: "Test functions can't take parameters."}
+		return result
+	}
+
+	var output bytes.Buffer
+	itpr := newInterpreter()
+	itpr.out = &output
+	defer itpr.closeGenerators()
+
+	//the call is a statement of its own, so errors in it come back as diagnostics like any other
+	diagnostics := program.run(itpr)
+	if len(diagnostics) == 0 {
+		call := ExpressionStmt{expression: CallExpr{callee: VariableExpr{name: test.name}, paren: test.name}}
+		itpr.interpret([]Stmt{call})
+		diagnostics = itpr.diagnostics
+	}
+	if len(diagnostics) > 0 {
+		failure := diagnostics[0]
+		failure.file = path
+		result.failure = &failure
+	}
+
+	result.passed = result.failure == nil
+	result.output = output.String()
+	result.duration = time.Since(start)
+	return result
+}
+
+// The .lox files to look in: files as given, directories searched all the way down
+func findTestFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.HasSuffix(file, ".lox") {
+				files = append(files, file)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+/**REPORTS**/
+// go test style: failures (and with verbose, passes) then a one line total
+func writeTestReport(w io.Writer, results []TestResult, verbose bool) {
+	passed := 0
+	for _, r := range results {
+		if r.passed {
+			passed++
+			if verbose {
+				fmt.Fprintf(w, "--- PASS: %s (%s) (%v)\n", r.name, r.file, r.duration.Round(time.Microsecond))
+				writeIndented(w, r.output)
+			}
+			continue
+		}
+
+		fmt.Fprintf(w, "--- FAIL: %s (%s) (%v)\n", r.name, r.file, r.duration.Round(time.Microsecond))
+		writeIndented(w, r.output)
+		fmt.Fprintf(w, "    %s:%d:%d: %s\n", r.failure.file, r.failure.line, r.failure.column, r.failure.msg)
+	}
+
+	if passed == len(results) {
+		fmt.Fprintf(w, "ok\t%d passed\n", passed)
+	} else {
+		fmt.Fprintf(w, "FAIL\t%d passed, %d failed\n", passed, len(results)-passed)
+	}
+}
+
+func writeIndented(w io.Writer, text string) {
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if line != "" {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// One <testsuite> per file
+func writeJUnit(w io.Writer, results []TestResult) error {
+	var suites junitSuites
+	index := make(map[string]int)
+	for _, r := range results {
+		i, exists := index[r.file]
+		if !exists {
+			i = len(suites.Suites)
+			index[r.file] = i
+			suites.Suites = append(suites.Suites, junitSuite{Name: r.file})
+		}
+		suite := &suites.Suites[i]
+
+		c := junitCase{Name: r.name, ClassName: strings.TrimSuffix(r.file, ".lox"), Time: seconds(r.duration), SystemOut: r.output}
+		if !r.passed {
+			suite.Failures++
+			c.Failure = &junitFailure{Message: r.failure.msg, Type: r.failure.code,
+				Text: fmt.Sprintf("%s:%d:%d: %s", r.failure.file, r.failure.line, r.failure.column, r.failure.msg)}
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, c)
+	}
+	for i := range suites.Suites {
+		var total time.Duration
+		for _, r := range results {
+			if r.file == suites.Suites[i].Name {
+				total += r.duration
+			}
+		}
+		suites.Suites[i].Time = seconds(total)
+	}
+
+	io.WriteString(w, xml.Header)
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.6f", d.Seconds())
+}
+
+/**COMMAND**/
+// glox test [-v] [--junit=report.xml] [dirs or files...]; exits 1 if anything failed
+func runTests(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "list passing tests and their output too")
+	junit := flags.String("junit", "", "also write a JUnit XML report to this file")
+	if err := flags.Parse(args); err != nil {
+		return 64
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	files, err := findTestFiles(paths)
+	if err != nil {
+		fmt.Fprintln(stdout, "Error:", err)
+		return 66
+	}
+
+	var results []TestResult
+	for _, file := range files {
+		results = append(results, runTestFile(file)...)
+	}
+	writeTestReport(stdout, results, *verbose)
+
+	if *junit != "" {
+		report, err := os.Create(*junit)
+		if err != nil {
+			fmt.Fprintln(stdout, "Error:", err)
+			return 1
+		}
+		defer report.Close()
+		if err := writeJUnit(report, results); err != nil {
+			fmt.Fprintln(stdout, "Error:", err)
+			return 1
+		}
+	}
+
+	for _, r := range results {
+		if !r.passed {
+			return 1
+		}
+	}
+	return 0
+}
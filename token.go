@@ -0,0 +1,133 @@
+/*
+* Defines the token types produced by the scanner and the Token struct
+* that carries each lexeme (and where it was found) through the rest of the pipeline
+* Created: 9/6
+* Modified: 10/19
+ */
+
+package main
+
+import "fmt"
+
+type TokenType int
+
+const (
+	//single-character tokens
+	LEFT_PAREN TokenType = iota
+	RIGHT_PAREN
+	LEFT_BRACE
+	RIGHT_BRACE
+	COMMA
+	DOT
+	MINUS
+	PLUS
+	SEMICOLON
+	SLASH
+	STAR
+	LEFT_BRACKET
+	RIGHT_BRACKET
+	PERCENT
+	AMPERSAND
+	PIPE
+	CARET
+	COLON
+
+	//one or two character tokens
+	BANG
+	BANG_EQUAL
+	EQUAL
+	EQUAL_EQUAL
+	GREATER
+	GREATER_EQUAL
+	GREATER_GREATER
+	LESS
+	LESS_EQUAL
+	LESS_LESS
+	TILDE
+	TILDE_SLASH
+	STAR_STAR
+	PLUS_PLUS
+	MINUS_MINUS
+	PLUS_EQUAL
+	MINUS_EQUAL
+	STAR_EQUAL
+	SLASH_EQUAL
+	QUESTION
+	QUESTION_QUESTION
+	QUESTION_DOT
+	ELLIPSIS //"...", for rest parameters and spreading a list into a call
+
+	//literals
+	IDENTIFIER
+	STRING
+	INTERPOLATION     //a piece of string that runs up to a "${"
+	INTERPOLATION_END //the last piece, from the final "}" to the closing quote
+	NUMBER
+
+	//keywords
+	AND
+	BREAK
+	CLASS
+	CONTINUE
+	ELSE
+	FALSE
+	FUN
+	FOR
+	IF
+	IN
+	NIL
+	OR
+	PRINT
+	RETURN
+	SUPER
+	THIS
+	TRUE
+	VAR
+	WHILE
+	YIELD
+	SPAWN
+	AWAIT
+
+	EOF
+)
+
+type Token struct {
+	kind    TokenType
+	lexeme  string
+	literal interface{}
+	line    int
+	column  int
+	trivia  *Trivia //comments found just before this token, nil if none
+	scan    uint64  //which Scanner made it, so tokens from two sources never compare equal
+}
+
+// Comments aren't tokens, but tooling like the formatter needs them back,
+// so the scanner hangs them off the token that follows them
+type Trivia struct {
+	comments []Comment
+}
+
+type Comment struct {
+	text     string //including the // or /* */
+	line     int
+	column   int
+	block    bool
+	trailing bool //shares its line with code that comes before it
+}
+
+// Comments attached to a token (safe on tokens without trivia)
+func (t Token) comments() []Comment {
+	if t.trivia == nil {
+		return nil
+	}
+	return t.trivia.comments
+}
+
+func (t Token) String() string {
+	return fmt.Sprintf("%d %s %v", t.kind, t.lexeme, t.literal)
+}
+
+// Whether a position comes before a token's position
+func before(line int, column int, t Token) bool {
+	return line < t.line || (line == t.line && column < t.column)
+}